@@ -0,0 +1,248 @@
+package main
+
+/**
+ * 后台接口的认证和审计
+ * 1、每个操作人一个凭证，配置在 Provider-Backend-Operator
+ *    "ops-name": {"token": "xxx", "key": "yyy", "role": "admin"}
+ * 2、两种认证方式
+ *    Bearer: 请求头 Authorization: Bearer <token>
+ *    签名:   请求头 BUGLE-BACKEND-OPERATOR / BUGLE-BACKEND-TIME / BUGLE-BACKEND-SIGN
+ *            SIGN = hex(hmac_sha256(key, METHOD\nPATH\nQUERY\nTIME\nBODY))，TIME 为unix秒，误差不超过5分钟
+ *            误差范围内同一个签名只能用一次，防止重放，相同的请求在QUERY中加随机的 nonce 参数区分
+ * 3、角色 readonly 只能调用查询接口，admin 可以调用所有接口
+ * 4、兼容老的 backend=口令 参数(配置了 BackendPasswd 时)，视为admin，建议尽快迁移，默认不配置
+ * 5、所有后台请求(包括被拒绝的)都记录审计日志(BackendAuditLog)
+ */
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yjp211/web"
+)
+
+const (
+	BACKEND_ROLE_READONLY = "readonly"
+	BACKEND_ROLE_ADMIN    = "admin"
+
+	BACKEND_HEADER_OPERATOR = "BUGLE-BACKEND-OPERATOR"
+	BACKEND_HEADER_TIME     = "BUGLE-BACKEND-TIME"
+	BACKEND_HEADER_SIGN     = "BUGLE-BACKEND-SIGN"
+
+	//签名时间允许的误差(秒)
+	BACKEND_SIGN_SKEW = 300
+)
+
+var (
+	backendOperators = map[string]*BackendOperator{}
+	backendSigns     = &BackendSignCache{seen: map[string]int64{}}
+	auditLock        sync.Mutex
+)
+
+type BackendOperator struct {
+	Name  string
+	Token string
+	Key   string
+	Role  string
+}
+
+func InitBackendOperators(dmap map[string]interface{}) {
+	backendOperators = map[string]*BackendOperator{}
+	for name, v := range dmap {
+		dict, ok := v.(map[string]interface{})
+		if !ok {
+			fmt.Printf("invalid backend operator <%s>\n", name)
+			continue
+		}
+		operator := &BackendOperator{Name: name}
+		operator.Token, _ = dict["token"].(string)
+		operator.Key, _ = dict["key"].(string)
+		operator.Role, _ = dict["role"].(string)
+		if operator.Role != BACKEND_ROLE_ADMIN {
+			operator.Role = BACKEND_ROLE_READONLY
+		}
+		if len(operator.Token) == 0 && len(operator.Key) == 0 {
+			fmt.Printf("backend operator <%s> has no token or key\n", name)
+			continue
+		}
+		backendOperators[name] = operator
+	}
+	if len(backendOperators) == 0 {
+		log.Warning("no backend operator configured, backend apis are disabled")
+	}
+	if len(configOpt.backendPasswd) > 0 {
+		log.Warning("BackendPasswd is set, backend=passwd requests are accepted as admin, " +
+			"migrate to Provider-Backend-Operator and leave it empty")
+	}
+}
+
+//误差范围内用过的签名
+type BackendSignCache struct {
+	seen  map[string]int64 //签名 -> 过期时间
+	swept int64
+	lock  sync.Mutex
+}
+
+//记录签名，已经用过返回false
+//过期时间是签名时间加允许的误差，之后时间检查会拒绝，不用再记录
+func (p *BackendSignCache) Use(sign string, t int64, now int64) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if now-p.swept >= 60 {
+		for k, expire := range p.seen {
+			if expire < now {
+				delete(p.seen, k)
+			}
+		}
+		p.swept = now
+	}
+	if expire, ok := p.seen[sign]; ok && expire >= now {
+		return false
+	}
+	p.seen[sign] = t + BACKEND_SIGN_SKEW
+	return true
+}
+
+//固定长度后再比较，不泄露长度和内容
+func secureEqual(a, b string) bool {
+	ha := sha256.Sum256([]byte(a))
+	hb := sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(ha[:], hb[:]) == 1
+}
+
+func BackendSign(key, method, path, query, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n", method, path, query, timestamp)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func roleAllowed(have, need string) bool {
+	return have == BACKEND_ROLE_ADMIN || have == need
+}
+
+//认证请求，返回操作人
+func authBackend(ctx *web.Context) (*BackendOperator, Error) {
+	req := ctx.Request
+
+	//Bearer token，逐个比较，不提前返回
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token := strings.TrimSpace(auth[len("Bearer "):])
+		var found *BackendOperator
+		for _, operator := range backendOperators {
+			if len(operator.Token) > 0 && secureEqual(operator.Token, token) {
+				found = operator
+			}
+		}
+		if nil == found {
+			return nil, NewError(NO_PERM, nil, "invalid token")
+		}
+		return found, OK
+	}
+
+	//签名
+	if name := req.Header.Get(BACKEND_HEADER_OPERATOR); len(name) > 0 {
+		operator, ok := backendOperators[name]
+		if !ok || len(operator.Key) == 0 {
+			return nil, NewError(NO_PERM, nil, "invalid operator")
+		}
+		timestamp := req.Header.Get(BACKEND_HEADER_TIME)
+		t, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil || t < Gtimer.Unix-BACKEND_SIGN_SKEW || t > Gtimer.Unix+BACKEND_SIGN_SKEW {
+			return nil, NewError(NO_PERM, nil, "invalid timestamp")
+		}
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, NewError(INVALID_PARAM, nil, "invalid params")
+		}
+		//后面的处理还要读请求体
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		sign := BackendSign(operator.Key, req.Method, req.URL.Path, req.URL.RawQuery, timestamp, body)
+		if !secureEqual(sign, strings.ToLower(req.Header.Get(BACKEND_HEADER_SIGN))) {
+			return nil, NewError(NO_PERM, nil, "invalid sign")
+		}
+		if !backendSigns.Use(sign, t, Gtimer.Unix) {
+			return nil, NewError(NO_PERM, nil, "replayed sign")
+		}
+		return operator, OK
+	}
+
+	//老的口令参数
+	if len(configOpt.backendPasswd) > 0 {
+		if backend, ok := ctx.Params["backend"]; ok && len(backend) > 0 {
+			if !secureEqual(backend, configOpt.backendPasswd) {
+				return nil, NewError(NO_PERM, nil, "no perm")
+			}
+			log.Warning("backend request from <%s> uses deprecated passwd param", getPerAddress(ctx))
+			return &BackendOperator{
+				Name: fmt.Sprintf("passwd@%s", getPerAddress(ctx)),
+				Role: BACKEND_ROLE_ADMIN,
+			}, OK
+		}
+	}
+
+	return nil, NewError(NO_PERM, nil, "no perm")
+}
+
+//检查后台请求的权限并记录审计日志，返回操作人
+func checkBackend(ctx *web.Context, role string) (string, Error) {
+	operator, ret := authBackend(ctx)
+	if ret.Ok() && !roleAllowed(operator.Role, role) {
+		ret = NewError(NO_PERM, nil, "permission denied")
+	}
+
+	record := Dict{
+		"time":   time.Now().Format("2006-01-02 15:04:05"),
+		"addr":   getPerAddress(ctx),
+		"method": ctx.Request.Method,
+		"path":   ctx.Request.URL.Path,
+		"need":   role,
+		"allow":  ret.Ok(),
+	}
+	if operator != nil {
+		record["operator"] = operator.Name
+		record["role"] = operator.Role
+	}
+	if !ret.Ok() {
+		record["reason"] = ret.Msg
+		log.Warning("backend request denied, %s", ret)
+	}
+	writeAuditRecord("backend", configOpt.backendAuditLog, record)
+
+	if !ret.Ok() {
+		return "", ret
+	}
+	return operator.Name, OK
+}
+
+//审计日志，每行一条json记录，path 为空只写日志
+func writeAuditRecord(kind string, path string, record Dict) {
+	jstr, _ := json.Marshal(record)
+	log.Info("%s audit: %s", kind, jstr)
+
+	if len(path) == 0 {
+		return
+	}
+	auditLock.Lock()
+	defer auditLock.Unlock()
+	fp, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		log.Error("open %s audit log<%s> failed, %v", kind, path, err)
+		return
+	}
+	defer fp.Close()
+	fp.WriteString(string(jstr) + "\n")
+}
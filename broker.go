@@ -101,6 +101,51 @@ func (self *BrokerConn) QueryTopicOnline(topic string) (int64, error) {
 	return online, nil
 }
 
+//批量查询在线人数，broker不支持批量协议时逐个查询
+func (self *BrokerConn) QueryMultiTopicOnline(topics []string) (map[string]int64, error) {
+	result := map[string]int64{}
+	if !configOpt.brokerMultiQuery {
+		for _, topic := range topics {
+			online, err := self.QueryTopicOnline(topic)
+			if nil != err {
+				return result, err
+			}
+			result[topic] = online
+		}
+		return result, nil
+	}
+
+	packet := GainQueryMultiOnlinePacket(topics)
+	err := SendPacket(self.conn, packet)
+	if nil != err {
+		self.writeErr = true
+		return result, err
+	}
+
+	if self.timeout > 0 {
+		self.conn.SetReadDeadline(time.Now().Add(time.Second *
+			time.Duration(self.timeout)))
+	}
+
+	packet, err = ReceivePacket(self.conn)
+	if nil != err || packet.command != RPC_TONC_MULTI_ACK {
+		self.writeErr = true
+		if nil == err {
+			err = fmt.Errorf("invalid ack command <%x>", packet.command)
+		}
+		return result, err
+	}
+	if int(packet.remainLength) < 4*len(topics) {
+		self.writeErr = true
+		return result, fmt.Errorf("invalid ack length <%d>", packet.remainLength)
+	}
+
+	for _, topic := range topics {
+		result[topic] = int64(packet.readInt32())
+	}
+	return result, nil
+}
+
 func (self *BrokerConn) Release() {
 	self.Using = false
 }
@@ -131,6 +176,28 @@ func GetAddrLength(addrs []string) map[string]int {
 	return resultMap
 }
 
+//各broker连接池的状态
+func (self *BrokerPool) Stats() Dict {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	stats := Dict{}
+	for _, addr := range configOpt.brokerAddrs {
+		using := 0
+		for _, client := range self.pool[addr] {
+			if client.Using {
+				using++
+			}
+		}
+		stats[addr] = Dict{
+			"conns": len(self.pool[addr]),
+			"using": using,
+			"max":   self.maxConn,
+		}
+	}
+	return stats
+}
+
 func (self *BrokerPool) GetBrokerConn(addr string, trywait bool) (*BrokerConn, string) {
 
 	var conn *BrokerConn = nil
@@ -0,0 +1,254 @@
+/**
+ * bugle provider 后台页面
+ * 只调用 /provider/v1/backend/* 接口，用 Bearer token 认证
+ * token 保存在 sessionStorage，关闭页面后失效
+ */
+(function () {
+  'use strict';
+
+  var API = '/provider/v1/backend';
+  var REFRESH = 2000;
+  var TOP_LEN = 20;
+  var PAGE_SIZE = 50;
+
+  var token = sessionStorage.getItem('backend-token') || '';
+  var lastWeights = null;
+  var lastTime = 0;
+  var decorateOffset = 0;
+  var decorateTotal = 0;
+  var timer = null;
+
+  function $(id) {
+    return document.getElementById(id);
+  }
+
+  function escape(s) {
+    return String(s).replace(/[&<>"']/g, function (c) {
+      return '&#' + c.charCodeAt(0) + ';';
+    });
+  }
+
+  function fmtTime(unix) {
+    if (!unix) {
+      return '-';
+    }
+    return new Date(unix * 1000).toLocaleString();
+  }
+
+  function setStatus(msg, error) {
+    $('status').textContent = msg;
+    $('status').className = error ? 'error' : '';
+  }
+
+  //请求后台接口，返回 data 部分
+  function api(method, path, params, body) {
+    var url = API + path;
+    if (params) {
+      var query = Object.keys(params).map(function (k) {
+        return encodeURIComponent(k) + '=' + encodeURIComponent(params[k]);
+      }).join('&');
+      if (query) {
+        url += '?' + query;
+      }
+    }
+    var opts = {method: method, headers: {'Authorization': 'Bearer ' + token}};
+    if (body !== undefined) {
+      opts.headers['Content-Type'] = 'application/json';
+      opts.body = JSON.stringify(body);
+    }
+    return fetch(url, opts).then(function (resp) {
+      return resp.json();
+    }).then(function (result) {
+      if (result.err_code !== 200) {
+        throw new Error(result.err_code + ' ' + result.err_msg);
+      }
+      return result.data;
+    });
+  }
+
+  function fillTable(id, rows) {
+    $(id).querySelector('tbody').innerHTML = rows.join('');
+  }
+
+  function cell(val, cls) {
+    return '<td' + (cls ? ' class="' + cls + '"' : '') + '>' + escape(val) + '</td>';
+  }
+
+  //推送速率由两次采样的差值计算
+  function renderPublish(data) {
+    var now = Date.now();
+    var prev = {};
+    (lastWeights || []).forEach(function (w) {
+      prev[w.weight] = w;
+    });
+    var seconds = (now - lastTime) / 1000;
+
+    $('schedule').textContent = data.schedule;
+    fillTable('weights', data.weights.map(function (w) {
+      var rate = '-';
+      if (prev[w.weight] && seconds > 0) {
+        rate = ((w.dispatched - prev[w.weight].dispatched) / seconds).toFixed(1);
+      }
+      var dropped = prev[w.weight] && w.dropped > prev[w.weight].dropped;
+      return '<tr>' + cell(w.weight) + cell(w.queue, 'num') + cell(rate, 'num') +
+        cell(w.dispatched, 'num') + cell(w.expired, 'num') +
+        cell(w.dropped, dropped ? 'num bad' : 'num') + '</tr>';
+    }));
+    $('throttle').textContent = '流控丢弃: ' + data.throttle.throttled +
+      '  重复: ' + data.throttle.duplicate +
+      '  环路: ' + data.forward.loop + '  超跳数: ' + data.forward.hop_exceed;
+
+    lastWeights = data.weights;
+    lastTime = now;
+  }
+
+  function renderHealth(data) {
+    fillTable('brokers', Object.keys(data.brokers).sort().map(function (addr) {
+      var b = data.brokers[addr];
+      return '<tr>' + cell(addr) + cell(b.conns, 'num') + cell(b.using, 'num') +
+        cell(b.max, 'num') + '</tr>';
+    }));
+
+    var addrs = {};
+    Object.keys(data.peers).concat(Object.keys(data.links)).forEach(function (addr) {
+      addrs[addr] = true;
+    });
+    fillTable('peers', Object.keys(addrs).sort().map(function (addr) {
+      var p = data.peers[addr] || {};
+      var l = data.links[addr];
+      var link = l ? (l.connected ? '已连接' : '断开') : '-';
+      return '<tr>' + cell(addr) + cell(link, l && !l.connected ? 'bad' : '') +
+        cell(l ? fmtTime(l.lastPong) : '-') + cell(p.pending || 0, 'num') +
+        cell(p.sent || 0, 'num') + cell(p.retried || 0, 'num') +
+        cell(p.dropped || 0, p.dropped ? 'num bad' : 'num') + '</tr>';
+    }));
+
+    fillTable('snapshots', Object.keys(data.snapshots).sort().map(function (node) {
+      var s = data.snapshots[node];
+      return '<tr>' + cell(node) + cell(s.seq, 'num') + cell(s.topics, 'num') +
+        cell(s.stale, 'num') + '</tr>';
+    }));
+  }
+
+  function renderTop(data) {
+    $('online-total').textContent = '总计 ' + data['1-total-online'] +
+      '，topic ' + data['2-topic-count'] + ' 个';
+    fillTable('top', (data['4-topic-tail'] || []).map(function (p) {
+      return '<tr>' + cell(p.Key) + cell(p.Value, 'num') + '</tr>';
+    }));
+  }
+
+  function refresh() {
+    Promise.all([
+      api('GET', '/publish/stat').then(renderPublish),
+      api('GET', '/health').then(renderHealth),
+      api('GET', '/online/all', {len: TOP_LEN}).then(renderTop)
+    ]).then(function () {
+      setStatus('更新于 ' + new Date().toLocaleTimeString());
+    }).catch(function (err) {
+      setStatus(err.message, true);
+    });
+  }
+
+  function loadDecorate() {
+    var params = {prefix: $('decorate-prefix').value, offset: decorateOffset, limit: PAGE_SIZE};
+    api('GET', '/decorate', params).then(function (data) {
+      decorateTotal = data.total;
+      decorateOffset = data.offset;
+      $('decorate-version').textContent = '版本 ' + data.version;
+      $('decorate-page').textContent = (data.total ? data.offset + 1 : 0) + '-' +
+        (data.offset + data.list.length) + ' / ' + data.total;
+      fillTable('decorate', data.list.map(function (item) {
+        return '<tr>' + cell(item.key) + cell(JSON.stringify(item.rule), 'rule') +
+          cell(item.version, 'num') + cell(item.operator || '-') + cell(fmtTime(item.time)) +
+          '<td><button data-edit="' + escape(item.key) + '">编辑</button> ' +
+          '<button data-delete="' + escape(item.key) + '">删除</button></td></tr>';
+      }));
+      $('decorate').rules = {};
+      data.list.forEach(function (item) {
+        $('decorate').rules[item.key] = item.rule;
+      });
+    }).catch(function (err) {
+      setStatus(err.message, true);
+    });
+  }
+
+  function start() {
+    if (!token) {
+      setStatus('请输入 token');
+      return;
+    }
+    lastWeights = null;
+    clearInterval(timer);
+    refresh();
+    loadDecorate();
+    timer = setInterval(refresh, REFRESH);
+  }
+
+  $('auth').addEventListener('submit', function (e) {
+    e.preventDefault();
+    token = $('token').value.trim();
+    sessionStorage.setItem('backend-token', token);
+    $('token').value = '';
+    start();
+  });
+
+  $('logout').addEventListener('click', function () {
+    token = '';
+    sessionStorage.removeItem('backend-token');
+    clearInterval(timer);
+    setStatus('已退出');
+  });
+
+  $('decorate-filter').addEventListener('submit', function (e) {
+    e.preventDefault();
+    decorateOffset = 0;
+    loadDecorate();
+  });
+
+  $('decorate-prev').addEventListener('click', function () {
+    decorateOffset = Math.max(0, decorateOffset - PAGE_SIZE);
+    loadDecorate();
+  });
+
+  $('decorate-next').addEventListener('click', function () {
+    if (decorateOffset + PAGE_SIZE < decorateTotal) {
+      decorateOffset += PAGE_SIZE;
+      loadDecorate();
+    }
+  });
+
+  $('decorate').addEventListener('click', function (e) {
+    var key = e.target.getAttribute('data-edit');
+    if (key !== null) {
+      $('decorate-key').value = key;
+      $('decorate-rule').value = JSON.stringify($('decorate').rules[key], null, 2);
+      return;
+    }
+    key = e.target.getAttribute('data-delete');
+    if (key !== null && confirm('删除修饰规则 ' + key + ' ?')) {
+      api('DELETE', '/decorate', null, {Key: key}).then(loadDecorate).catch(function (err) {
+        setStatus(err.message, true);
+      });
+    }
+  });
+
+  $('decorate-edit').addEventListener('submit', function (e) {
+    e.preventDefault();
+    var rule;
+    try {
+      rule = JSON.parse($('decorate-rule').value);
+    } catch (err) {
+      setStatus('规则不是合法的json', true);
+      return;
+    }
+    api('POST', '/decorate', null, {Key: $('decorate-key').value.trim(), Rule: rule}).then(function () {
+      setStatus('已保存 ' + $('decorate-key').value);
+      loadDecorate();
+    }).catch(function (err) {
+      setStatus(err.message, true);
+    });
+  });
+
+  start();
+})();
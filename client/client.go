@@ -0,0 +1,637 @@
+package client
+
+/**
+ * bugle provider 的 go 客户端
+ * 1、负责请求签名（invoker + md5 sig）
+ * 2、解析 provider 返回的 err_code/err_msg/data 结构
+ * 3、连接失败、服务繁忙时按配置进行重试
+ */
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+type Dict map[string]interface{}
+
+const (
+	DefaultInvokerKey = "BUGLE-PROVIDER-INVOKER"
+	DefaultSignKey    = "BUGLE-PROVIDER-SIGN"
+
+	DefaultUrlOnline  = "/provider/v1/online"
+	DefaultUrlToken   = "/provider/v1/token"
+	DefaultUrlPublish = "/provider/v1/publish"
+
+	DefaultUrlOnlineBatch = "/provider/v1/online/batch"
+
+	DefaultUrlBackendOnline    = "/provider/v1/backend/online"
+	DefaultUrlBackendOnlineAll = "/provider/v1/backend/online/all"
+	DefaultUrlBackendDecorate  = "/provider/v1/backend/decorate"
+
+	BackendHeaderOperator = "BUGLE-BACKEND-OPERATOR"
+	BackendHeaderTime     = "BUGLE-BACKEND-TIME"
+	BackendHeaderSign     = "BUGLE-BACKEND-SIGN"
+)
+
+type Client struct {
+	Addr    string //provider地址 host:port
+	Invoker string
+	Key     string
+
+	InvokerKey string //签名请求头
+	SignKey    string
+
+	//后台接口认证，三选一
+	BackendToken    string //Bearer token
+	BackendOperator string //签名认证的操作人和密钥
+	BackendKey      string
+	BackendPasswd   string //老的后台访问口令，已废弃
+
+	UrlOnline  string
+	UrlToken   string
+	UrlPublish string
+
+	UrlOnlineBatch string
+
+	UrlBackendOnline    string
+	UrlBackendOnlineAll string
+	UrlBackendDecorate  string
+
+	Retry         int           //失败重试次数
+	RetryInterval time.Duration //重试间隔
+
+	HttpClient *http.Client
+}
+
+func NewClient(addr, invoker, key string) *Client {
+	return &Client{
+		Addr:    addr,
+		Invoker: invoker,
+		Key:     key,
+
+		InvokerKey: DefaultInvokerKey,
+		SignKey:    DefaultSignKey,
+
+		UrlOnline:  DefaultUrlOnline,
+		UrlToken:   DefaultUrlToken,
+		UrlPublish: DefaultUrlPublish,
+
+		UrlOnlineBatch: DefaultUrlOnlineBatch,
+
+		UrlBackendOnline:    DefaultUrlBackendOnline,
+		UrlBackendOnlineAll: DefaultUrlBackendOnlineAll,
+		UrlBackendDecorate:  DefaultUrlBackendDecorate,
+
+		Retry:         2,
+		RetryInterval: 200 * time.Millisecond,
+
+		HttpClient: &http.Client{Timeout: 3 * time.Second},
+	}
+}
+
+func Md5Sig(body, invoker, key string) string {
+	buf := fmt.Sprintf("%s%s%s", body, invoker, key)
+	t := md5.New()
+	io.WriteString(t, buf)
+	return fmt.Sprintf("%x", t.Sum(nil))
+}
+
+func newUpstreamId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return fmt.Sprintf("%x", b)
+}
+
+type PublishForm struct {
+	UpstreamId string
+	Topic      string
+	Topics     []string `json:",omitempty"`
+	Bridge     bool
+	Msg        string
+	Weight     int
+	Ttl        int
+}
+
+type PublishOption func(*PublishForm)
+
+//消息权重，provider会限定在 [1, PublishMaxWeight]
+func WithWeight(weight int) PublishOption {
+	return func(form *PublishForm) {
+		form.Weight = weight
+	}
+}
+
+//消息生命周期(秒)，provider会限定在 PublishMaxTtl 以内
+func WithTtl(ttl int) PublishOption {
+	return func(form *PublishForm) {
+		form.Ttl = ttl
+	}
+}
+
+//桥接到其它集群
+func WithBridge(bridge bool) PublishOption {
+	return func(form *PublishForm) {
+		form.Bridge = bridge
+	}
+}
+
+//指定消息id，不指定则由客户端生成，保证重试时id不变
+func WithUpstreamId(id string) PublishOption {
+	return func(form *PublishForm) {
+		form.UpstreamId = id
+	}
+}
+
+//推送消息，返回消息id
+func (p *Client) Publish(topic, msg string, opts ...PublishOption) (string, error) {
+	form := &PublishForm{
+		Topic:  topic,
+		Msg:    msg,
+		Weight: 1,
+	}
+	for _, opt := range opts {
+		opt(form)
+	}
+	if len(form.UpstreamId) == 0 {
+		form.UpstreamId = newUpstreamId()
+	}
+
+	_, err := p.doSigned(p.UrlPublish, form)
+	if err != nil {
+		return "", err
+	}
+	return form.UpstreamId, nil
+}
+
+type PublishResult struct {
+	Id      string
+	Topics  int64    //实际推送的topic数
+	Dropped []string //被流控丢弃的topic，用同一个id(WithUpstreamId)重试只会推送这些topic
+}
+
+//同时推送到多个topic，可以是通配符(live/+ 、game/# 、live/*)，按provider已知的topic(推送过消息或 PublishKnownTopics 配置的)展开
+func (p *Client) PublishTopics(topics []string, msg string, opts ...PublishOption) (*PublishResult, error) {
+	form := &PublishForm{
+		Topics: topics,
+		Msg:    msg,
+		Weight: 1,
+	}
+	for _, opt := range opts {
+		opt(form)
+	}
+	if len(form.UpstreamId) == 0 {
+		form.UpstreamId = newUpstreamId()
+	}
+
+	data, err := p.doSigned(p.UrlPublish, form)
+	if err != nil {
+		return nil, err
+	}
+	result := &PublishResult{Id: form.UpstreamId}
+	if result.Topics, err = dictInt64(data, "topics"); err != nil {
+		return nil, err
+	}
+	if err := remarshal(data["dropped"], &result.Dropped); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+//获取加权后的在线人数
+func (p *Client) GetOnline(topic string) (int64, error) {
+	data, err := p.doGet(p.UrlOnline, url.Values{"topic": {topic}})
+	if err != nil {
+		return 0, err
+	}
+	return dictInt64(data, "online")
+}
+
+//批量获取加权后的在线人数
+func (p *Client) GetOnlineBatch(topics []string) (map[string]int64, error) {
+	body, err := json.Marshal(Dict{"Topics": topics})
+	if err != nil {
+		return nil, &Error{Code: INVALID_PARAM, Msg: "invalid params", Err: err}
+	}
+	headers := map[string]string{
+		"Content-Type": "application/json",
+	}
+	data, err := p.do("POST", p.UrlOnlineBatch, nil, headers, body)
+	if err != nil {
+		return nil, err
+	}
+	onlines := map[string]int64{}
+	if err := remarshal(data["onlines"], &onlines); err != nil {
+		return nil, err
+	}
+	return onlines, nil
+}
+
+type Token struct {
+	Account           string `json:"account"`
+	Password          string `json:"password"`
+	PingInterval      int    `json:"pingInterval"`
+	PingFailedCount   int    `json:"pingFailedCount"`
+	ReconnectInterval int    `json:"reconnectInterval"`
+	BrokerAddr        string `json:"brokerAddr"`
+	BrokerPort        int    `json:"brokerPort"`
+}
+
+func (p *Client) GetToken(device, mac string) (*Token, error) {
+	data, err := p.doGet(p.UrlToken, url.Values{"device": {device}, "mac": {mac}})
+	if err != nil {
+		return nil, err
+	}
+	token := &Token{}
+	if err := remarshal(data, token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+//获取没有加权的在线人数 (后台接口)
+func (p *Client) GetPureOnline(topic string) (int64, error) {
+	data, err := p.doBackend("GET", p.UrlBackendOnline, url.Values{"topic": {topic}}, nil)
+	if err != nil {
+		return 0, err
+	}
+	return dictInt64(data, "online")
+}
+
+//单个来源(broker或对端provider)的在线人数
+type SourceOnline struct {
+	Online  int64  `json:"online"`
+	Updated int64  `json:"updated"`
+	Failed  string `json:"failed"`
+}
+
+type OnlineDetail struct {
+	Online   int64                   `json:"online"`
+	Degraded bool                    `json:"degraded"`
+	Updated  int64                   `json:"updated"`
+	Local    int64                   `json:"local"`
+	Brokers  map[string]SourceOnline `json:"brokers"`
+	Peers    map[string]SourceOnline `json:"peers"`
+	Failed   []string                `json:"failed"`
+}
+
+//获取没有修饰的在线人数及各broker、各对端的明细 (后台接口)
+func (p *Client) GetPureOnlineDetail(topic string) (*OnlineDetail, error) {
+	params := url.Values{"topic": {topic}, "detail": {"1"}}
+	data, err := p.doBackend("GET", p.UrlBackendOnline, params, nil)
+	if err != nil {
+		return nil, err
+	}
+	detail := &OnlineDetail{}
+	if err := remarshal(data, detail); err != nil {
+		return nil, err
+	}
+	return detail, nil
+}
+
+type TopicOnline struct {
+	Key   string
+	Value int64
+}
+
+type AllOnline struct {
+	TotalOnline int64         `json:"1-total-online"`
+	TopicCount  int           `json:"2-topic-count"`
+	ShowCount   int           `json:"3-show-count"`
+	Topics      []TopicOnline `json:"4-topic-tail"`
+}
+
+//获取所有topic的在线人数 (后台接口)，showlen <= 0 表示全部
+func (p *Client) GetAllPureOnline(showlen int, local bool) (*AllOnline, error) {
+	params := url.Values{"len": {fmt.Sprintf("%d", showlen)}}
+	if local {
+		params.Set("local", "1")
+	}
+	data, err := p.doBackend("GET", p.UrlBackendOnlineAll, params, nil)
+	if err != nil {
+		return nil, err
+	}
+	all := &AllOnline{}
+	if err := remarshal(data, all); err != nil {
+		return nil, err
+	}
+	return all, nil
+}
+
+//在线人数修饰规则，和provider的配置格式一致
+//只有加权值或固定值的规则在接口中是数字形式
+type DecorateRule struct {
+	Multiplier float64            `json:"multiplier"`
+	Fixed      int64              `json:"fixed,omitempty"`
+	Jitter     float64            `json:"jitter,omitempty"`
+	Floor      int64              `json:"floor,omitempty"`
+	Cap        int64              `json:"cap,omitempty"`
+	Schedules  []DecorateSchedule `json:"schedules,omitempty"`
+	Smooth     *DecorateSmooth    `json:"smooth,omitempty"`
+}
+
+//对外展示人数的平滑处理，Alpha 为移动平均系数，MaxDecrease 为每个周期最多下降的比例
+type DecorateSmooth struct {
+	Alpha       float64 `json:"alpha,omitempty"`
+	MaxDecrease float64 `json:"maxDecrease,omitempty"`
+	Interval    int64   `json:"interval,omitempty"`
+}
+
+type DecorateSchedule struct {
+	Start int64         `json:"start"`
+	End   int64         `json:"end"`
+	Rule  *DecorateRule `json:"rule"`
+}
+
+func (p *DecorateRule) UnmarshalJSON(data []byte) error {
+	var val float64
+	if err := json.Unmarshal(data, &val); err == nil {
+		if val < 0 {
+			*p = DecorateRule{Fixed: int64(0 - val)}
+		} else {
+			*p = DecorateRule{Multiplier: val}
+		}
+		return nil
+	}
+	type rule DecorateRule
+	tmp := rule{Multiplier: 1}
+	if err := json.Unmarshal(data, &tmp); err != nil {
+		return err
+	}
+	*p = DecorateRule(tmp)
+	return nil
+}
+
+//获取修饰规则 (后台接口)
+func (p *Client) GetDecorate() (map[string]*DecorateRule, error) {
+	data, err := p.doBackend("GET", p.UrlBackendDecorate, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return decorateMap(data)
+}
+
+//设置修饰规则 (后台接口)，val >= 0 为加权值，< 0 为固定值，返回设置后的全部规则
+func (p *Client) SetDecorate(key string, val float64) (map[string]*DecorateRule, error) {
+	return p.setDecorate(key, fmt.Sprintf("%v", val))
+}
+
+//设置结构化的修饰规则 (后台接口)，返回设置后的全部规则
+func (p *Client) SetDecorateRule(key string, rule *DecorateRule) (map[string]*DecorateRule, error) {
+	jstr, err := json.Marshal(rule)
+	if err != nil {
+		return nil, &Error{Code: INVALID_PARAM, Msg: "invalid rule", Err: err}
+	}
+	return p.setDecorate(key, string(jstr))
+}
+
+func (p *Client) setDecorate(key string, val string) (map[string]*DecorateRule, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"Key":  key,
+		"Rule": json.RawMessage(val),
+	})
+	if err != nil {
+		return nil, &Error{Code: INVALID_PARAM, Msg: "invalid rule", Err: err}
+	}
+	data, err := p.doBackend("POST", p.UrlBackendDecorate, nil, body)
+	if err != nil {
+		return nil, err
+	}
+	return decorateMap(data)
+}
+
+//后台接口认证，优先使用 token，其次签名，最后是老的口令参数
+func (p *Client) doBackend(method, path string, params url.Values, body []byte) (Dict, error) {
+	if params == nil {
+		params = url.Values{}
+	}
+	headers := map[string]string{}
+	if body != nil {
+		headers["Content-Type"] = "application/json"
+	}
+
+	switch {
+	case len(p.BackendToken) > 0:
+		headers["Authorization"] = "Bearer " + p.BackendToken
+	case len(p.BackendOperator) > 0:
+		//服务端拒绝重复的签名，每次请求(包括重试)用新的 nonce 重新签名
+		return p.retry(func() (Dict, error) {
+			params.Set("nonce", newUpstreamId())
+			timestamp := fmt.Sprintf("%d", time.Now().Unix())
+			headers[BackendHeaderOperator] = p.BackendOperator
+			headers[BackendHeaderTime] = timestamp
+			headers[BackendHeaderSign] = BackendSign(p.BackendKey, method, path,
+				params.Encode(), timestamp, body)
+			return p.doOnce(method, p.url(path, params), headers, body)
+		})
+	default:
+		params.Set("backend", p.BackendPasswd)
+	}
+	return p.do(method, path, params, headers, body)
+}
+
+//后台接口签名 hex(hmac_sha256(key, METHOD\nPATH\nQUERY\nTIME\nBODY))
+func BackendSign(key, method, path, query, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n", method, path, query, timestamp)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (p *Client) doGet(path string, params url.Values) (Dict, error) {
+	return p.do("GET", path, params, nil, nil)
+}
+
+func (p *Client) doSigned(path string, form interface{}) (Dict, error) {
+	body, err := json.Marshal(form)
+	if err != nil {
+		return nil, &Error{Code: INVALID_PARAM, Msg: "invalid params", Err: err}
+	}
+	headers := map[string]string{
+		"Content-Type": "application/json",
+		p.InvokerKey:   p.Invoker,
+		p.SignKey:      Md5Sig(string(body), p.Invoker, p.Key),
+	}
+	return p.do("POST", path, nil, headers, body)
+}
+
+func (p *Client) url(path string, params url.Values) string {
+	httpUrl := fmt.Sprintf("http://%s%s", p.Addr, path)
+	if len(params) > 0 {
+		httpUrl = fmt.Sprintf("%s?%s", httpUrl, params.Encode())
+	}
+	return httpUrl
+}
+
+//发送请求，连接失败和服务繁忙的请求会重试
+func (p *Client) do(method, path string, params url.Values,
+	headers map[string]string, body []byte) (Dict, error) {
+	httpUrl := p.url(path, params)
+	return p.retry(func() (Dict, error) {
+		return p.doOnce(method, httpUrl, headers, body)
+	})
+}
+
+func (p *Client) retry(once func() (Dict, error)) (Dict, error) {
+	var err error
+	for i := 0; i <= p.Retry; i++ {
+		if i > 0 {
+			time.Sleep(p.RetryInterval)
+		}
+		var data Dict
+		data, err = once()
+		if err == nil {
+			return data, nil
+		}
+		if e, ok := err.(*Error); ok && !e.Temporary() {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+func (p *Client) doOnce(method, httpUrl string,
+	headers map[string]string, body []byte) (Dict, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, httpUrl, reader)
+	if err != nil {
+		return nil, &Error{Code: INVALID_PARAM, Msg: "invalid request", Err: err}
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := p.HttpClient.Do(req)
+	if err != nil {
+		return nil, &Error{Code: REMOTE_CONN_ERR, Msg: "remote server can't access", Err: err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, &Error{Code: REMOTE_RESP_ERR, Msg: fmt.Sprintf("err code: %d", resp.StatusCode),
+			Status: resp.StatusCode}
+	}
+
+	result, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, &Error{Code: REMOTE_RESP_ERR, Msg: "remote server response error", Err: err}
+	}
+
+	return parseResult(result)
+}
+
+//解析 {"err_code":200,"err_msg":"","data":{}}
+func parseResult(result []byte) (Dict, error) {
+	resp := struct {
+		Code *int   `json:"err_code"`
+		Msg  string `json:"err_msg"`
+		Data Dict   `json:"data"`
+	}{}
+	if err := json.Unmarshal(result, &resp); err != nil || resp.Code == nil {
+		return nil, &Error{Code: REMOTE_RESP_ERR, Msg: "invalid data format", Err: err}
+	}
+	if *resp.Code != 200 {
+		return nil, &Error{Code: *resp.Code, Msg: resp.Msg}
+	}
+	return resp.Data, nil
+}
+
+func dictInt64(data Dict, key string) (int64, error) {
+	v, ok := data[key].(float64)
+	if !ok {
+		return 0, &Error{Code: REMOTE_RESP_ERR, Msg: "invalid data format"}
+	}
+	return int64(v), nil
+}
+
+type DecorateItem struct {
+	Key      string        `json:"key"`
+	Rule     *DecorateRule `json:"rule"`
+	Version  int64         `json:"version"`
+	Operator string        `json:"operator"`
+	Time     int64         `json:"time"`
+}
+
+type DecorateList struct {
+	List    []*DecorateItem `json:"list"`
+	Total   int             `json:"total"`
+	Offset  int             `json:"offset"`
+	Limit   int             `json:"limit"`
+	Version int64           `json:"version"`
+}
+
+//分页获取修饰规则 (后台接口)，prefix 为key前缀，limit <= 0 表示全部
+func (p *Client) ListDecorate(prefix string, offset, limit int) (*DecorateList, error) {
+	params := url.Values{
+		"prefix": {prefix},
+		"offset": {fmt.Sprintf("%d", offset)},
+		"limit":  {fmt.Sprintf("%d", limit)},
+	}
+	data, err := p.doBackend("GET", p.UrlBackendDecorate, params, nil)
+	if err != nil {
+		return nil, err
+	}
+	list := &DecorateList{}
+	if err := remarshal(data, list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+//删除修饰规则 (后台接口)，返回删除后的版本号
+func (p *Client) DeleteDecorate(key string) (int64, error) {
+	body, _ := json.Marshal(map[string]string{"Key": key})
+	data, err := p.doBackend("DELETE", p.UrlBackendDecorate, nil, body)
+	if err != nil {
+		return 0, err
+	}
+	return dictInt64(data, "version")
+}
+
+//批量导入修饰规则 (后台接口)，replace 为true时删除导入数据中没有的规则，返回导入后的版本号
+func (p *Client) ImportDecorate(rules map[string]*DecorateRule, replace bool) (int64, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"Rules":   rules,
+		"Replace": replace,
+	})
+	if err != nil {
+		return 0, &Error{Code: INVALID_PARAM, Msg: "invalid rule", Err: err}
+	}
+	data, err := p.doBackend("POST", p.UrlBackendDecorate+"/import", nil, body)
+	if err != nil {
+		return 0, err
+	}
+	return dictInt64(data, "version")
+}
+
+func decorateMap(data Dict) (map[string]*DecorateRule, error) {
+	dmap := map[string]*DecorateRule{}
+	if err := remarshal(data["map"], &dmap); err != nil {
+		return nil, err
+	}
+	return dmap, nil
+}
+
+func remarshal(src interface{}, dst interface{}) error {
+	jstr, err := json.Marshal(src)
+	if err == nil {
+		err = json.Unmarshal(jstr, dst)
+	}
+	if err != nil {
+		return &Error{Code: REMOTE_RESP_ERR, Msg: "invalid data format", Err: err}
+	}
+	return nil
+}
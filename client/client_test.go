@@ -0,0 +1,293 @@
+package client
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testInvoker = "test-invoker"
+	testKey     = "test-key"
+
+	testOperator    = "ops"
+	testOperatorKey = "ops-key"
+)
+
+//进程内的provider，按provider的规则校验签名，返回 err_code/err_msg/data
+type stubProvider struct {
+	server *httptest.Server
+
+	lock   sync.Mutex
+	calls  map[string]int
+	busy   int //前几次请求返回服务繁忙
+	status int //非0时直接返回这个http状态码
+	forms  []*PublishForm
+	signs  map[string]bool
+}
+
+func newStubProvider(t *testing.T) *stubProvider {
+	p := &stubProvider{
+		calls: map[string]int{},
+		signs: map[string]bool{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(DefaultUrlPublish, p.publish)
+	mux.HandleFunc(DefaultUrlOnline, p.online)
+	mux.HandleFunc(DefaultUrlBackendDecorate, p.decorate)
+	p.server = httptest.NewServer(mux)
+	t.Cleanup(p.server.Close)
+	return p
+}
+
+func (p *stubProvider) client() *Client {
+	client := NewClient(strings.TrimPrefix(p.server.URL, "http://"), testInvoker, testKey)
+	client.RetryInterval = time.Millisecond
+	return client
+}
+
+func (p *stubProvider) count(path string) int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.calls[path]
+}
+
+func (p *stubProvider) fail(busy int, status int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.busy = busy
+	p.status = status
+}
+
+func (p *stubProvider) published() []*PublishForm {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.forms
+}
+
+func writeResult(w http.ResponseWriter, code int, msg string, data interface{}) {
+	jstr, _ := json.Marshal(map[string]interface{}{
+		"err_code": code,
+		"err_msg":  msg,
+		"data":     data,
+	})
+	w.Write(jstr)
+}
+
+//记录请求，需要失败时写入响应并返回false
+func (p *stubProvider) enter(w http.ResponseWriter, req *http.Request) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.calls[req.URL.Path]++
+	if p.status != 0 {
+		w.WriteHeader(p.status)
+		return false
+	}
+	if p.busy > 0 {
+		p.busy--
+		writeResult(w, SYSTEM_BUSY, "system busy", nil)
+		return false
+	}
+	return true
+}
+
+func (p *stubProvider) publish(w http.ResponseWriter, req *http.Request) {
+	if !p.enter(w, req) {
+		return
+	}
+	body, _ := ioutil.ReadAll(req.Body)
+	if req.Header.Get(DefaultInvokerKey) != testInvoker ||
+		req.Header.Get(DefaultSignKey) != Md5Sig(string(body), testInvoker, testKey) {
+		writeResult(w, INVALID_PARAM, "invalid sign", nil)
+		return
+	}
+	form := &PublishForm{}
+	if err := json.Unmarshal(body, form); err != nil {
+		writeResult(w, INVALID_PARAM, "invalid params", nil)
+		return
+	}
+	p.lock.Lock()
+	p.forms = append(p.forms, form)
+	p.lock.Unlock()
+
+	data := map[string]interface{}{"id": form.UpstreamId, "topics": 1, "dropped": []string{}}
+	if len(form.Topics) > 0 {
+		data["topics"] = len(form.Topics) - 1
+		data["dropped"] = form.Topics[len(form.Topics)-1:]
+	}
+	writeResult(w, 200, "", data)
+}
+
+func (p *stubProvider) online(w http.ResponseWriter, req *http.Request) {
+	if !p.enter(w, req) {
+		return
+	}
+	writeResult(w, 200, "", map[string]interface{}{"online": len(req.URL.Query().Get("topic"))})
+}
+
+//后台签名校验，同一个签名只能用一次，返回服务繁忙的请求也算用过
+func (p *stubProvider) decorate(w http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	sign := req.Header.Get(BackendHeaderSign)
+	right := BackendSign(testOperatorKey, req.Method, req.URL.Path, req.URL.RawQuery,
+		req.Header.Get(BackendHeaderTime), body)
+	if req.Header.Get(BackendHeaderOperator) != testOperator || sign != right {
+		writeResult(w, NO_PERM, "invalid sign", nil)
+		return
+	}
+	p.lock.Lock()
+	replayed := p.signs[sign]
+	p.signs[sign] = true
+	p.lock.Unlock()
+	if replayed {
+		writeResult(w, NO_PERM, "replayed sign", nil)
+		return
+	}
+	if !p.enter(w, req) {
+		return
+	}
+	writeResult(w, 200, "", map[string]interface{}{"list": []interface{}{}, "version": 3})
+}
+
+func TestPublishSigned(t *testing.T) {
+	stub := newStubProvider(t)
+	client := stub.client()
+
+	id, err := client.Publish("live/room", "hello", WithWeight(3), WithTtl(60))
+	if err != nil {
+		t.Fatalf("publish failed, %v", err)
+	}
+	forms := stub.published()
+	if len(forms) != 1 {
+		t.Fatalf("provider got %d publish", len(forms))
+	}
+	form := forms[0]
+	if form.UpstreamId != id || form.Topic != "live/room" || form.Msg != "hello" ||
+		form.Weight != 3 || form.Ttl != 60 {
+		t.Errorf("provider got %+v, id %s", form, id)
+	}
+}
+
+func TestPublishTopicsResult(t *testing.T) {
+	stub := newStubProvider(t)
+	client := stub.client()
+
+	result, err := client.PublishTopics([]string{"live/a", "live/b"}, "hello", WithUpstreamId("abc"))
+	if err != nil {
+		t.Fatalf("publish failed, %v", err)
+	}
+	if result.Id != "abc" || result.Topics != 1 ||
+		len(result.Dropped) != 1 || result.Dropped[0] != "live/b" {
+		t.Errorf("unexpected result %+v", result)
+	}
+}
+
+func TestErrorDecode(t *testing.T) {
+	stub := newStubProvider(t)
+	client := stub.client()
+	client.Key = "wrong-key"
+
+	_, err := client.Publish("live/room", "hello")
+	e, ok := err.(*Error)
+	if !ok || e.Code != INVALID_PARAM || e.Msg != "invalid sign" || !IsInvalidParam(err) {
+		t.Fatalf("unexpected error %#v", err)
+	}
+	//参数错误不重试
+	if n := stub.count(DefaultUrlPublish); n != 1 {
+		t.Errorf("provider called %d times, want 1", n)
+	}
+}
+
+func TestRetryBusy(t *testing.T) {
+	stub := newStubProvider(t)
+	client := stub.client()
+	stub.fail(2, 0)
+
+	online, err := client.GetOnline("live/room")
+	if err != nil || online != 9 {
+		t.Fatalf("online %d, err %v", online, err)
+	}
+	if n := stub.count(DefaultUrlOnline); n != 3 {
+		t.Errorf("provider called %d times, want 3", n)
+	}
+
+	//重试次数用完返回最后一次的错误
+	stub.fail(10, 0)
+	client.Retry = 1
+	_, err = client.GetOnline("live/room")
+	e, ok := err.(*Error)
+	if !ok || e.Code != SYSTEM_BUSY || !e.Temporary() {
+		t.Fatalf("unexpected error %#v", err)
+	}
+	if n := stub.count(DefaultUrlOnline); n != 5 {
+		t.Errorf("provider called %d times, want 5", n)
+	}
+}
+
+func TestRetryHttpStatus(t *testing.T) {
+	for _, c := range []struct {
+		status int
+		calls  int
+	}{
+		{http.StatusBadGateway, 3},
+		{http.StatusNotFound, 1},
+	} {
+		stub := newStubProvider(t)
+		client := stub.client()
+		stub.fail(0, c.status)
+
+		_, err := client.GetOnline("live/room")
+		e, ok := err.(*Error)
+		if !ok || e.Code != REMOTE_RESP_ERR || e.Status != c.status {
+			t.Errorf("status %d: unexpected error %#v", c.status, err)
+		}
+		if n := stub.count(DefaultUrlOnline); n != c.calls {
+			t.Errorf("status %d: provider called %d times, want %d", c.status, n, c.calls)
+		}
+	}
+}
+
+func TestConnRefused(t *testing.T) {
+	stub := newStubProvider(t)
+	client := stub.client()
+	stub.server.Close()
+
+	_, err := client.GetOnline("live/room")
+	e, ok := err.(*Error)
+	if !ok || e.Code != REMOTE_CONN_ERR || !e.Temporary() {
+		t.Fatalf("unexpected error %#v", err)
+	}
+}
+
+//签名请求重试时重新签名，不会被当成重放
+func TestBackendSignRetry(t *testing.T) {
+	stub := newStubProvider(t)
+	client := stub.client()
+	client.BackendOperator = testOperator
+	client.BackendKey = testOperatorKey
+	stub.fail(1, 0)
+
+	for i := 0; i < 2; i++ {
+		list, err := client.ListDecorate("live/", 0, 10)
+		if err != nil {
+			t.Fatalf("list decorate failed, %v", err)
+		}
+		if list.Version != 3 {
+			t.Errorf("unexpected list %+v", list)
+		}
+	}
+	if n := stub.count(DefaultUrlBackendDecorate); n != 3 {
+		t.Errorf("provider called %d times, want 3", n)
+	}
+
+	client.BackendKey = "wrong-key"
+	_, err := client.ListDecorate("", 0, 0)
+	if !IsNoPerm(err) {
+		t.Errorf("unexpected error %v", err)
+	}
+}
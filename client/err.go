@@ -0,0 +1,54 @@
+package client
+
+import "fmt"
+
+//与 provider 的错误码保持一致
+const (
+	SUCCESS = iota
+
+	REMOTE_CONN_ERR
+	REMOTE_RESP_ERR
+
+	BROKER_CONN_ERR
+	BROKER_PUSH_ERR
+
+	NO_PERM          = 401
+	INVALID_PARAM    = 400
+	SYSTEM_BUSY      = 503
+	SERVICE_DEGRADED = 501 //服务降级
+)
+
+type Error struct {
+	Code   int   // err_code 或本地错误码
+	Err    error // origin error
+	Msg    string
+	Status int // http status, 非200时有效
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%d: %s, %s", e.Code, e.Msg, e.Err.Error())
+	}
+	return fmt.Sprintf("%d: %s", e.Code, e.Msg)
+}
+
+//连接失败、服务繁忙、服务端异常可以重试
+func (e *Error) Temporary() bool {
+	switch e.Code {
+	case REMOTE_CONN_ERR, SYSTEM_BUSY:
+		return true
+	case REMOTE_RESP_ERR:
+		return e.Status >= 500
+	}
+	return false
+}
+
+func IsNoPerm(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.Code == NO_PERM
+}
+
+func IsInvalidParam(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.Code == INVALID_PARAM
+}
@@ -10,8 +10,13 @@ import (
 type Config struct {
 	//启动pprof
 	enableOnlinePprof bool
-	//后台访问口令
+	//后台访问口令，已废弃，建议使用 Provider-Backend-Operator
 	backendPasswd string
+	//后台请求审计日志，为空只写日志
+	backendAuditLog string
+
+	//集群标识，用于桥接消息的环路检测
+	clusterId string
 
 	listenPort int
 	logPath    string
@@ -27,10 +32,65 @@ type Config struct {
 	//每条消息广播的处理能力
 	publishMaxQps int64
 
+	//每个权重队列的最大长度
+	publishQueueCapacity int
+	//队列满时的处理策略 drop_new/drop_oldest
+	publishQueueOverflow string
+
+	//消息最大生命周期(秒)
+	publishMaxTtl int
+
+	//消息最多转发次数，0 不限制
+	publishMaxHops int
+
+	//一次推送展开后最多的topic数，0 不限制
+	publishMaxTopics int
+	//推送通配符可以匹配的常驻topic
+	publishKnownTopics []string
+	//推送过消息的topic登记多久(秒)、最多登记多少个
+	topicRegistryExpire int
+	topicRegistryMax    int
+
+	//消息去重时间窗口(秒)，0 不去重
+	publishDedupWindow int
+
+	//推送队列调度策略 strict/wrr/drr
+	publishSchedule string
+	//drr调度时权重1每轮的字节额度
+	publishDrrQuantum int
+
 	totalOnlineCacheExpire int
 	localOnlineCacheExpire int
+	//缓存的最多topic个数
+	onlineCacheMaxTopics int
+
+	//在线人数采样间隔(秒)，-1 表示不采样
+	onlineHistoryInterval int
+	//每个topic保存的采样点个数
+	onlineHistorySize int
+
+	//在线人数汇总方式 pull/push
+	onlineAggregate       string
+	onlinePushInterval    int //推送间隔(秒)
+	onlinePushFullEvery   int //每推多少次发一次全量
+	onlineSnapshotTimeout int //快照超时(秒)
+	nodeId                string
 
 	httpRpcTimeout int
+	//每个对端的最大并发请求数
+	httpMaxConnsPerPeer int
+
+	//转发到其它provider的发送队列
+	peerQueueSize        int
+	peerMaxRetry         int
+	peerRetryInterval    int //毫秒，每次重试翻倍
+	peerRetryMaxInterval int //毫秒
+	peerSpoolDir         string
+
+	//provider之间的长连接端口，0 表示不开启
+	peerLinkPort int
+	//长连接心跳间隔(秒)
+	peerLinkPing int
 
 	relayList    []string
 	relayInvoker string
@@ -45,12 +105,41 @@ type Config struct {
 	urlToken   string
 	urlPublish string
 
+	urlOnlineBatch string
+	//批量查询最多的topic个数
+	onlineBatchMax int
+
+	urlOnlineStream       string
+	onlineStreamInterval  int //每个连接两次推送的最小间隔(秒)
+	onlineStreamMaxConn   int
+	onlineStreamMaxTopics int //每个连接最多订阅的topic数
+
+	urlSubscribe           string
+	subscribeBuffer        int //每个订阅者缓存的消息条数
+	subscribeMaxConn       int
+	subscribePollWait      int //长轮询最长等待时间(秒)
+	subscribeSessionExpire int //长轮询会话没有请求后的过期时间(秒)
+	subscribeAllowOrigins  []string
+
 	urlCollectOnline string
 	urlRelayPublish  string
 	urlBridgePublish string
+	urlPushOnline    string
+	urlSyncDecorate  string
+	urlPullDecorate  string
+
+	//修饰规则对账的间隔(秒)
+	decorateSyncInterval int
+
+	//修饰规则的存储文件和审计日志，为空不保存
+	decorateStore    string
+	decorateAuditLog string
 
 	invokerMap  map[string]interface{}
 	decorateMap map[string]interface{}
+	ttlMap      map[string]interface{}
+	limitMap    map[string]interface{}
+	operatorMap map[string]interface{}
 
 	/* client config*/
 	clientPingInterval      int //心跳间隔
@@ -64,6 +153,21 @@ type Config struct {
 
 	brokerPoolMax int
 	brokerTimeout int
+	//broker是否支持批量统计在线人数
+	brokerMultiQuery bool
+}
+
+//示例配置中曾经使用的集群标识
+const SAMPLE_CLUSTER_ID = "default"
+
+//检查配置之间的约束
+func CheckConfig(config *Config) error {
+	//桥接靠集群标识检测环路，各集群必须不同，否则桥接的消息全部被当成环路丢弃
+	if len(config.bridgeList) > 0 &&
+		(len(config.clusterId) == 0 || config.clusterId == SAMPLE_CLUSTER_ID) {
+		return fmt.Errorf("ClusterId must be set to a unique value when BridgeList is not empty")
+	}
+	return nil
 }
 
 func ParseConfig(configPath string, config *Config) error {
@@ -92,6 +196,11 @@ func ParseConfig(configPath string, config *Config) error {
 			config.enableOnlinePprof = val.(bool)
 		case "BackendPasswd":
 			config.backendPasswd = val.(string)
+		case "BackendAuditLog":
+			config.backendAuditLog = val.(string)
+
+		case "ClusterId":
+			config.clusterId = val.(string)
 
 		case "ListenPort":
 			config.listenPort = int(val.(float64))
@@ -102,20 +211,83 @@ func ParseConfig(configPath string, config *Config) error {
 
 		case "PublishMaxWeight":
 			config.publishMaxWeight = int(val.(float64))
+		case "PublishMaxTopics":
+			config.publishMaxTopics = int(val.(float64))
+		case "PublishKnownTopics":
+			arr := []string{}
+			for _, v := range strings.Split(val.(string), ",") {
+				nv := strings.Trim(v, " ")
+				if len(nv) > 0 {
+					arr = append(arr, nv)
+				}
+			}
+			config.publishKnownTopics = arr
+		case "TopicRegistryExpire":
+			config.topicRegistryExpire = int(val.(float64))
+		case "TopicRegistryMax":
+			config.topicRegistryMax = int(val.(float64))
 		case "PublishMaxCount":
 			config.publishMaxCount = int64(val.(float64))
 		case "PublishMaxMulti":
 			config.publishMaxMulti = int(val.(float64))
 		case "PublishMaxQps":
 			config.publishMaxQps = int64(val.(float64))
+		case "PublishQueueCapacity":
+			config.publishQueueCapacity = int(val.(float64))
+		case "PublishQueueOverflow":
+			config.publishQueueOverflow = val.(string)
+		case "PublishMaxTtl":
+			config.publishMaxTtl = int(val.(float64))
+		case "PublishMaxHops":
+			config.publishMaxHops = int(val.(float64))
+		case "PublishDedupWindow":
+			config.publishDedupWindow = int(val.(float64))
+		case "PublishSchedule":
+			config.publishSchedule = val.(string)
+		case "PublishDrrQuantum":
+			config.publishDrrQuantum = int(val.(float64))
 
 		case "TotalOnlineCacheExpire":
 			config.totalOnlineCacheExpire = int(val.(float64))
 		case "LocalOnlineCacheExpire":
 			config.localOnlineCacheExpire = int(val.(float64))
+		case "OnlineCacheMaxTopics":
+			config.onlineCacheMaxTopics = int(val.(float64))
+		case "OnlineHistoryInterval":
+			config.onlineHistoryInterval = int(val.(float64))
+		case "OnlineHistorySize":
+			config.onlineHistorySize = int(val.(float64))
+
+		case "OnlineAggregate":
+			config.onlineAggregate = val.(string)
+		case "OnlinePushInterval":
+			config.onlinePushInterval = int(val.(float64))
+		case "OnlinePushFullEvery":
+			config.onlinePushFullEvery = int(val.(float64))
+		case "OnlineSnapshotTimeout":
+			config.onlineSnapshotTimeout = int(val.(float64))
+		case "NodeId":
+			config.nodeId = val.(string)
 
 		case "HttpRpcTimeout":
 			config.httpRpcTimeout = int(val.(float64))
+		case "HttpMaxConnsPerPeer":
+			config.httpMaxConnsPerPeer = int(val.(float64))
+
+		case "PeerQueueSize":
+			config.peerQueueSize = int(val.(float64))
+		case "PeerMaxRetry":
+			config.peerMaxRetry = int(val.(float64))
+		case "PeerRetryInterval":
+			config.peerRetryInterval = int(val.(float64))
+		case "PeerRetryMaxInterval":
+			config.peerRetryMaxInterval = int(val.(float64))
+		case "PeerSpoolDir":
+			config.peerSpoolDir = val.(string)
+		case "PeerLinkPort":
+			config.peerLinkPort = int(val.(float64))
+		case "PeerLinkPing":
+			config.peerLinkPing = int(val.(float64))
 
 		case "RelayList":
 			str := val.(string)
@@ -156,6 +328,37 @@ func ParseConfig(configPath string, config *Config) error {
 			config.urlToken = val.(string)
 		case "UrlPublish":
 			config.urlPublish = val.(string)
+		case "UrlOnlineBatch":
+			config.urlOnlineBatch = val.(string)
+		case "OnlineBatchMax":
+			config.onlineBatchMax = int(val.(float64))
+		case "UrlOnlineStream":
+			config.urlOnlineStream = val.(string)
+		case "OnlineStreamInterval":
+			config.onlineStreamInterval = int(val.(float64))
+		case "OnlineStreamMaxConn":
+			config.onlineStreamMaxConn = int(val.(float64))
+		case "OnlineStreamMaxTopics":
+			config.onlineStreamMaxTopics = int(val.(float64))
+		case "UrlSubscribe":
+			config.urlSubscribe = val.(string)
+		case "SubscribeBuffer":
+			config.subscribeBuffer = int(val.(float64))
+		case "SubscribeMaxConn":
+			config.subscribeMaxConn = int(val.(float64))
+		case "SubscribePollWait":
+			config.subscribePollWait = int(val.(float64))
+		case "SubscribeSessionExpire":
+			config.subscribeSessionExpire = int(val.(float64))
+		case "SubscribeAllowOrigins":
+			arr := []string{}
+			for _, v := range strings.Split(val.(string), ",") {
+				nv := strings.Trim(v, " ")
+				if len(nv) > 0 {
+					arr = append(arr, nv)
+				}
+			}
+			config.subscribeAllowOrigins = arr
 
 		case "UrlCollectOnline":
 			config.urlCollectOnline = val.(string)
@@ -163,6 +366,18 @@ func ParseConfig(configPath string, config *Config) error {
 			config.urlRelayPublish = val.(string)
 		case "UrlBridgePublish":
 			config.urlBridgePublish = val.(string)
+		case "UrlPushOnline":
+			config.urlPushOnline = val.(string)
+		case "UrlSyncDecorate":
+			config.urlSyncDecorate = val.(string)
+		case "UrlPullDecorate":
+			config.urlPullDecorate = val.(string)
+		case "DecorateSyncInterval":
+			config.decorateSyncInterval = int(val.(float64))
+		case "DecorateStore":
+			config.decorateStore = val.(string)
+		case "DecorateAuditLog":
+			config.decorateAuditLog = val.(string)
 
 		}
 
@@ -181,6 +396,22 @@ func ParseConfig(configPath string, config *Config) error {
 		return err
 	}
 
+	//可选配置
+	ttlDict, ok := dict["Provider-Publish-Ttl"].(map[string]interface{})
+	if ok {
+		config.ttlMap = ttlDict
+	}
+
+	limitDict, ok := dict["Provider-Topic-Limit"].(map[string]interface{})
+	if ok {
+		config.limitMap = limitDict
+	}
+
+	operatorDict, ok := dict["Provider-Backend-Operator"].(map[string]interface{})
+	if ok {
+		config.operatorMap = operatorDict
+	}
+
 	clientDict := dict["Client"]
 	if nil == clientDict {
 		fmt.Println("config file %s:%s format  error", configPath, dict)
@@ -226,6 +457,8 @@ func ParseConfig(configPath string, config *Config) error {
 			config.brokerPoolMax = int(val.(float64))
 		case "PoolTimeout":
 			config.brokerTimeout = int(val.(float64))
+		case "MultiQuery":
+			config.brokerMultiQuery = val.(bool)
 		}
 	}
 
@@ -3,15 +3,18 @@ package main
 /**
  * 推送平绿的控制算法
  * 1、将当前的推送按照不同的权重插到不同的队列中
- * 2、每插入一次，通知消费协程一次
- * 3、消息协程每次都从高到低，一次遍历所有队列
- * 4、找到一条消息则处理，处理完后等待下次循环再次从头开始
+ * 2、每插入一次，唤醒一个等待的消费协程
+ * 3、消息协程每次按调度策略(schedule.go)选出一条消息
+ * 4、找到一条消息则处理，所有队列为空则阻塞等待
  * 5、消息协程推送到共享层，如果共享控制层的流控返回繁忙
  * 6、繁忙，则重新将此消息加入到推送队列
  * 7、消息具有生命周期ttl，当周期已结束消息不再会进入循环
+ * 8、每个权重队列有容量上限，满了按配置丢弃新消息或最早的消息
  */
 import (
+	"container/heap"
 	"encoding/json"
+	"strconv"
 	"sync"
 	"sync/atomic"
 )
@@ -19,7 +22,7 @@ import (
 var (
 	WeightQueueMap   = map[int]*Queue{}
 	MaxPublishWeight = configOpt.publishMaxWeight
-	NewJob           = make(chan bool, configOpt.publishMaxCount)
+	publishQueue     = NewPublishQueue(0, OVERFLOW_DROP_OLDEST)
 
 	//每条处理消息的条数
 	MaxPublishCount int64 = configOpt.publishMaxCount
@@ -30,6 +33,12 @@ var (
 	MaxPublishQps int64 = configOpt.publishMaxQps
 	CurSecondQps  int64 = 0
 	QpsExceed           = false
+
+	//消息生命周期
+	MaxPublishTtl = configOpt.publishMaxTtl
+	PublishTtlMap = map[int]int{}
+	DefaultTtlKey = "default"
+	DefaultTtl    = 0
 )
 
 func ResetCurCount() {
@@ -67,7 +76,10 @@ func InrcCurQpsAndTryTrans(qps int64) (bool, int64) {
 
 func SetMaxPublishCount(count int64) {
 	MaxPublishCount = count
-	NewJob = make(chan bool, count)
+}
+
+func SetPublishQueue(capacity int, overflow string) {
+	publishQueue = NewPublishQueue(capacity, overflow)
 }
 
 func SetMaxPublishQps(qps int64) {
@@ -78,127 +90,219 @@ func SetMaxPublishWeight(weight int) {
 	MaxPublishWeight = weight
 }
 
+func SetMaxPublishTtl(ttl int) {
+	MaxPublishTtl = ttl
+}
+
+//每个权重的默认生命周期 {"default": 3, "10": 30}
+func InitPublishTtlMap(dmap map[string]interface{}) {
+	PublishTtlMap = map[int]int{}
+	for k, v := range dmap {
+		val, ok := v.(float64)
+		if !ok {
+			continue
+		}
+		if k == DefaultTtlKey {
+			DefaultTtl = int(val)
+			continue
+		}
+		weight, err := strconv.Atoi(k)
+		if err != nil {
+			continue
+		}
+		PublishTtlMap[weight] = int(val)
+	}
+}
+
+//计算消息的生命周期
+//1、调用方指定了ttl则使用指定值
+//2、否则使用权重对应的默认值，再否则使用default，都没有配置则等于权重
+//3、不能超过最大生命周期
+func GainPublishTtl(weight int, ttl int) int {
+	if ttl <= 0 {
+		if v, ok := PublishTtlMap[weight]; ok {
+			ttl = v
+		} else if DefaultTtl > 0 {
+			ttl = DefaultTtl
+		} else {
+			ttl = weight
+		}
+	}
+	if MaxPublishTtl > 0 && ttl > MaxPublishTtl {
+		ttl = MaxPublishTtl
+	}
+	return ttl
+}
+
+func SetPublishScheduler(name string, quantum int) {
+	publishScheduler = NewScheduler(name, quantum)
+}
+
+//按 (PubTime, seq) 排序的小顶堆，回收的消息按原来的顺序插回 O(log n)
 type Item struct {
 	Data *PublishForm
-	Next *Item
+	Seq  uint64 //入队序号，同一秒内保持先进先出
 }
 
 type Queue struct {
-	//推送队列
-	Length int64 //队列长度
-	Head   *Item //队列头
-	Tail   *Item //队列尾
-	Lock   sync.Mutex
+	items []*Item
 }
 
-func (p *Queue) push(pub *PublishForm, reuse bool) {
-	p.Lock.Lock()
-	defer p.Lock.Unlock()
-
-	item := &Item{
-		Data: pub,
-		Next: nil,
+func (p *Queue) Len() int { return len(p.items) }
+func (p *Queue) Less(i, j int) bool {
+	a, b := p.items[i], p.items[j]
+	if a.Data.PubTime != b.Data.PubTime {
+		return a.Data.PubTime < b.Data.PubTime
 	}
+	return a.Seq < b.Seq
+}
+func (p *Queue) Swap(i, j int) { p.items[i], p.items[j] = p.items[j], p.items[i] }
+func (p *Queue) Push(x interface{}) {
+	p.items = append(p.items, x.(*Item))
+}
+func (p *Queue) Pop() interface{} {
+	n := len(p.items)
+	item := p.items[n-1]
+	p.items[n-1] = nil
+	p.items = p.items[:n-1]
+	return item
+}
 
-	//当前队列为空
-	if p.Length == 0 {
-		p.Head = item
-		p.Tail = item
-	} else {
-		//队列不为空
+func (p *Queue) push(item *Item) {
+	heap.Push(p, item)
+}
 
-		//新消息，追加到队列末尾
-		if !reuse {
-			p.Tail.Next = item
-			p.Tail = item
-		} else {
-			//回收的消息，需要插到时间顺序的位置
-			//插到最前
-			if p.Head.Data.PubTime > item.Data.PubTime {
-				item.Next = p.Head
-				p.Head = item
-			} else {
-				cur := p.Head
-				var point *Item = nil
-				j := 0
-				for cur != nil {
-					//没有到末尾
-					j++
-					if cur.Next != nil {
-						//当前的下一个节点发布时间比这个节点要晚
-						if cur.Next.Data.PubTime > item.Data.PubTime {
-							point = cur
-							break
-						}
-					}
-					cur = cur.Next
-				}
-				//后插（因为查找的是前一个节点）
-				if cur != nil {
-					tmp := cur.Next
-					point.Next = item
-					item.Next = tmp
-				} else {
-					//插到末尾
-					p.Tail.Next = item
-					p.Tail = item
-				}
-			}
+func (p *Queue) pop() *PublishForm {
+	return p.popIf(nil)
+}
 
-		}
+//队列头满足条件才出队
+func (p *Queue) popIf(cond func(*PublishForm) bool) *PublishForm {
+	if len(p.items) == 0 {
+		return nil
+	}
+	if cond != nil && !cond(p.items[0].Data) {
+		return nil
+	}
+	return heap.Pop(p).(*Item).Data
+}
 
+/**
+ * 所有权重队列共用一把锁，消费协程在条件变量上等待
+ * 调度器(Scheduler)在持有锁的情况下访问 WeightQueueMap
+ */
+type PublishQueue struct {
+	lock     sync.Mutex
+	cond     *sync.Cond
+	length   int64  //所有队列的消息总数
+	seq      uint64 //入队序号
+	capacity int    //每个权重队列的最大长度，<=0 不限制
+	overflow string //队列满时的处理策略
+}
+
+const (
+	OVERFLOW_DROP_NEW    = "drop_new"    //丢弃新消息
+	OVERFLOW_DROP_OLDEST = "drop_oldest" //丢弃队列中最早的消息
+)
+
+func NewPublishQueue(capacity int, overflow string) *PublishQueue {
+	queue := &PublishQueue{
+		capacity: capacity,
+		overflow: overflow,
+	}
+	if overflow != OVERFLOW_DROP_NEW {
+		queue.overflow = OVERFLOW_DROP_OLDEST
 	}
-	//队列长度+1
-	p.Length++
+	queue.cond = sync.NewCond(&queue.lock)
+	return queue
 }
 
-func (p *Queue) pop() *PublishForm {
-	p.Lock.Lock()
-	defer p.Lock.Unlock()
+func (p *PublishQueue) Put(pub *PublishForm, reuse bool) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
 
-	if p.Length == 0 {
-		return nil
+	queue, ok := WeightQueueMap[pub.Weight]
+	if !ok {
+		return false
 	}
 
-	cur := p.Head
-	p.Head = cur.Next
-	pub := cur.Data
-	p.Length -= 1
-	if p.Length == 0 {
-		p.Tail = nil
+	item := &Item{Data: pub}
+	if reuse {
+		//回收的消息保持原来的顺序
+		item.Seq = pub.seq
+	} else {
+		p.seq++
+		item.Seq = p.seq
+		pub.seq = p.seq
 	}
 
-	return pub
+	if p.capacity > 0 && queue.Len() >= p.capacity {
+		if p.overflow == OVERFLOW_DROP_NEW {
+			IncrPublishDropped(pub.Weight)
+			log.Warning("publish queue<%d> full, drop new<%s>", pub.Weight, pub.UpstreamId)
+			return false
+		}
+		old := queue.pop()
+		p.length--
+		IncrPublishDropped(old.Weight)
+		log.Warning("publish queue<%d> full, drop oldest<%s>", old.Weight, old.UpstreamId)
+	}
 
+	queue.push(item)
+	p.length++
+	p.cond.Signal()
+	return true
 }
 
-func CollectPublish(pub *PublishForm, reuse bool) {
-	weight := pub.Weight
-	queue, ok := WeightQueueMap[weight]
-	if !ok {
-		//消息权重不在指定范围，丢弃
-		//not support ignore
-		return
+//阻塞直到取到一条消息
+func (p *PublishQueue) Take() *PublishForm {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for {
+		if p.length > 0 {
+			if pub := publishScheduler.Next(); pub != nil {
+				p.length--
+				return pub
+			}
+		}
+		p.cond.Wait()
 	}
-	queue.push(pub, reuse)
+}
+
+func (p *PublishQueue) Empty() bool {
+	return p.length == 0
+}
 
-	log.Debug("---deliver new job")
-	go func() {
-		NewJob <- true
-	}()
+//各权重队列长度
+func (p *PublishQueue) Lens() map[int]int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	lens := map[int]int{}
+	for k, queue := range WeightQueueMap {
+		lens[k] = queue.Len()
+	}
+	return lens
+}
+
+func CollectPublish(pub *PublishForm, reuse bool) {
+	//消息权重不在指定范围或者队列已满，丢弃
+	if publishQueue.Put(pub, reuse) {
+		log.Debug("---deliver new job")
+	}
 }
 
 func StartPublishConsumerLoop(multi int) {
 	/**先初始化所有的queue*/
 	for i := 0; i <= MaxPublishWeight; i++ {
-		queue := &Queue{
-			Length: 0,
-			Head:   nil,
-			Tail:   nil,
-			Lock:   sync.Mutex{},
-		}
-		WeightQueueMap[i] = queue
+		WeightQueueMap[i] = &Queue{}
+	}
+	initPublishStats()
+	if publishScheduler == nil {
+		publishScheduler = NewScheduler(SCHEDULE_STRICT, 0)
 	}
+	log.Info("publish schedule: %s", publishScheduler.Name())
 
 	for i := 0; i < multi; i++ {
 		go ConsumerPublish()
@@ -207,32 +311,24 @@ func StartPublishConsumerLoop(multi int) {
 
 func ConsumerPublish() {
 	for {
-		<-NewJob
+		pub := publishQueue.Take()
+		if pub.PubTime+int64(pub.Ttl) < Gtimer.Unix {
+			log.Warning("publish<%s> expired, weight: %d, ttl: %d, delay: %d",
+				pub.UpstreamId, pub.Weight, pub.Ttl, Gtimer.Unix-pub.PubTime)
+			IncrPublishExpired(pub.Weight)
+			continue
+		}
+		log.Debug("---->publish catch, weight: %d, id:%s", pub.Weight, pub.UpstreamId)
 
-		for i := MaxPublishWeight; i >= 0; i-- {
-			queue, ok := WeightQueueMap[i]
-			if !ok {
-				continue
-			}
-			pub := queue.pop()
-			if pub == nil {
-				continue
-			}
-			if pub.PubTime+int64(pub.Ttl) < Gtimer.Unix {
-				continue
+		ret := spreadToBrokers(pub)
+		if !ret.Ok() {
+			//如果是系统繁忙没有进行推送，则将此消息塞回到推送队列中去
+			if ret.Code == SYSTEM_BUSY {
+				CollectPublish(pub, true)
 			}
-			log.Debug("---->publish catch, weight: %d, id:%s", pub.Weight, pub.UpstreamId)
-
-			ret := spreadToBrokers(pub)
-			if !ret.Ok() {
-				//如果是系统繁忙没有进行推送，则将此消息塞回到推送队列中去
-				if ret.Code == SYSTEM_BUSY {
-					CollectPublish(pub, true)
-				}
-			}
-
+		} else {
+			IncrPublishDispatched(pub.Weight)
 		}
-
 	}
 }
 
@@ -255,6 +351,8 @@ func spreadToBrokers(pub *PublishForm) Error {
 
 	jstr, _ := json.Marshal(data)
 	pub.Data = string(jstr)
+	//不能连接broker的订阅者
+	subscribeHub.Deliver(pub.Topic, pub.Data)
 	for _, addrStr := range configOpt.brokerAddrs {
 		go func(addr string) {
 			conn, errMsg := brokerPool.GetBrokerConn(addr, true)
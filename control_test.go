@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+)
+
+const benchPublishWeight = 10
+
+//每次重建权重队列，消息按权重轮流分布
+func setupBenchPublish(schedule string) []*PublishForm {
+	MaxPublishWeight = benchPublishWeight
+	WeightQueueMap = map[int]*Queue{}
+	for i := 0; i <= MaxPublishWeight; i++ {
+		WeightQueueMap[i] = &Queue{}
+	}
+	initPublishStats()
+	publishScheduler = NewScheduler(schedule, 0)
+	publishQueue = NewPublishQueue(0, OVERFLOW_DROP_OLDEST)
+
+	pubs := make([]*PublishForm, MaxPublishWeight+1)
+	for i := range pubs {
+		pubs[i] = &PublishForm{Topic: "bench", Msg: "hello", Weight: i}
+	}
+	return pubs
+}
+
+//多个生产者、一个消费者，和推送流程的用法一致
+func BenchmarkPublishQueue(b *testing.B) {
+	for _, schedule := range []string{SCHEDULE_STRICT, SCHEDULE_WRR, SCHEDULE_DRR} {
+		b.Run(schedule, func(b *testing.B) {
+			pubs := setupBenchPublish(schedule)
+			done := make(chan bool)
+			go func() {
+				for i := 0; i < b.N; i++ {
+					publishQueue.Take()
+				}
+				close(done)
+			}()
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					publishQueue.Put(pubs[i%len(pubs)], false)
+					i++
+				}
+			})
+			<-done
+		})
+	}
+}
+
+//基准: 同样的生产消费方式用一个带缓冲的channel，不区分权重
+func BenchmarkPublishChannel(b *testing.B) {
+	pubs := setupBenchPublish(SCHEDULE_STRICT)
+	queue := make(chan *PublishForm, 1024)
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < b.N; i++ {
+			<-queue
+		}
+		close(done)
+	}()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			queue <- pubs[i%len(pubs)]
+			i++
+		}
+	})
+	<-done
+}
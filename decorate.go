@@ -1,45 +1,482 @@
 package main
 
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
 var (
-	DecorateMap        map[string]float64 = nil
-	DefaultDecorateKey                    = "default"
+	DecorateMap        map[string]*DecorateRule = nil
+	DefaultDecorateKey                          = "default"
+	decorateLock       sync.RWMutex
+
+	//模式规则，按第一级分组，组内按优先级排列
+	decoratePatterns = &DecoratePatternIndex{}
+	//topic -> 匹配到的模式规则，规则变化时清空
+	decorateMatched     = map[string]*list.Element{}
+	decorateMatchedLru  = list.New() //最近访问的在前
+	decorateMatchedLock sync.Mutex
 )
 
-//大于等于0表示实际值 x 加权值
-//小于0 表示用该值的绝对值 替换实际值
-//大于1且是小数形式 2.xx  则对xx后面的尾数进行随机
+//缓存的topic匹配结果上限，超过后淘汰最久没有访问的
+const DECORATE_MATCHED_MAX = 100000
+
+//随机浮动的变化周期(秒)
+const DECORATE_JITTER_INTERVAL = 10
+
+/**
+ * 在线人数修饰规则，兼容原来的数字配置
+ * 数字大于等于0表示实际值 x 加权值
+ * 数字小于0 表示用该值的绝对值 替换实际值
+ *
+ * 对象形式:
+ * {
+ *     "multiplier": 1.5,          //加权值，默认1
+ *     "fixed": 1000,              //大于0表示用固定值替换实际值，其它项不再生效
+ *     "jitter": 0.03,             //随机浮动比例，0.03 表示 ±3%，每个topic每10秒变化一次
+ *     "floor": 100,               //最少显示人数
+ *     "cap": 1000000,             //最多显示人数，0 不限制
+ *     "smooth": {"alpha": 0.3, "maxDecrease": 0.05, "interval": 1}, //平滑，见smooth.go
+ *     "schedules": [              //时间段内使用的规则，按顺序匹配第一个
+ *         {"start": 1500000000, "end": 1500003600, "rule": {...}}
+ *     ]
+ * }
+ */
+type DecorateRule struct {
+	Multiplier float64            `json:"multiplier"`
+	Fixed      int64              `json:"fixed,omitempty"`
+	Jitter     float64            `json:"jitter,omitempty"`
+	Floor      int64              `json:"floor,omitempty"`
+	Cap        int64              `json:"cap,omitempty"`
+	Schedules  []DecorateSchedule `json:"schedules,omitempty"`
+	Smooth     *DecorateSmooth    `json:"smooth,omitempty"`
+}
+
+type DecorateSchedule struct {
+	Start int64         `json:"start"`
+	End   int64         `json:"end"`
+	Rule  *DecorateRule `json:"rule"`
+}
+
+//没有配置任何规则时的默认值
+var defaultDecorateRule = &DecorateRule{Multiplier: 1}
+
+//把数字形式转成规则
+func NewDecorateRule(val float64) *DecorateRule {
+	if val < 0 {
+		return &DecorateRule{Fixed: int64(0 - val)}
+	}
+	return &DecorateRule{Multiplier: val}
+}
+
+//解析配置或接口中的规则，可以是数字或对象
+func ParseDecorateRule(v interface{}) (*DecorateRule, error) {
+	jstr, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	rule := &DecorateRule{}
+	if err := json.Unmarshal(jstr, rule); err != nil {
+		return nil, err
+	}
+	return rule, rule.check()
+}
+
+func (p *DecorateRule) UnmarshalJSON(data []byte) error {
+	var val float64
+	if err := json.Unmarshal(data, &val); err == nil {
+		*p = *NewDecorateRule(val)
+		return nil
+	}
+	type rule DecorateRule
+	tmp := rule{Multiplier: 1}
+	if err := json.Unmarshal(data, &tmp); err != nil {
+		return err
+	}
+	*p = DecorateRule(tmp)
+	return nil
+}
+
+func (p *DecorateRule) check() error {
+	if p.Multiplier < 0 || p.Fixed < 0 || p.Floor < 0 || p.Cap < 0 {
+		return fmt.Errorf("negative decorate value")
+	}
+	if p.Jitter < 0 || p.Jitter >= 1 {
+		return fmt.Errorf("jitter must be in [0, 1)")
+	}
+	if p.Cap > 0 && p.Floor > p.Cap {
+		return fmt.Errorf("floor greater than cap")
+	}
+	if p.Smooth != nil {
+		if err := p.Smooth.check(); err != nil {
+			return err
+		}
+	}
+	for _, schedule := range p.Schedules {
+		if nil == schedule.Rule || schedule.End <= schedule.Start {
+			return fmt.Errorf("invalid decorate schedule")
+		}
+		if len(schedule.Rule.Schedules) > 0 {
+			return fmt.Errorf("nested decorate schedule")
+		}
+		if err := schedule.Rule.check(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//只有加权值或固定值的规则仍然输出成数字，兼容老的调用方
+func (p *DecorateRule) MarshalJSON() ([]byte, error) {
+	if p.Jitter == 0 && p.Floor == 0 && p.Cap == 0 && len(p.Schedules) == 0 && p.Smooth == nil {
+		if p.Fixed > 0 {
+			return json.Marshal(0 - float64(p.Fixed))
+		}
+		return json.Marshal(p.Multiplier)
+	}
+	type rule DecorateRule
+	return json.Marshal((*rule)(p))
+}
+
+//当前时间生效的规则
+func (p *DecorateRule) Active(now int64) *DecorateRule {
+	for _, schedule := range p.Schedules {
+		if now >= schedule.Start && now < schedule.End {
+			return schedule.Rule
+		}
+	}
+	return p
+}
+
+//用固定值替换实际值，不需要去后台捞数据
+func (p *DecorateRule) IsFixed() bool {
+	return p.Fixed > 0
+}
+
+func (p *DecorateRule) Apply(topic string, online int64) int64 {
+	if p.Fixed > 0 {
+		return p.Fixed
+	}
+	val := float64(online) * p.Multiplier
+	if p.Jitter > 0 {
+		val = val * (1 + p.Jitter*decorateJitter(topic, Gtimer.Unix))
+	}
+	result := int64(val)
+	if result < p.Floor {
+		result = p.Floor
+	}
+	if p.Cap > 0 && result > p.Cap {
+		result = p.Cap
+	}
+	return result
+}
+
+//浮动在 [-1, 1) 之间，同一个topic在同一个时间段内不变
+//实际值不变时修饰后的值也不变，各节点返回的也一致
+func decorateJitter(topic string, now int64) float64 {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s:%d", topic, now/DECORATE_JITTER_INTERVAL)
+	return 2*float64(h.Sum64()>>11)/(1<<53) - 1
+}
+
+/**
+ * 规则的key除了具体的topic，还可以是模式
+ * 1、MQTT风格: + 匹配一级，# 匹配剩余所有级(只能在最后)，如 live/+ 、game/#
+ *    + 和 # 必须单独占一级，a/#/b 、live+ 这样的key不合法
+ * 2、前缀: 以 * 结尾且没有其它通配符，如 live/* 匹配所有以 live/ 开头的topic
+ * 3、glob: 包含 * ? [ 的其它形式，按 path.Match 匹配，* 不跨越 /
+ * 匹配优先级: 具体topic > 最长的模式 > default
+ */
+const (
+	DECORATE_PATTERN_MQTT   = "mqtt"
+	DECORATE_PATTERN_PREFIX = "prefix"
+	DECORATE_PATTERN_GLOB   = "glob"
+)
+
+type DecoratePattern struct {
+	Key    string
+	Kind   string
+	levels []string
+	Rule   *DecorateRule
+}
+
+//规则的key，MQTT风格的通配符必须单独占一级，# 只能在最后
+func checkDecorateKey(key string) error {
+	if len(key) == 0 {
+		return fmt.Errorf("empty key")
+	}
+	if !strings.ContainsAny(key, "+#") {
+		return nil
+	}
+	levels := strings.Split(key, "/")
+	for i, level := range levels {
+		if !strings.ContainsAny(level, "+#") {
+			continue
+		}
+		if level != "+" && level != "#" {
+			return fmt.Errorf("wildcard must occupy a whole level")
+		}
+		if level == "#" && i != len(levels)-1 {
+			return fmt.Errorf("# must be the last level")
+		}
+	}
+	return nil
+}
+
+//不是模式或者不合法返回nil
+func NewDecoratePattern(key string, rule *DecorateRule) *DecoratePattern {
+	pattern := &DecoratePattern{Key: key, Rule: rule}
+	switch {
+	case strings.ContainsAny(key, "+#"):
+		if checkDecorateKey(key) != nil {
+			return nil
+		}
+		pattern.Kind = DECORATE_PATTERN_MQTT
+		pattern.levels = strings.Split(key, "/")
+	case strings.HasSuffix(key, "*") && !strings.ContainsAny(key[:len(key)-1], "*?["):
+		pattern.Kind = DECORATE_PATTERN_PREFIX
+	case strings.ContainsAny(key, "*?["):
+		if _, err := path.Match(key, ""); err != nil {
+			return nil
+		}
+		pattern.Kind = DECORATE_PATTERN_GLOB
+	default:
+		return nil
+	}
+	return pattern
+}
+
+func (p *DecoratePattern) Match(topic string) bool {
+	switch p.Kind {
+	case DECORATE_PATTERN_PREFIX:
+		return strings.HasPrefix(topic, p.Key[:len(p.Key)-1])
+	case DECORATE_PATTERN_GLOB:
+		ok, _ := path.Match(p.Key, topic)
+		return ok
+	case DECORATE_PATTERN_MQTT:
+		levels := strings.Split(topic, "/")
+		for i, level := range p.levels {
+			if level == "#" {
+				return true
+			}
+			if i >= len(levels) {
+				return false
+			}
+			if level != "+" && level != levels[i] {
+				return false
+			}
+		}
+		return len(levels) == len(p.levels)
+	}
+	return false
+}
+
+func (p *DecoratePattern) multiLevel() bool {
+	return p.Kind == DECORATE_PATTERN_PREFIX || strings.HasSuffix(p.Key, "#")
+}
+
+//能匹配的topic的第一级，第一级包含通配符返回false
+func (p *DecoratePattern) firstLevel() (string, bool) {
+	key := p.Key
+	if p.Kind == DECORATE_PATTERN_PREFIX {
+		key = key[:len(key)-1]
+	}
+	pos := strings.Index(key, "/")
+	if pos < 0 {
+		return "", false
+	}
+	first := key[:pos]
+	if strings.ContainsAny(first, "+#*?[\\") {
+		return "", false
+	}
+	return first, true
+}
+
+type DecoratePatternList []*DecoratePattern
+
+func (p DecoratePatternList) Len() int      { return len(p) }
+func (p DecoratePatternList) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p DecoratePatternList) Less(i, j int) bool {
+	if len(p[i].Key) != len(p[j].Key) {
+		return len(p[i].Key) > len(p[j].Key)
+	}
+	//长度相同时，匹配多级的模式(# 和前缀)优先级低
+	if p[i].multiLevel() != p[j].multiLevel() {
+		return !p[i].multiLevel()
+	}
+	return p[i].Key < p[j].Key
+}
+
+//按第一级分组的模式，查找时只需要比较同一组和第一级包含通配符的模式
+type DecoratePatternIndex struct {
+	byFirst map[string]DecoratePatternList //第一级是确定值的模式
+	others  DecoratePatternList            //第一级包含通配符的模式，如 +/a 、room-?
+}
+
+func NewDecoratePatternIndex(patterns []*DecoratePattern) *DecoratePatternIndex {
+	index := &DecoratePatternIndex{byFirst: map[string]DecoratePatternList{}}
+	for _, pattern := range patterns {
+		if first, ok := pattern.firstLevel(); ok {
+			index.byFirst[first] = append(index.byFirst[first], pattern)
+		} else {
+			index.others = append(index.others, pattern)
+		}
+	}
+	for _, group := range index.byFirst {
+		sort.Sort(group)
+	}
+	sort.Sort(index.others)
+	return index
+}
+
+//优先级最高的匹配模式
+func (p *DecoratePatternIndex) Match(topic string) *DecoratePattern {
+	var found *DecoratePattern
+	first := topic
+	if pos := strings.Index(topic, "/"); pos >= 0 {
+		first = topic[:pos]
+	}
+	for _, pattern := range p.byFirst[first] {
+		if pattern.Match(topic) {
+			found = pattern
+			break
+		}
+	}
+	for _, pattern := range p.others {
+		if found != nil && !(DecoratePatternList{pattern, found}).Less(0, 1) {
+			break
+		}
+		if pattern.Match(topic) {
+			return pattern
+		}
+	}
+	return found
+}
+
+//规则变化后重建模式索引，调用方持有 decorateLock
+func rebuildDecoratePatterns() {
+	patterns := []*DecoratePattern{}
+	for k, v := range DecorateMap {
+		if k == DefaultDecorateKey {
+			continue
+		}
+		if pattern := NewDecoratePattern(k, v); pattern != nil {
+			patterns = append(patterns, pattern)
+		}
+	}
+	decoratePatterns = NewDecoratePatternIndex(patterns)
+
+	decorateMatchedLock.Lock()
+	decorateMatched = map[string]*list.Element{}
+	decorateMatchedLru = list.New()
+	decorateMatchedLock.Unlock()
+}
+
+//缓存的匹配结果，没有匹配到的也缓存
+type decorateMatchedEntry struct {
+	topic   string
+	pattern *DecoratePattern
+}
+
+//查找最长的匹配模式，调用方持有 decorateLock 读锁
+func matchDecoratePattern(topic string) *DecoratePattern {
+	decorateMatchedLock.Lock()
+	if elem, ok := decorateMatched[topic]; ok {
+		decorateMatchedLru.MoveToFront(elem)
+		decorateMatchedLock.Unlock()
+		return elem.Value.(*decorateMatchedEntry).pattern
+	}
+	decorateMatchedLock.Unlock()
+
+	pattern := decoratePatterns.Match(topic)
+
+	decorateMatchedLock.Lock()
+	if _, ok := decorateMatched[topic]; !ok {
+		decorateMatched[topic] = decorateMatchedLru.PushFront(&decorateMatchedEntry{topic, pattern})
+		for len(decorateMatched) > DECORATE_MATCHED_MAX {
+			oldest := decorateMatchedLru.Back()
+			decorateMatchedLru.Remove(oldest)
+			delete(decorateMatched, oldest.Value.(*decorateMatchedEntry).topic)
+		}
+	}
+	decorateMatchedLock.Unlock()
+	return pattern
+}
+
+//修饰对外展示的在线人数，规则配置了平滑时再做平滑处理
+func DecorateOnline(topic string, rule *DecorateRule, online int64) int64 {
+	result := rule.Apply(topic, online)
+	if rule.Smooth != nil && !rule.IsFixed() {
+		result = SmoothOnline(topic, rule.Smooth, result)
+	}
+	return result
+}
 
 func InitOnlineDecorteMap(dmap map[string]interface{}) {
-	DecorateMap = map[string]float64{}
+	DecorateMap = map[string]*DecorateRule{}
 	for k, v := range dmap {
-		val := v.(float64)
-		DecorateMap[k] = val
+		if err := checkDecorateKey(k); err != nil {
+			fmt.Printf("invalid decorate key <%s>, %v\n", k, err)
+			continue
+		}
+		rule, err := ParseDecorateRule(v)
+		if err != nil {
+			fmt.Printf("invalid decorate rule of <%s>, %v\n", k, err)
+			continue
+		}
+		DecorateMap[k] = rule
 	}
+	rebuildDecoratePatterns()
 	//fmt.Printf("%+v\n", DecorateMap)
 }
 
-func PutDecorateMap(k string, v float64) {
-	DecorateMap[k] = v
-}
-
-func GetDecorateMap(k string) float64 {
+func GetDecorateMap(k string) *DecorateRule {
+	decorateLock.RLock()
+	defer decorateLock.RUnlock()
 	v, _ := DecorateMap[k]
 	return v
 }
 
-func GetDecorate(topic string) float64 {
+//返回的是副本
+func GetAllDecorate() map[string]*DecorateRule {
+	decorateLock.RLock()
+	defer decorateLock.RUnlock()
+
+	all := make(map[string]*DecorateRule, len(DecorateMap))
+	for k, v := range DecorateMap {
+		all[k] = v
+	}
+	return all
+}
+
+//返回topic当前生效的规则
+func GetDecorate(topic string) *DecorateRule {
+	decorateLock.RLock()
+	defer decorateLock.RUnlock()
+
 	//先查找是否用具体的直播间加权规则
 	v, ok := DecorateMap[topic]
 	if ok {
-		return v
+		return v.Active(Gtimer.Unix)
+	}
+
+	//再查找最长的模式规则
+	if pattern := matchDecoratePattern(topic); pattern != nil {
+		return pattern.Rule.Active(Gtimer.Unix)
 	}
 
 	//查找默认规则
 	v, ok = DecorateMap[DefaultDecorateKey]
 	if ok {
-		return v
+		return v.Active(Gtimer.Unix)
 	}
 
-	//一个都没找到返回0
-	return 1
+	//一个都没找到不修饰
+	return defaultDecorateRule
 }
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+)
+
+func TestCheckDecorateKey(t *testing.T) {
+	for _, c := range []struct {
+		key string
+		ok  bool
+	}{
+		{"live/room", true},
+		{"live/+", true},
+		{"+/room", true},
+		{"game/#", true},
+		{"#", true},
+		{"live/+/#", true},
+		{"live/*", true},
+		{"room-?", true},
+		{"", false},
+		{"a/#/b", false},
+		{"#/a", false},
+		{"live+", false},
+		{"live/a+", false},
+		{"live/#a", false},
+	} {
+		if err := checkDecorateKey(c.key); (err == nil) != c.ok {
+			t.Errorf("key <%s>: %v, want ok %v", c.key, err, c.ok)
+		}
+		if pattern := NewDecoratePattern(c.key, nil); !c.ok && pattern != nil {
+			t.Errorf("key <%s>: invalid key built a %s pattern", c.key, pattern.Kind)
+		}
+	}
+}
+
+//按第一级分组查找的结果和逐个比较所有模式相同
+func TestDecoratePatternIndex(t *testing.T) {
+	keys := []string{
+		"live/+", "live/#", "live/*", "live/room-?", "live/room-1/+", "live/ro*",
+		"+/room-1", "#", "li*", "room-?", "*", "game/+/score", "game/#", "+/+/score",
+	}
+	patterns := DecoratePatternList{}
+	for _, key := range keys {
+		pattern := NewDecoratePattern(key, nil)
+		if pattern == nil {
+			t.Fatalf("key <%s> is not a pattern", key)
+		}
+		patterns = append(patterns, pattern)
+	}
+	index := NewDecoratePatternIndex(patterns)
+	sort.Sort(patterns)
+
+	topics := []string{
+		"live", "live/room-1", "live/room-12", "live/room-1/a", "live/other", "lively",
+		"room-1", "room-12", "game/1/score", "game/1", "game", "x/room-1", "x/y/score", "", "/a",
+	}
+	for _, topic := range topics {
+		var want *DecoratePattern
+		for _, pattern := range patterns {
+			if pattern.Match(topic) {
+				want = pattern
+				break
+			}
+		}
+		if got := index.Match(topic); got != want {
+			t.Errorf("topic <%s>: index matched %v, linear matched %v", topic, got, want)
+		}
+	}
+}
+
+//匹配缓存满了淘汰最久没有访问的topic
+func TestDecorateMatchedLru(t *testing.T) {
+	useTestDecorate(t, map[string]interface{}{"live/+": 2.0})
+
+	decorateLock.RLock()
+	defer decorateLock.RUnlock()
+	matchDecoratePattern("live/hot")
+	for i := 0; i < DECORATE_MATCHED_MAX; i++ {
+		if i%1000 == 0 {
+			matchDecoratePattern("live/hot")
+		}
+		matchDecoratePattern(fmt.Sprintf("live/%d", i))
+	}
+
+	decorateMatchedLock.Lock()
+	defer decorateMatchedLock.Unlock()
+	if n := len(decorateMatched); n != DECORATE_MATCHED_MAX || decorateMatchedLru.Len() != n {
+		t.Errorf("%d matched cached, lru %d, want %d", n, decorateMatchedLru.Len(), DECORATE_MATCHED_MAX)
+	}
+	if _, ok := decorateMatched["live/hot"]; !ok {
+		t.Errorf("recently used topic evicted")
+	}
+	if _, ok := decorateMatched["live/0"]; ok {
+		t.Errorf("oldest topic not evicted")
+	}
+}
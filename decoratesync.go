@@ -0,0 +1,473 @@
+package main
+
+/**
+ * 修饰规则的持久化和集群同步
+ * 1、每次修改生成一个版本号(集群内的逻辑时钟)，规则按key记录最后修改的版本
+ * 2、修改后写入本地存储文件(DecorateStore)，重启时用存储文件覆盖配置文件中的规则
+ * 3、修改通过签名接口异步同步给集群内其它节点(relayList)
+ *    接收方只接受版本更新的修改，版本相同时节点标识大的优先，保证各节点最终一致
+ * 4、每次修改写审计日志(DecorateAuditLog)，记录谁在什么时候改了什么
+ * 5、同步失败的修改靠定时对账补齐: 启动时和每 DecorateSyncInterval 秒向每个节点发送本地所有修改的摘要
+ *    摘要不一致时对端返回它的所有修改，按上面的规则合并，双方各自拉取，最终一致
+ */
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	//当前版本，本地修改和收到的修改中最大的版本
+	DecorateVersion int64 = 0
+	//key -> 最后一次修改
+	decorateChanges = map[string]*DecorateChange{}
+
+	//存储快照的序号，写文件时丢弃比已写入的更旧的快照
+	decorateStoreSeq   int64 = 0
+	decorateStoreSaved int64 = 0
+	decorateStoreLock  sync.Mutex
+)
+
+type DecorateChange struct {
+	Key      string
+	Rule     *DecorateRule //nil 表示删除
+	Version  int64
+	Node     string //发起修改的节点
+	Operator string
+	Time     int64
+}
+
+//是否比另一个修改新
+func (p *DecorateChange) newer(other *DecorateChange) bool {
+	if nil == other {
+		return true
+	}
+	if p.Version != other.Version {
+		return p.Version > other.Version
+	}
+	return p.Node > other.Node
+}
+
+type decorateStore struct {
+	Version int64
+	Rules   map[string]*DecorateRule
+	Changes map[string]*DecorateChange
+
+	seq int64
+}
+
+//用存储文件中的规则覆盖配置文件
+func LoadDecorateStore() {
+	if len(configOpt.decorateStore) == 0 {
+		return
+	}
+	contents, err := ioutil.ReadFile(configOpt.decorateStore)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Error("read decorate store<%s> failed, %v", configOpt.decorateStore, err)
+		}
+		return
+	}
+	store := &decorateStore{}
+	if err := json.Unmarshal(contents, store); err != nil || nil == store.Rules {
+		log.Error("parse decorate store<%s> failed, %v", configOpt.decorateStore, err)
+		return
+	}
+
+	decorateLock.Lock()
+	defer decorateLock.Unlock()
+	DecorateMap = store.Rules
+	DecorateVersion = store.Version
+	if store.Changes != nil {
+		decorateChanges = store.Changes
+	}
+	rebuildDecoratePatterns()
+	log.Info("load %d decorate rules from store<%s>, version: %d",
+		len(DecorateMap), configOpt.decorateStore, DecorateVersion)
+}
+
+//当前规则的快照，调用方持有 decorateLock
+//规则对象修改时整体替换，不会原地修改，复制map即可
+func snapshotDecorateStore() *decorateStore {
+	if len(configOpt.decorateStore) == 0 {
+		return nil
+	}
+	decorateStoreSeq++
+	store := &decorateStore{
+		Version: DecorateVersion,
+		Rules:   make(map[string]*DecorateRule, len(DecorateMap)),
+		Changes: make(map[string]*DecorateChange, len(decorateChanges)),
+		seq:     decorateStoreSeq,
+	}
+	for k, v := range DecorateMap {
+		store.Rules[k] = v
+	}
+	for k, v := range decorateChanges {
+		store.Changes[k] = v
+	}
+	return store
+}
+
+//写入存储文件，不能持有 decorateLock，避免写磁盘时阻塞读取规则
+func saveDecorateStore(store *decorateStore) {
+	if nil == store {
+		return
+	}
+	decorateStoreLock.Lock()
+	defer decorateStoreLock.Unlock()
+	//并发修改时，更新的快照可能已经先写入了
+	if store.seq <= decorateStoreSaved {
+		return
+	}
+
+	jstr, err := json.MarshalIndent(store, "", "    ")
+	if err != nil {
+		log.Error("marshal decorate store failed, %v", err)
+		return
+	}
+	tmp := configOpt.decorateStore + ".tmp"
+	if err := ioutil.WriteFile(tmp, jstr, 0644); err != nil {
+		log.Error("write decorate store<%s> failed, %v", tmp, err)
+		return
+	}
+	if err := os.Rename(tmp, configOpt.decorateStore); err != nil {
+		log.Error("write decorate store<%s> failed, %v", configOpt.decorateStore, err)
+		return
+	}
+	decorateStoreSaved = store.seq
+}
+
+//调用方持有 decorateLock，并在修改后调用 rebuildDecoratePatterns
+func applyDecorateChange(change *DecorateChange) *DecorateRule {
+	old := DecorateMap[change.Key]
+	if nil == change.Rule {
+		delete(DecorateMap, change.Key)
+	} else {
+		DecorateMap[change.Key] = change.Rule
+	}
+	decorateChanges[change.Key] = change
+	if change.Version > DecorateVersion {
+		DecorateVersion = change.Version
+	}
+	return old
+}
+
+//本节点的修改，rule 为nil 表示删除
+func ChangeDecorate(key string, rule *DecorateRule, operator string) *DecorateChange {
+	return ChangeDecorateBatch(map[string]*DecorateRule{key: rule}, false, operator)[0]
+}
+
+//本节点的一批修改，共用一个版本，只写一次存储文件，每个节点只同步一次
+//rule 为nil 表示删除，replace 为true 时同时删除不在 rules 中的规则
+func ChangeDecorateBatch(rules map[string]*DecorateRule, replace bool, operator string) []*DecorateChange {
+	decorateLock.Lock()
+	keys := make([]string, 0, len(rules))
+	for key := range rules {
+		keys = append(keys, key)
+	}
+	if replace {
+		for key := range DecorateMap {
+			if _, ok := rules[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+
+	version := DecorateVersion + 1
+	changes := make([]*DecorateChange, 0, len(keys))
+	olds := make([]*DecorateRule, 0, len(keys))
+	for _, key := range keys {
+		change := &DecorateChange{
+			Key:      key,
+			Rule:     rules[key],
+			Version:  version,
+			Node:     LocalNodeId(),
+			Operator: operator,
+			Time:     Gtimer.Unix,
+		}
+		changes = append(changes, change)
+		olds = append(olds, applyDecorateChange(change))
+	}
+	if len(changes) == 0 {
+		decorateLock.Unlock()
+		return changes
+	}
+	rebuildDecoratePatterns()
+	store := snapshotDecorateStore()
+	decorateLock.Unlock()
+
+	saveDecorateStore(store)
+	for i, change := range changes {
+		auditDecorateChange(change, olds[i], "local")
+	}
+	for _, addr := range configOpt.relayList {
+		go syncDecorateChanges(addr, changes)
+	}
+	return changes
+}
+
+func checkDecorateChange(change *DecorateChange) Error {
+	if len(change.Key) == 0 || len(change.Node) == 0 {
+		return NewError(INVALID_PARAM, nil, "invalid params")
+	}
+	if err := checkDecorateKey(change.Key); err != nil {
+		return NewError(INVALID_PARAM, err, "invalid key")
+	}
+	if change.Rule != nil {
+		if err := change.Rule.check(); err != nil {
+			return NewError(INVALID_PARAM, err, "invalid rule")
+		}
+	}
+	return OK
+}
+
+//合并其它节点的修改，只接受比本地新的，返回生效的数量
+func mergeDecorateChanges(changes []*DecorateChange, source string) int {
+	type merged struct {
+		change *DecorateChange
+		old    *DecorateRule
+	}
+	applied := []merged{}
+
+	decorateLock.Lock()
+	for _, change := range changes {
+		if !change.newer(decorateChanges[change.Key]) {
+			continue
+		}
+		applied = append(applied, merged{change, applyDecorateChange(change)})
+	}
+	if len(applied) == 0 {
+		decorateLock.Unlock()
+		return 0
+	}
+	rebuildDecoratePatterns()
+	store := snapshotDecorateStore()
+	decorateLock.Unlock()
+
+	saveDecorateStore(store)
+	for _, item := range applied {
+		auditDecorateChange(item.change, item.old, source)
+	}
+	return len(applied)
+}
+
+//集群内同步一批修改的请求，只有一个修改时直接发送 DecorateChange
+type DecorateSyncForm struct {
+	Changes []*DecorateChange
+}
+
+//其它节点同步过来的修改，有不合法的修改时整批拒绝，返回生效的数量
+func ServiceSyncDecorate(changes []*DecorateChange) (int, Error) {
+	if len(changes) == 0 {
+		return 0, NewError(INVALID_PARAM, nil, "invalid params")
+	}
+	for _, change := range changes {
+		if ret := checkDecorateChange(change); !ret.Ok() {
+			return 0, ret
+		}
+	}
+	return mergeDecorateChanges(changes, "sync"), OK
+}
+
+//所有修改的摘要，调用方持有 decorateLock
+func decorateDigest() string {
+	items := make([]string, 0, len(decorateChanges))
+	for key, change := range decorateChanges {
+		items = append(items, fmt.Sprintf("%s:%d:%s\n", key, change.Version, change.Node))
+	}
+	sort.Strings(items)
+	h := md5.New()
+	for _, item := range items {
+		io.WriteString(h, item)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+type DecoratePullForm struct {
+	Version int64
+	Digest  string
+}
+
+//对端拉取修改，摘要一致时不返回修改
+func ServicePullDecorate(form *DecoratePullForm) (Dict, Error) {
+	decorateLock.RLock()
+	defer decorateLock.RUnlock()
+
+	data := Dict{
+		"version": DecorateVersion,
+		"same":    true,
+	}
+	if form.Digest == decorateDigest() {
+		return data, OK
+	}
+	changes := make([]*DecorateChange, 0, len(decorateChanges))
+	for _, change := range decorateChanges {
+		changes = append(changes, change)
+	}
+	data["same"] = false
+	data["changes"] = changes
+	return data, OK
+}
+
+type DecorateItem struct {
+	Key      string        `json:"key"`
+	Rule     *DecorateRule `json:"rule"`
+	Version  int64         `json:"version"`
+	Operator string        `json:"operator,omitempty"`
+	Time     int64         `json:"time,omitempty"`
+}
+
+//按key排序的规则列表，prefix 为空返回全部
+func GetDecorateList(prefix string) []*DecorateItem {
+	decorateLock.RLock()
+	defer decorateLock.RUnlock()
+
+	items := []*DecorateItem{}
+	for key, rule := range DecorateMap {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		item := &DecorateItem{Key: key, Rule: rule}
+		if change, ok := decorateChanges[key]; ok {
+			item.Version = change.Version
+			item.Operator = change.Operator
+			item.Time = change.Time
+		}
+		items = append(items, item)
+	}
+	sort.Sort(DecorateItemList(items))
+	return items
+}
+
+type DecorateItemList []*DecorateItem
+
+func (p DecorateItemList) Len() int           { return len(p) }
+func (p DecorateItemList) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p DecorateItemList) Less(i, j int) bool { return p[i].Key < p[j].Key }
+
+func GetDecorateVersion() int64 {
+	decorateLock.RLock()
+	defer decorateLock.RUnlock()
+	return DecorateVersion
+}
+
+//签名后发送给集群内的节点
+func postDecorate(addr string, path string, body interface{}) (Dict, Error) {
+	httpUrl := fmt.Sprintf("http://%s%s", addr, path)
+	jstr, _ := json.Marshal(body)
+	key, ok := getInvokerKey(configOpt.relayInvoker)
+	if !ok {
+		return nil, NewError(NO_PERM, nil, "invalid invoker")
+	}
+	headerMap := map[string]string{
+		configOpt.requestInvokerKey: configOpt.relayInvoker,
+		configOpt.requestSignKey:    Md5Sig(string(jstr), configOpt.relayInvoker, key),
+	}
+
+	data, ret := HttpPostJson(httpUrl, headerMap, body, configOpt.httpRpcTimeout)
+	if !ret.Ok() {
+		return nil, ret
+	}
+	return TransProviderResult(data)
+}
+
+func syncDecorateChanges(addr string, changes []*DecorateChange) {
+	var body interface{} = &DecorateSyncForm{Changes: changes}
+	if len(changes) == 1 {
+		body = changes[0]
+	}
+	version := changes[0].Version
+
+	for tries := 1; ; tries++ {
+		_, ret := postDecorate(addr, configOpt.urlSyncDecorate, body)
+		if ret.Ok() {
+			log.Info("sync %d decorate changes version %d to <%s> success", len(changes), version, addr)
+			return
+		}
+		log.Error("sync %d decorate changes version %d to <%s> failed(%d), %s",
+			len(changes), version, addr, tries, ret)
+		//放弃后由定时对账补齐
+		if ret.Code == INVALID_PARAM || ret.Code == NO_PERM || tries > configOpt.peerMaxRetry {
+			return
+		}
+		time.Sleep(peerBackoff(tries))
+	}
+}
+
+//和一个节点对账，摘要不一致时拉取对端的所有修改并合并
+func pullDecorate(addr string) {
+	decorateLock.RLock()
+	form := &DecoratePullForm{
+		Version: DecorateVersion,
+		Digest:  decorateDigest(),
+	}
+	decorateLock.RUnlock()
+
+	data, ret := postDecorate(addr, configOpt.urlPullDecorate, form)
+	if !ret.Ok() {
+		log.Error("pull decorate from <%s> failed, %s", addr, ret)
+		return
+	}
+	if same, _ := data["same"].(bool); same {
+		return
+	}
+	changes := []*DecorateChange{}
+	jstr, _ := json.Marshal(data["changes"])
+	if err := json.Unmarshal(jstr, &changes); err != nil {
+		log.Error("pull decorate from <%s> failed, %v", addr, err)
+		return
+	}
+	valid := make([]*DecorateChange, 0, len(changes))
+	for _, change := range changes {
+		if ret := checkDecorateChange(change); !ret.Ok() {
+			log.Error("pull decorate <%s> from <%s> skipped, %s", change.Key, addr, ret)
+			continue
+		}
+		valid = append(valid, change)
+	}
+	applied := mergeDecorateChanges(valid, "pull")
+	log.Info("pull decorate from <%s>, %d changes, %d applied", addr, len(changes), applied)
+}
+
+func StartDecorateSync() {
+	if len(configOpt.urlPullDecorate) == 0 || len(configOpt.relayList) == 0 {
+		return
+	}
+	if configOpt.decorateSyncInterval <= 0 {
+		configOpt.decorateSyncInterval = 60
+	}
+
+	go func() {
+		for {
+			for _, addr := range configOpt.relayList {
+				pullDecorate(addr)
+			}
+			<-time.After(time.Second * time.Duration(configOpt.decorateSyncInterval))
+		}
+	}()
+}
+
+//审计日志，每行一条json记录
+func auditDecorateChange(change *DecorateChange, old *DecorateRule, source string) {
+	record := Dict{
+		"time":     time.Now().Format("2006-01-02 15:04:05"),
+		"source":   source,
+		"node":     change.Node,
+		"operator": change.Operator,
+		"key":      change.Key,
+		"old":      old,
+		"new":      change.Rule,
+		"version":  change.Version,
+	}
+	writeAuditRecord("decorate", configOpt.decorateAuditLog, record)
+}
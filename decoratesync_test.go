@@ -0,0 +1,173 @@
+package main
+
+import (
+	"testing"
+)
+
+//一个节点的修饰规则状态
+type decorateState struct {
+	rules   map[string]*DecorateRule
+	changes map[string]*DecorateChange
+	version int64
+}
+
+//切换当前节点的状态，返回切换前的
+func swapDecorateState(state *decorateState) *decorateState {
+	decorateLock.Lock()
+	defer decorateLock.Unlock()
+	old := &decorateState{DecorateMap, decorateChanges, DecorateVersion}
+	DecorateMap, decorateChanges, DecorateVersion = state.rules, state.changes, state.version
+	rebuildDecoratePatterns()
+	return old
+}
+
+func newDecorateState(changes ...*DecorateChange) *decorateState {
+	state := &decorateState{rules: map[string]*DecorateRule{}, changes: map[string]*DecorateChange{}}
+	for _, change := range changes {
+		if change.Rule != nil {
+			state.rules[change.Key] = change.Rule
+		}
+		state.changes[change.Key] = change
+		if change.Version > state.version {
+			state.version = change.Version
+		}
+	}
+	return state
+}
+
+//不写存储文件和审计日志，测试结束后恢复
+func useDecorateState(t *testing.T, state *decorateState) {
+	savedStore, savedAudit := configOpt.decorateStore, configOpt.decorateAuditLog
+	configOpt.decorateStore, configOpt.decorateAuditLog = "", ""
+	saved := swapDecorateState(state)
+	t.Cleanup(func() {
+		swapDecorateState(saved)
+		configOpt.decorateStore, configOpt.decorateAuditLog = savedStore, savedAudit
+	})
+}
+
+func decorateSet(key string, multiplier float64, version int64, node string) *DecorateChange {
+	return &DecorateChange{Key: key, Rule: &DecorateRule{Multiplier: multiplier}, Version: version, Node: node}
+}
+
+func decorateDelete(key string, version int64, node string) *DecorateChange {
+	return &DecorateChange{Key: key, Version: version, Node: node}
+}
+
+func TestMergeDecorateChanges(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		local    []*DecorateChange
+		incoming []*DecorateChange
+		applied  int
+		want     float64 //live/a 的加权值，0 表示已删除
+		version  int64
+	}{
+		{"new key", nil, []*DecorateChange{decorateSet("live/a", 2, 1, "b")}, 1, 2, 1},
+		{"newer version", []*DecorateChange{decorateSet("live/a", 1, 1, "a")},
+			[]*DecorateChange{decorateSet("live/a", 2, 2, "a")}, 1, 2, 2},
+		{"older version", []*DecorateChange{decorateSet("live/a", 1, 3, "a")},
+			[]*DecorateChange{decorateSet("live/a", 2, 2, "b")}, 0, 1, 3},
+		{"same version bigger node", []*DecorateChange{decorateSet("live/a", 1, 2, "a")},
+			[]*DecorateChange{decorateSet("live/a", 2, 2, "b")}, 1, 2, 2},
+		{"same version smaller node", []*DecorateChange{decorateSet("live/a", 1, 2, "b")},
+			[]*DecorateChange{decorateSet("live/a", 2, 2, "a")}, 0, 1, 2},
+		{"same change", []*DecorateChange{decorateSet("live/a", 1, 2, "a")},
+			[]*DecorateChange{decorateSet("live/a", 1, 2, "a")}, 0, 1, 2},
+		{"newer delete", []*DecorateChange{decorateSet("live/a", 1, 1, "a")},
+			[]*DecorateChange{decorateDelete("live/a", 2, "b")}, 1, 0, 2},
+		{"older delete", []*DecorateChange{decorateSet("live/a", 1, 3, "a")},
+			[]*DecorateChange{decorateDelete("live/a", 2, "b")}, 0, 1, 3},
+		{"set after delete", []*DecorateChange{decorateDelete("live/a", 2, "a")},
+			[]*DecorateChange{decorateSet("live/a", 3, 3, "b")}, 1, 3, 3},
+		{"older set after delete", []*DecorateChange{decorateDelete("live/a", 2, "a")},
+			[]*DecorateChange{decorateSet("live/a", 3, 1, "b")}, 0, 0, 2},
+		{"batch in order", []*DecorateChange{decorateSet("live/a", 1, 1, "a")},
+			[]*DecorateChange{decorateSet("live/a", 2, 2, "b"), decorateSet("live/a", 3, 3, "b")}, 2, 3, 3},
+		{"batch out of order", []*DecorateChange{decorateSet("live/a", 1, 1, "a")},
+			[]*DecorateChange{decorateSet("live/a", 3, 3, "b"), decorateSet("live/a", 2, 2, "b")}, 1, 3, 3},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			useDecorateState(t, newDecorateState(c.local...))
+
+			if applied := mergeDecorateChanges(c.incoming, "test"); applied != c.applied {
+				t.Errorf("applied %d, want %d", applied, c.applied)
+			}
+			rule := GetDecorateMap("live/a")
+			if c.want == 0 && rule != nil {
+				t.Errorf("rule %+v not deleted", rule)
+			} else if c.want != 0 && (rule == nil || rule.Multiplier != c.want) {
+				t.Errorf("rule %+v, want multiplier %v", rule, c.want)
+			}
+			//规则变化后模式和匹配缓存跟着更新
+			if got := GetDecorate("live/a").Multiplier; c.want != 0 && got != c.want {
+				t.Errorf("decorate of live/a %v, want %v", got, c.want)
+			}
+			if DecorateVersion != c.version {
+				t.Errorf("version %d, want %d", DecorateVersion, c.version)
+			}
+		})
+	}
+}
+
+//两个节点互相拉取后摘要和规则一致，摘要一致时不返回修改
+func TestDecorateDigestReconcile(t *testing.T) {
+	nodeA := newDecorateState(
+		decorateSet("live/a", 1, 1, "a"),
+		decorateDelete("live/b", 3, "a"),
+		decorateSet("live/+", 5, 2, "a"),
+	)
+	nodeB := newDecorateState(
+		decorateSet("live/a", 2, 2, "b"),
+		decorateSet("live/b", 2, 2, "b"),
+		decorateSet("live/c", 4, 1, "b"),
+	)
+	useDecorateState(t, nodeA)
+
+	//pull 从 from 节点拉取修改合并到 to 节点，返回合并后 to 节点的状态
+	pull := func(from, to *decorateState) *decorateState {
+		swapDecorateState(to)
+		decorateLock.RLock()
+		form := &DecoratePullForm{Version: DecorateVersion, Digest: decorateDigest()}
+		decorateLock.RUnlock()
+
+		swapDecorateState(from)
+		data, ret := ServicePullDecorate(form)
+		if !ret.Ok() {
+			t.Fatalf("pull failed, %s", ret)
+		}
+		swapDecorateState(to)
+		if same, _ := data["same"].(bool); !same {
+			mergeDecorateChanges(data["changes"].([]*DecorateChange), "pull")
+		}
+		return swapDecorateState(from)
+	}
+	nodeB = pull(nodeA, nodeB)
+	nodeA = pull(nodeB, nodeA)
+
+	digests := []string{}
+	for _, state := range []*decorateState{nodeA, nodeB} {
+		swapDecorateState(state)
+		decorateLock.RLock()
+		digests = append(digests, decorateDigest())
+		decorateLock.RUnlock()
+
+		for key, want := range map[string]float64{"live/a": 2, "live/b": 0, "live/c": 4, "live/+": 5} {
+			rule := GetDecorateMap(key)
+			if (want == 0) != (rule == nil) || (rule != nil && rule.Multiplier != want) {
+				t.Errorf("rule of %s %+v, want %v", key, rule, want)
+			}
+		}
+		if DecorateVersion != 3 {
+			t.Errorf("version %d, want 3", DecorateVersion)
+		}
+	}
+	if digests[0] != digests[1] {
+		t.Errorf("digests differ after reconcile, %v", digests)
+	}
+
+	data, _ := ServicePullDecorate(&DecoratePullForm{Digest: digests[1]})
+	if same, _ := data["same"].(bool); !same || data["changes"] != nil {
+		t.Errorf("same digest got %v", data)
+	}
+}
@@ -1,7 +1,8 @@
 package main
 
 type OnlineForm struct {
-	Topic string
+	Topic  string
+	Topics []string `json:",omitempty"` //批量查询
 }
 
 type TokenForm struct {
@@ -15,15 +16,21 @@ type TokenForm struct {
 type PublishForm struct {
 	UpstreamId string
 	Topic      string
+	Topics     []string `json:",omitempty"` //同时推送的多个topic，可以是通配符
 	Bridge     bool
 	Msg        string
 	Weight     int //消息权重
 	Online     int64
-	Data       string `json:"-"`
-	Ttl        int    `json:"-"` //生命周期
-	Version    int    `json:"-"`
-	PubTime    int64  `json:"-"`
-	Invoker    string `json:"-"`
+	Origin     string   //消息产生的集群
+	Hops       int      //已经转发的次数
+	Visited    []string //已经经过的集群
+	Data       string   `json:"-"`
+	Ttl        int      //生命周期(秒)，不指定则按权重取默认值
+	Version    int      `json:"-"`
+	PubTime    int64    `json:"-"`
+	Invoker    string   `json:"-"`
+
+	seq uint64 //推送队列中的入队序号
 }
 
 type PublishData struct {
@@ -32,3 +39,15 @@ type PublishData struct {
 	Total     int    `json:"total"`
 	Datas     string `json:"datas"`
 }
+
+//后台修改修饰规则，Rule 可以是数字或对象
+type DecorateForm struct {
+	Key  string
+	Rule *DecorateRule
+}
+
+//批量导入修饰规则
+type DecorateImportForm struct {
+	Rules   map[string]*DecorateRule
+	Replace bool //删除导入数据中没有的规则
+}
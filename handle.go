@@ -2,6 +2,7 @@ package main
 
 import (
 	"io/ioutil"
+	"net/http"
 	"strconv"
 	"strings"
 
@@ -93,6 +94,18 @@ func DoneCollectLocalOnline(ctx *web.Context) string {
 		return jsonpWrap(ctx, NewError(INVALID_PARAM, nil, "invalid params").Json())
 	}
 
+	//批量
+	if len(form.Topics) > 0 {
+		data, ret := ServiceGetLocalOnlineBatch(form.Topics)
+		if !ret.Ok() {
+			log.Error("collect <%d> topics local online count failed, %s", len(form.Topics), ret)
+		} else {
+			log.Info("collect <%d> topics local online count success", len(form.Topics))
+			ret.Data = data
+		}
+		return jsonpWrap(ctx, ret.Json())
+	}
+
 	topic := form.Topic
 	data, ret := ServiceGetLocalOnline(topic)
 
@@ -105,6 +118,36 @@ func DoneCollectLocalOnline(ctx *web.Context) string {
 	return jsonpWrap(ctx, ret.Json())
 }
 
+/**
+*推模式下，其它节点推送过来的本地在线人数快照
+ */
+func DonePushOnline(ctx *web.Context) string {
+	log.Debug("--->push online snapshot")
+
+	ctx.SetHeader("Content-Type", "application/json; charset=UTF-8", true)
+
+	body, _, ret := verifySignedBody(ctx)
+	if !ret.Ok() {
+		return ret.Json()
+	}
+	snapshot := &OnlineSnapshot{}
+	err := json.Unmarshal(body, snapshot)
+	if err != nil {
+		return NewError(INVALID_PARAM, nil, "invalid params").Json()
+	}
+
+	wants, ret := ServicePushOnline(snapshot)
+	if !ret.Ok() {
+		log.Error("push online snapshot from<%s> failed, %s", snapshot.Node, ret)
+	} else {
+		log.Debug("push online snapshot from<%s> success, seq: %d", snapshot.Node, snapshot.Seq)
+		ret.Data = Dict{
+			"wants": wants,
+		}
+	}
+	return ret.Json()
+}
+
 /**
 *分布式部署在线人数要分开统计， 这是一个对外接口，返回所有中心的在线数据
  */
@@ -127,52 +170,190 @@ func DoneGetOnline(ctx *web.Context) string {
 
 }
 
-func gainPublishForm(ctx *web.Context) (*PublishForm, Error) {
+//校验请求签名，返回请求体和调用方
+func verifySignedBody(ctx *web.Context) ([]byte, string, Error) {
 	invoker := ctx.Request.Header.Get(configOpt.requestInvokerKey)
 	sig := ctx.Request.Header.Get(configOpt.requestSignKey)
 	if len(invoker) == 0 || len(sig) == 0 {
 		log.Error("invalid request header")
-		return nil, NewError(INVALID_PARAM, nil, "invalid request header")
+		return nil, "", NewError(INVALID_PARAM, nil, "invalid request header")
 	}
 
-	dict, ok := configOpt.invokerMap[invoker].(map[string]interface{})
-	if !ok {
-		log.Error("invalid invoker:%s", invoker)
-		return nil, NewError(INVALID_PARAM, nil, "invalid voker")
-	}
-	key, ok := dict["key"].(string)
+	key, ok := getInvokerKey(invoker)
 	if !ok {
 		log.Error("invalid invoker:%s", invoker)
-		return nil, NewError(INVALID_PARAM, nil, "invalid voker")
+		return nil, "", NewError(INVALID_PARAM, nil, "invalid voker")
 	}
 
-	form := &PublishForm{}
 	body, err := ioutil.ReadAll(ctx.Request.Body)
 	if err != nil {
 		log.Error("read params body faild, %s", err)
-		return nil, NewError(INVALID_PARAM, nil, "invalid params")
-	}
-	err = json.Unmarshal(body, form)
-	if err != nil {
-		log.Error("parse params to json faild, %s", err)
-		return nil, NewError(INVALID_PARAM, nil, "invalid params format")
+		return nil, "", NewError(INVALID_PARAM, nil, "invalid params")
 	}
 	rightSig := Md5Sig(string(body), invoker, key)
 	if strings.ToLower(sig) != strings.ToLower(rightSig) {
 		log.Error("invalid sig<%s> right is <%s>", sig, rightSig)
-		return nil, NewError(INVALID_PARAM, nil, "invalid sign")
+		return nil, "", NewError(INVALID_PARAM, nil, "invalid sign")
+	}
+	return body, invoker, OK
+}
+
+/**
+*批量获取多个topic的在线人数，对外接口
+*GET topics=a,b,c 或 POST {"Topics": ["a", "b", "c"]}
+ */
+func DoneGetOnlineBatch(ctx *web.Context) string {
+	log.Debug("--->get batch online count")
+
+	ctx.SetHeader("Content-Type", "application/json; charset=UTF-8", true)
+
+	topics := []string{}
+	if ctx.Request.Method == "POST" {
+		form := &OnlineForm{}
+		body, err := ioutil.ReadAll(ctx.Request.Body)
+		if err != nil {
+			return jsonpWrap(ctx, NewError(INVALID_PARAM, nil, "invalid params").Json())
+		}
+		err = json.Unmarshal(body, form)
+		if err != nil {
+			return jsonpWrap(ctx, NewError(INVALID_PARAM, nil, "invalid params").Json())
+		}
+		topics = form.Topics
+	} else {
+		for _, v := range strings.Split(ctx.Params["topics"], ",") {
+			v = strings.Trim(v, " ")
+			if len(v) > 0 {
+				topics = append(topics, v)
+			}
+		}
+	}
+
+	data, ret := ServiceGetOnlineBatch(topics)
+	if !ret.Ok() {
+		log.Error("get <%d> topics online count failed, %s", len(topics), ret)
+	} else {
+		log.Info("get <%d> topics online count success", len(topics))
+		ret.Data = data
+	}
+	return jsonpWrap(ctx, ret.Json())
+}
+
+//订阅在线人数变化(SSE)，连接一直保持到客户端断开
+func DoneOnlineStream(ctx *web.Context) {
+	log.Debug("--->online stream")
+
+	topics := []string{}
+	for _, v := range strings.Split(ctx.Params["topics"], ",") {
+		v = strings.Trim(v, " ")
+		if len(v) > 0 {
+			topics = append(topics, v)
+		}
+	}
+
+	flusher, ok := ctx.ResponseWriter.(http.Flusher)
+	if !ok {
+		log.Error("online stream not supported")
+		ctx.SetHeader("Content-Type", "application/json; charset=UTF-8", true)
+		ctx.WriteString(NewError(INVALID_PARAM, nil, "stream not supported").Json())
+		return
+	}
+
+	stream, ret := SubscribeOnlineStream(topics)
+	if !ret.Ok() {
+		log.Error("subscribe <%d> topics online stream failed, %s", len(topics), ret)
+		ctx.SetHeader("Content-Type", "application/json; charset=UTF-8", true)
+		ctx.WriteString(ret.Json())
+		return
+	}
+	defer onlineStreamHub.Remove(stream)
+
+	log.Info("<%s> subscribe <%d> topics online stream", getPerAddress(ctx), len(topics))
+	ctx.SetHeader("Content-Type", "text/event-stream; charset=UTF-8", true)
+	ctx.SetHeader("Cache-Control", "no-cache", true)
+	//nginx 不缓冲
+	ctx.SetHeader("X-Accel-Buffering", "no", true)
+	stream.Serve(ctx.ResponseWriter, flusher, ctx.Request.Context().Done())
+	log.Info("<%s> online stream closed", getPerAddress(ctx))
+}
+
+//订阅topic的消息，websocket 或长轮询
+func DoneSubscribe(ctx *web.Context) {
+	log.Debug("--->subscribe")
+
+	topic := ctx.Params["topic"]
+	if origin := ctx.Request.Header.Get("Origin"); !SubscribeOriginAllowed(origin) {
+		log.Error("subscribe topic<%s> from origin<%s> denied", topic, origin)
+		ctx.SetHeader("Content-Type", "application/json; charset=UTF-8", true)
+		ctx.WriteString(NewError(NO_PERM, nil, "origin not allowed").Json())
+		return
+	}
+	if !IsWebsocketRequest(ctx.Request) {
+		//不支持jsonp: <script> 请求不带 Origin，会绕过检查；跨域只对允许的 Origin 返回CORS头
+		if origin := ctx.Request.Header.Get("Origin"); len(origin) > 0 {
+			ctx.SetHeader("Access-Control-Allow-Origin", origin, true)
+			ctx.SetHeader("Vary", "Origin", true)
+		}
+		ctx.SetHeader("Content-Type", "application/json; charset=UTF-8", true)
+		ctx.SetHeader("Cache-Control", "no-cache", true)
+		data, ret := ServiceSubscribePoll(topic, ctx.Params["session"])
+		if !ret.Ok() {
+			log.Error("poll topic<%s> failed, %s", topic, ret)
+		} else {
+			ret.Data = data
+		}
+		ctx.WriteString(ret.Json())
+		return
+	}
+
+	sub, ret := subscribeHub.Subscribe(topic, false)
+	if !ret.Ok() {
+		log.Error("subscribe topic<%s> failed, %s", topic, ret)
+		ctx.SetHeader("Content-Type", "application/json; charset=UTF-8", true)
+		ctx.WriteString(ret.Json())
+		return
+	}
+	defer subscribeHub.Unsubscribe(sub, "")
+
+	conn, err := UpgradeWebsocket(ctx.ResponseWriter, ctx.Request)
+	if err != nil {
+		log.Error("upgrade websocket of topic<%s> failed, %v", topic, err)
+		ctx.SetHeader("Content-Type", "application/json; charset=UTF-8", true)
+		ctx.WriteString(NewError(INVALID_PARAM, err, "invalid websocket request").Json())
+		return
+	}
+	log.Info("<%s> subscribe topic<%s> by websocket", getPerAddress(ctx), topic)
+	ServeSubscribeWebsocket(conn, sub)
+	log.Info("<%s> websocket of topic<%s> closed", getPerAddress(ctx), topic)
+}
+
+func gainPublishForm(ctx *web.Context) (*PublishForm, Error) {
+	body, invoker, ret := verifySignedBody(ctx)
+	if !ret.Ok() {
+		return nil, ret
+	}
+
+	form := &PublishForm{}
+	err := json.Unmarshal(body, form)
+	if err != nil {
+		log.Error("parse params to json faild, %s", err)
+		return nil, NewError(INVALID_PARAM, nil, "invalid params format")
 	}
 	form.Invoker = invoker
 
+	normalizePublishForm(form)
+	return form, OK
+}
+
+//限定消息的权重和生命周期
+func normalizePublishForm(form *PublishForm) {
 	if form.Weight > configOpt.publishMaxWeight {
 		form.Weight = configOpt.publishMaxWeight
 	} else if form.Weight < 1 {
 		form.Weight = 1
 	}
-	form.Ttl = form.Weight
+	form.Ttl = GainPublishTtl(form.Weight, form.Ttl)
 
 	form.Version = 1
-	return form, OK
 }
 
 //来自集群内广播的消息(集群内广播)
@@ -230,61 +411,260 @@ func DonePublish(ctx *web.Context) string {
 		return ret.Json()
 	}
 
-	ret = ServicePublish(form)
+	data, ret := ServicePublish(form)
 
 	if !ret.Ok() {
 		log.Error("publish<%+v> failed, %s", form, ret)
 	} else {
-		log.Info("publish<%+v> success", form)
+		log.Info("publish<%+v> success, %+v", form, data)
+		ret.Data = data
 	}
 	return ret.Json()
 }
 
-func haveBackendParam(ctx *web.Context) bool {
-	backend, ok := ctx.Params["backend"]
-	if !ok || len(backend) == 0 {
-		return false
+//prefix 按key前缀过滤，offset/limit 分页，不指定返回全部
+func DoneGetDecorate(ctx *web.Context) string {
+	log.Debug("---->get decorate")
+	ctx.SetHeader("Content-Type", "application/json; charset=UTF-8", true)
+
+	if _, ret := checkBackend(ctx, BACKEND_ROLE_READONLY); !ret.Ok() {
+		return ret.Json()
+	}
+
+	offset, err := strconv.Atoi(ctx.Params["offset"])
+	if err != nil {
+		offset = 0
+	}
+	limit, err := strconv.Atoi(ctx.Params["limit"])
+	if err != nil {
+		limit = 0
 	}
-	return backend == configOpt.backendPasswd
+
+	data, ret := ServiceListDecorate(ctx.Params["prefix"], offset, limit)
+	if !ret.Ok() {
+		log.Error("list decorate failed, %s", ret)
+	} else {
+		ret.Data = data
+	}
+	return ret.Json()
 }
 
-func DoneGetDecorate(ctx *web.Context) string {
-	log.Debug("---->get decorate")
+//是否是json格式的请求体
+func isJsonBody(ctx *web.Context) bool {
+	return strings.HasPrefix(ctx.Request.Header.Get("Content-Type"), "application/json")
+}
+
+/**
+*设置修饰规则
+*POST json {"Key": "live/+", "Rule": {...}}
+*或者兼容老的参数形式 key=xx&val=数字或json
+ */
+func DoneSetDecorate(ctx *web.Context) string {
+	log.Debug("---->set decorate")
 	ctx.SetHeader("Content-Type", "application/json; charset=UTF-8", true)
 
-	if !haveBackendParam(ctx) {
-		return NewError(NO_PERM, nil, "no perm").Json()
+	operator, ret := checkBackend(ctx, BACKEND_ROLE_ADMIN)
+	if !ret.Ok() {
+		return ret.Json()
+	}
+
+	form := &DecorateForm{}
+	if isJsonBody(ctx) {
+		body, err := ioutil.ReadAll(ctx.Request.Body)
+		if err != nil {
+			return NewError(INVALID_PARAM, nil, "invalid params").Json()
+		}
+		if err := json.Unmarshal(body, form); err != nil {
+			return NewError(INVALID_PARAM, err, "invalid params").Json()
+		}
+	} else {
+		form.Key = ctx.Params["key"]
+		//val 可以是数字，也可以是json格式的规则
+		form.Rule = &DecorateRule{}
+		if err := json.Unmarshal([]byte(ctx.Params["val"]), form.Rule); err != nil {
+			return NewError(INVALID_PARAM, nil, "invalid params").Json()
+		}
+	}
+
+	data, ret := ServiceSetDecorate(form.Key, form.Rule, operator)
+	if !ret.Ok() {
+		log.Error("set decorate <%s> failed, %s", form.Key, ret)
+	} else {
+		log.Info("set decorate <%s> to %+v, version: %v", form.Key, form.Rule, data["version"])
+		ret.Data = data
 	}
+	return ret.Json()
+}
 
+/**
+*删除修饰规则
+*DELETE json {"Key": "live/+"} 或者参数 key=xx
+ */
+func DoneDeleteDecorate(ctx *web.Context) string {
+	log.Debug("---->delete decorate")
+	ctx.SetHeader("Content-Type", "application/json; charset=UTF-8", true)
+
+	operator, ret := checkBackend(ctx, BACKEND_ROLE_ADMIN)
+	if !ret.Ok() {
+		return ret.Json()
+	}
+
+	form := &DecorateForm{}
+	if isJsonBody(ctx) {
+		body, err := ioutil.ReadAll(ctx.Request.Body)
+		if err != nil {
+			return NewError(INVALID_PARAM, nil, "invalid params").Json()
+		}
+		if err := json.Unmarshal(body, form); err != nil {
+			return NewError(INVALID_PARAM, err, "invalid params").Json()
+		}
+	} else {
+		form.Key = ctx.Params["key"]
+	}
+
+	data, ret := ServiceDeleteDecorate(form.Key, operator)
+	if !ret.Ok() {
+		log.Error("delete decorate <%s> failed, %s", form.Key, ret)
+	} else {
+		log.Info("delete decorate <%s>, version: %v", form.Key, data["version"])
+		ret.Data = data
+	}
+	return ret.Json()
+}
+
+/**
+*导出修饰规则，format=csv 导出csv，否则导出json
+ */
+func DoneExportDecorate(ctx *web.Context) string {
+	log.Debug("---->export decorate")
+
+	if _, ret := checkBackend(ctx, BACKEND_ROLE_READONLY); !ret.Ok() {
+		ctx.SetHeader("Content-Type", "application/json; charset=UTF-8", true)
+		return ret.Json()
+	}
+
+	if ctx.Params["format"] == "csv" {
+		ctx.SetHeader("Content-Type", "text/csv; charset=UTF-8", true)
+		ctx.SetHeader("Content-Disposition", "attachment; filename=decorate.csv", true)
+		return ExportDecorateCsv()
+	}
+
+	ctx.SetHeader("Content-Type", "application/json; charset=UTF-8", true)
 	ret := OK
 	ret.Data = Dict{
-		"map": DecorateMap,
+		"Rules":   GetAllDecorate(),
+		"version": GetDecorateVersion(),
 	}
 	return ret.Json()
 }
 
-func DoneSetDecorate(ctx *web.Context) string {
-	log.Debug("---->set decorate")
+/**
+*批量导入修饰规则
+*json {"Rules": {"key": 规则}, "Replace": false}
+*或者 format=csv 请求体为导出的csv，replace=1 删除导入数据中没有的规则
+ */
+func DoneImportDecorate(ctx *web.Context) string {
+	log.Debug("---->import decorate")
 	ctx.SetHeader("Content-Type", "application/json; charset=UTF-8", true)
 
-	if !haveBackendParam(ctx) {
-		return NewError(NO_PERM, nil, "no perm").Json()
+	operator, ret := checkBackend(ctx, BACKEND_ROLE_ADMIN)
+	if !ret.Ok() {
+		return ret.Json()
 	}
 
-	key, ok := ctx.Params["key"]
-	if !ok {
+	body, err := ioutil.ReadAll(ctx.Request.Body)
+	if err != nil {
+		return NewError(INVALID_PARAM, nil, "invalid params").Json()
+	}
+
+	form := &DecorateImportForm{}
+	if ctx.Params["format"] == "csv" {
+		rules, ret := ParseDecorateCsv(body)
+		if !ret.Ok() {
+			return ret.Json()
+		}
+		form.Rules = rules
+		form.Replace = ctx.Params["replace"] == "1"
+	} else if err := json.Unmarshal(body, form); err != nil {
+		return NewError(INVALID_PARAM, err, "invalid params").Json()
+	}
+
+	data, ret := ServiceImportDecorate(form.Rules, form.Replace, operator)
+	if !ret.Ok() {
+		log.Error("import decorate failed, %s", ret)
+	} else {
+		log.Info("import decorate success, %+v", data)
+		ret.Data = data
+	}
+	return ret.Json()
+}
+
+/**
+*集群内其它节点同步过来的修饰规则修改
+ */
+func DoneSyncDecorate(ctx *web.Context) string {
+	log.Debug("---->sync decorate")
+	ctx.SetHeader("Content-Type", "application/json; charset=UTF-8", true)
+
+	body, invoker, ret := verifySignedBody(ctx)
+	if !ret.Ok() {
+		return ret.Json()
+	}
+	if invoker != configOpt.relayInvoker {
+		log.Error("invoker<%s> can't sync decorate", invoker)
+		return NewError(NO_PERM, nil, "no perm").Json()
+	}
+	form := &DecorateSyncForm{}
+	err := json.Unmarshal(body, form)
+	if err != nil {
 		return NewError(INVALID_PARAM, nil, "invalid params").Json()
 	}
+	//只有一个修改时请求就是 DecorateChange
+	if len(form.Changes) == 0 {
+		change := &DecorateChange{}
+		json.Unmarshal(body, change)
+		form.Changes = []*DecorateChange{change}
+	}
+
+	applied, ret := ServiceSyncDecorate(form.Changes)
+	if !ret.Ok() {
+		log.Error("sync %d decorate changes failed, %s", len(form.Changes), ret)
+	} else {
+		log.Info("sync %d decorate changes version %d from<%s>, applied: %d",
+			len(form.Changes), form.Changes[0].Version, form.Changes[0].Node, applied)
+		ret.Data = Dict{
+			"applied": applied,
+			"version": GetDecorateVersion(),
+		}
+	}
+	return ret.Json()
+}
+
+/**
+*集群内其它节点对账，摘要不一致时返回本节点的所有修饰规则修改
+ */
+func DonePullDecorate(ctx *web.Context) string {
+	log.Debug("---->pull decorate")
+	ctx.SetHeader("Content-Type", "application/json; charset=UTF-8", true)
 
-	val, err := strconv.ParseFloat(ctx.Params["val"], 64)
+	body, invoker, ret := verifySignedBody(ctx)
+	if !ret.Ok() {
+		return ret.Json()
+	}
+	if invoker != configOpt.relayInvoker {
+		log.Error("invoker<%s> can't pull decorate", invoker)
+		return NewError(NO_PERM, nil, "no perm").Json()
+	}
+	form := &DecoratePullForm{}
+	err := json.Unmarshal(body, form)
 	if err != nil {
 		return NewError(INVALID_PARAM, nil, "invalid params").Json()
 	}
 
-	PutDecorateMap(key, val)
-	ret := OK
-	ret.Data = Dict{
-		"map": DecorateMap,
+	data, ret := ServicePullDecorate(form)
+	if ret.Ok() {
+		log.Debug("pull decorate, remote version %d, same: %v", form.Version, data["same"])
+		ret.Data = data
 	}
 	return ret.Json()
 }
@@ -295,13 +675,15 @@ func DoneGetPureOnline(ctx *web.Context) string {
 
 	ctx.SetHeader("Content-Type", "application/json; charset=UTF-8", true)
 
-	if !haveBackendParam(ctx) {
-		return NewError(NO_PERM, nil, "no perm").Json()
+	if _, ret := checkBackend(ctx, BACKEND_ROLE_READONLY); !ret.Ok() {
+		return ret.Json()
 	}
 
 	topic := ctx.Params["topic"]
+	//detail=1 时返回各broker、各对端的明细
+	breakdown := ctx.Params["detail"] == "1"
 
-	data, ret := ServiceGetPureOnline(topic)
+	data, ret := ServiceGetPureOnline(topic, breakdown)
 
 	if !ret.Ok() {
 		log.Error("get topic<%s> online count failed, %s", topic, ret)
@@ -319,8 +701,8 @@ func DoneGetAllPureOnline(ctx *web.Context) string {
 
 	ctx.SetHeader("Content-Type", "application/json; charset=UTF-8", true)
 
-	if !haveBackendParam(ctx) {
-		return NewError(NO_PERM, nil, "no perm").Json()
+	if _, ret := checkBackend(ctx, BACKEND_ROLE_READONLY); !ret.Ok() {
+		return ret.Json()
 	}
 	showlen, err := strconv.Atoi(ctx.Params["len"])
 	if err != nil {
@@ -342,3 +724,160 @@ func DoneGetAllPureOnline(ctx *web.Context) string {
 	}
 	return ret.Json()
 }
+
+//历史查询的时间范围，默认最近一小时
+func gainHistoryRange(ctx *web.Context) (int64, int64) {
+	to, err := strconv.ParseInt(ctx.Params["to"], 10, 64)
+	if err != nil || to <= 0 {
+		to = Gtimer.Unix
+	}
+	from, err := strconv.ParseInt(ctx.Params["from"], 10, 64)
+	if err != nil || from <= 0 {
+		window, err := strconv.ParseInt(ctx.Params["window"], 10, 64)
+		if err != nil || window <= 0 {
+			window = 3600
+		}
+		from = to - window
+	}
+	return from, to
+}
+
+//获取topic的在线人数历史
+func DoneGetOnlineHistory(ctx *web.Context) string {
+	log.Debug("--->get online history")
+
+	ctx.SetHeader("Content-Type", "application/json; charset=UTF-8", true)
+
+	if _, ret := checkBackend(ctx, BACKEND_ROLE_READONLY); !ret.Ok() {
+		return ret.Json()
+	}
+
+	topic := ctx.Params["topic"]
+	from, to := gainHistoryRange(ctx)
+
+	data, ret := ServiceGetOnlineHistory(topic, from, to)
+	if !ret.Ok() {
+		log.Error("get topic<%s> online history failed, %s", topic, ret)
+	} else {
+		log.Info("get topic<%s> online history success", topic)
+		ret.Data = data
+	}
+	return ret.Json()
+}
+
+//获取topic的在线人数峰值、平均值
+func DoneGetOnlinePeak(ctx *web.Context) string {
+	log.Debug("--->get online peak")
+
+	ctx.SetHeader("Content-Type", "application/json; charset=UTF-8", true)
+
+	if _, ret := checkBackend(ctx, BACKEND_ROLE_READONLY); !ret.Ok() {
+		return ret.Json()
+	}
+
+	topic := ctx.Params["topic"]
+	from, to := gainHistoryRange(ctx)
+
+	data, ret := ServiceGetOnlinePeak(topic, from, to)
+	if !ret.Ok() {
+		log.Error("get topic<%s> online peak failed, %s", topic, ret)
+	} else {
+		log.Info("get topic<%s> online peak success, %+v", topic, data)
+		ret.Data = data
+	}
+	return ret.Json()
+}
+
+//获取峰值最高的topic
+func DoneGetOnlineTop(ctx *web.Context) string {
+	log.Debug("--->get online top")
+
+	ctx.SetHeader("Content-Type", "application/json; charset=UTF-8", true)
+
+	if _, ret := checkBackend(ctx, BACKEND_ROLE_READONLY); !ret.Ok() {
+		return ret.Json()
+	}
+
+	showlen, err := strconv.Atoi(ctx.Params["len"])
+	if err != nil {
+		showlen = 0
+	}
+	from, to := gainHistoryRange(ctx)
+
+	data, ret := ServiceGetOnlineTop(from, to, showlen)
+	if !ret.Ok() {
+		log.Error("get online top failed, %s", ret)
+	} else {
+		log.Info("get online top success")
+		ret.Data = data
+	}
+	return ret.Json()
+}
+
+//获取broker、对端的健康状态
+func DoneGetHealth(ctx *web.Context) string {
+	log.Debug("--->get health")
+
+	ctx.SetHeader("Content-Type", "application/json; charset=UTF-8", true)
+
+	if _, ret := checkBackend(ctx, BACKEND_ROLE_READONLY); !ret.Ok() {
+		return ret.Json()
+	}
+
+	ret := OK
+	ret.Data = Dict{
+		"time":      Gtimer.Unix,
+		"brokers":   brokerPool.Stats(),
+		"peers":     GetPeerStats(),
+		"links":     GetPeerLinkStats(),
+		"snapshots": GetOnlineSnapshotStats(),
+		"cache": Dict{
+			"total": onlineCache.Total.Len(),
+			"local": onlineCache.Local.Len(),
+		},
+		"streams":   onlineStreamHub.Len(),
+		"subscribe": subscribeHub.Stats(),
+		"topics":    topicRegistry.Len(),
+	}
+	return ret.Json()
+}
+
+//获取各权重队列的推送统计
+func DoneGetPublishStat(ctx *web.Context) string {
+	log.Debug("--->get publish stat")
+
+	ctx.SetHeader("Content-Type", "application/json; charset=UTF-8", true)
+
+	if _, ret := checkBackend(ctx, BACKEND_ROLE_READONLY); !ret.Ok() {
+		return ret.Json()
+	}
+
+	ret := OK
+	ret.Data = Dict{
+		"schedule": publishScheduler.Name(),
+		"weights":  GetPublishStats(),
+		"throttle": GetThrottleStats(),
+		"forward":  GetLoopStats(),
+		"peers":    GetPeerStats(),
+	}
+	return ret.Json()
+}
+
+//获取推模式下各节点的在线人数快照状态
+func DoneGetOnlineSnapshot(ctx *web.Context) string {
+	log.Debug("--->get online snapshot")
+
+	ctx.SetHeader("Content-Type", "application/json; charset=UTF-8", true)
+
+	if _, ret := checkBackend(ctx, BACKEND_ROLE_READONLY); !ret.Ok() {
+		return ret.Json()
+	}
+
+	ret := OK
+	ret.Data = Dict{
+		"aggregate": configOpt.onlineAggregate,
+		"node":      OnlineNodeId,
+		"snapshots": GetOnlineSnapshotStats(),
+	}
+	return ret.Json()
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/yjp211/web"
+	"provider/client"
+)
+
+const (
+	testProviderInvoker = "mqtt-bench"
+	testProviderKey     = "123@.root"
+)
+
+//按web框架的方式调用handler: 参数取第一个值，返回值写入响应
+func serveWebHandler(handler func(*web.Context) string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		params := map[string]string{}
+		for k, v := range req.Form {
+			params[k] = v[0]
+		}
+		io.WriteString(w, handler(&web.Context{Request: req, Params: params, ResponseWriter: w}))
+	}
+}
+
+//用测试配置启动provider的对外接口，在线人数用测试缓存，不连接broker
+func startTestProvider(t *testing.T) *httptest.Server {
+	config := Config{}
+	if err := ParseConfig("build/conf/test/provider.conf", &config); err != nil {
+		t.Fatalf("parse config failed, %v", err)
+	}
+	saved := configOpt
+	savedOperators := backendOperators
+	t.Cleanup(func() {
+		configOpt = saved
+		backendOperators = savedOperators
+	})
+	configOpt = config
+	configOpt.backendAuditLog = ""
+	configOpt.decorateAuditLog = ""
+	configOpt.decorateStore = ""
+
+	SetMaxPublishCount(configOpt.publishMaxCount)
+	SetPublishQueue(configOpt.publishQueueCapacity, configOpt.publishQueueOverflow)
+	SetMaxPublishQps(configOpt.publishMaxQps)
+	SetMaxPublishWeight(configOpt.publishMaxWeight)
+	SetMaxPublishTtl(configOpt.publishMaxTtl)
+	InitPublishTtlMap(configOpt.ttlMap)
+	InitTopicLimitMap(configOpt.limitMap)
+	SetDedupWindow(configOpt.publishDedupWindow)
+	SetPublishScheduler(configOpt.publishSchedule, configOpt.publishDrrQuantum)
+	WeightQueueMap = map[int]*Queue{}
+	for i := 0; i <= MaxPublishWeight; i++ {
+		WeightQueueMap[i] = &Queue{}
+	}
+	InitBackendOperators(map[string]interface{}{
+		"ops-admin":  map[string]interface{}{"key": "admin-key", "role": BACKEND_ROLE_ADMIN},
+		"ops-viewer": map[string]interface{}{"token": "viewer-token"},
+	})
+	useTestOnlineCache(t)
+	useTestDecorate(t, map[string]interface{}{"default": 1.0, "live/fixed": -500.0})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(configOpt.urlPublish, serveWebHandler(DonePublish))
+	mux.HandleFunc(configOpt.urlOnline, serveWebHandler(DoneGetOnline))
+	getDecorate := serveWebHandler(DoneGetDecorate)
+	setDecorate := serveWebHandler(DoneSetDecorate)
+	mux.HandleFunc(client.DefaultUrlBackendDecorate, func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == "POST" {
+			setDecorate(w, req)
+		} else {
+			getDecorate(w, req)
+		}
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func newTestProviderClient(server *httptest.Server) *client.Client {
+	c := client.NewClient(strings.TrimPrefix(server.URL, "http://"), testProviderInvoker, testProviderKey)
+	c.Retry = 0
+	return c
+}
+
+//客户端的签名、参数和结果解析与provider的handler一致
+func TestClientAgainstHandlers(t *testing.T) {
+	server := startTestProvider(t)
+	c := newTestProviderClient(server)
+
+	id, err := c.Publish("live/room", "hello", client.WithWeight(3))
+	if err != nil || len(id) == 0 {
+		t.Fatalf("publish failed, id %s, %v", id, err)
+	}
+	result, err := c.PublishTopics([]string{"live/a", "live/b"}, "hello")
+	if err != nil || result.Topics != 2 || len(result.Dropped) != 0 {
+		t.Fatalf("publish topics got %+v, %v", result, err)
+	}
+	if lens := publishQueue.Lens(); lens[3] != 1 || lens[1] != 2 {
+		t.Errorf("publish queue lens %v", lens)
+	}
+
+	for topic, want := range map[string]int64{"live/ab": 7, "live/fixed": 500} {
+		if online, err := c.GetOnline(topic); err != nil || online != want {
+			t.Errorf("online of %s: %d, %v, want %d", topic, online, err, want)
+		}
+	}
+
+	c.Key = "wrong-key"
+	if _, err := c.Publish("live/room", "hello"); !client.IsInvalidParam(err) {
+		t.Errorf("publish with wrong key got %v", err)
+	}
+}
+
+//后台接口: token 只读，签名的管理员可以修改
+func TestClientBackendAuth(t *testing.T) {
+	server := startTestProvider(t)
+
+	viewer := newTestProviderClient(server)
+	viewer.BackendToken = "viewer-token"
+	list, err := viewer.ListDecorate("live/", 0, 10)
+	if err != nil || len(list.List) != 1 {
+		t.Fatalf("list decorate got %+v, %v", list, err)
+	}
+	if _, err := viewer.SetDecorate("live/ab", 2); !client.IsNoPerm(err) {
+		t.Errorf("viewer set decorate got %v", err)
+	}
+
+	admin := newTestProviderClient(server)
+	admin.BackendOperator = "ops-admin"
+	admin.BackendKey = "admin-key"
+	if _, err := admin.SetDecorate("live/ab", 2); err != nil {
+		t.Fatalf("admin set decorate failed, %v", err)
+	}
+	if online, err := admin.GetOnline("live/ab"); err != nil || online != 14 {
+		t.Errorf("decorated online %d, %v, want 14", online, err)
+	}
+
+	admin.BackendKey = "wrong-key"
+	if _, err := admin.GetDecorate(); !client.IsNoPerm(err) {
+		t.Errorf("wrong key got %v", err)
+	}
+}
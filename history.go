@@ -0,0 +1,195 @@
+package main
+
+/**
+ * 在线人数历史
+ * 1、每隔 OnlineHistoryInterval 秒对缓存中的topic采样一次总在线人数(不加权)
+ *    采样时批量刷新过期的topic，没人查询的topic也按采样周期更新
+ * 2、每个topic一个环形缓冲区，最多保存 OnlineHistorySize 个采样点，随采样逐步增长
+ * 3、不再活跃(不在缓存中)的topic，采样点全部过期后删除
+ */
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	onlineHistory = &OnlineHistory{
+		topics: map[string]*OnlineRing{},
+	}
+)
+
+type OnlineSample struct {
+	Time   int64
+	Online int64
+}
+
+//环形缓冲区，没满时追加，满了覆盖最旧的采样点
+//topic很多而采样点很少时不预先分配整个缓冲区
+type OnlineRing struct {
+	samples []OnlineSample
+	size    int
+	next    int //满了以后下一个覆盖的位置，也就是最旧的采样点
+}
+
+func NewOnlineRing(size int) *OnlineRing {
+	return &OnlineRing{
+		size: size,
+	}
+}
+
+func (p *OnlineRing) Add(sample OnlineSample) {
+	if len(p.samples) < p.size {
+		p.samples = append(p.samples, sample)
+		return
+	}
+	p.samples[p.next] = sample
+	p.next = (p.next + 1) % p.size
+}
+
+//按时间顺序返回[from, to]之间的采样点
+func (p *OnlineRing) Range(from, to int64) []OnlineSample {
+	result := []OnlineSample{}
+	for i := 0; i < len(p.samples); i++ {
+		sample := p.samples[(p.next+i)%len(p.samples)]
+		if sample.Time >= from && sample.Time <= to {
+			result = append(result, sample)
+		}
+	}
+	return result
+}
+
+//最新的采样时间
+func (p *OnlineRing) Last() int64 {
+	if len(p.samples) == 0 {
+		return 0
+	}
+	return p.samples[(p.next+len(p.samples)-1)%len(p.samples)].Time
+}
+
+type OnlineHistory struct {
+	topics   map[string]*OnlineRing
+	size     int
+	interval int
+	lock     sync.RWMutex
+}
+
+func onlineHistoryInterval() int {
+	if configOpt.onlineHistoryInterval > 0 {
+		return configOpt.onlineHistoryInterval
+	}
+	return 60
+}
+
+func StartOnlineHistory() {
+	if configOpt.onlineHistoryInterval < 0 {
+		log.Info("online history disabled")
+		return
+	}
+	onlineHistory.interval = onlineHistoryInterval()
+	onlineHistory.size = configOpt.onlineHistorySize
+	if onlineHistory.size <= 0 {
+		onlineHistory.size = 1440
+	}
+
+	go func() {
+		for {
+			<-time.After(time.Second * time.Duration(onlineHistory.interval))
+			onlineHistory.sample(Gtimer.Unix)
+		}
+	}()
+}
+
+func (p *OnlineHistory) sample(now int64) {
+	topics := []string{}
+	for topic := range onlineCache.GetAllTotalOnline(false) {
+		topics = append(topics, topic)
+	}
+	onlines := onlineCache.GetTotalOnlineBatch(topics)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for topic, online := range onlines {
+		ring, ok := p.topics[topic]
+		if !ok {
+			ring = NewOnlineRing(p.size)
+			p.topics[topic] = ring
+		}
+		ring.Add(OnlineSample{Time: now, Online: online})
+	}
+
+	//整个缓冲区时长内都没有采样的topic删除
+	expire := now - int64(p.size*p.interval)
+	for topic, ring := range p.topics {
+		if ring.Last() < expire {
+			delete(p.topics, topic)
+		}
+	}
+}
+
+func (p *OnlineHistory) Series(topic string, from, to int64) []OnlineSample {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	ring, ok := p.topics[topic]
+	if !ok {
+		return []OnlineSample{}
+	}
+	return ring.Range(from, to)
+}
+
+type OnlinePeak struct {
+	Topic    string
+	Peak     int64
+	PeakTime int64
+	Average  int64
+	Samples  int
+}
+
+type OnlinePeakList []*OnlinePeak
+
+func (p OnlinePeakList) Len() int           { return len(p) }
+func (p OnlinePeakList) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p OnlinePeakList) Less(i, j int) bool { return p[i].Peak < p[j].Peak }
+
+func gainOnlinePeak(topic string, samples []OnlineSample) *OnlinePeak {
+	peak := &OnlinePeak{Topic: topic, Samples: len(samples)}
+	if len(samples) == 0 {
+		return peak
+	}
+	var sum int64 = 0
+	for _, sample := range samples {
+		sum += sample.Online
+		if sample.Online > peak.Peak || peak.PeakTime == 0 {
+			peak.Peak = sample.Online
+			peak.PeakTime = sample.Time
+		}
+	}
+	peak.Average = sum / int64(len(samples))
+	return peak
+}
+
+func (p *OnlineHistory) Peak(topic string, from, to int64) *OnlinePeak {
+	return gainOnlinePeak(topic, p.Series(topic, from, to))
+}
+
+//按峰值排序的前n个topic
+func (p *OnlineHistory) Top(from, to int64, n int) []*OnlinePeak {
+	p.lock.RLock()
+	peaks := make([]*OnlinePeak, 0, len(p.topics))
+	for topic, ring := range p.topics {
+		peak := gainOnlinePeak(topic, ring.Range(from, to))
+		if peak.Samples > 0 {
+			peaks = append(peaks, peak)
+		}
+	}
+	p.lock.RUnlock()
+
+	sort.Sort(sort.Reverse(OnlinePeakList(peaks)))
+	if n > 0 && n < len(peaks) {
+		peaks = peaks[:n]
+	}
+	return peaks
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//缓存过期后没人查询的topic，每次采样也会刷新并记录
+func TestOnlineHistorySample(t *testing.T) {
+	var calls int64
+	saved := onlineCache
+	onlineCache = &OnlineCache{
+		Total: newTestOnlineTable(0, 0, &calls),
+		Local: newTestOnlineTable(0, 0, &calls),
+	}
+	t.Cleanup(func() { onlineCache = saved })
+	onlineCache.GetTotalOnlineBatch([]string{"a", "bb"})
+
+	history := &OnlineHistory{topics: map[string]*OnlineRing{}, size: 3, interval: 60}
+	for i := int64(1); i <= 5; i++ {
+		history.sample(i * 60)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt64(&calls); n < 6 {
+		t.Errorf("collect called %d times, want refresh on every sample", n)
+	}
+	for topic, online := range map[string]int64{"a": 1, "bb": 2} {
+		series := history.Series(topic, 0, 1000)
+		if len(series) != 3 || series[0].Time != 180 || series[2].Time != 300 {
+			t.Errorf("series of %s: %v", topic, series)
+			continue
+		}
+		for _, sample := range series {
+			if sample.Online != online {
+				t.Errorf("series of %s: %v", topic, series)
+			}
+		}
+	}
+
+	//缓存中没有的topic，采样点全部过期后删除
+	onlineCache.Total = newTestOnlineTable(0, 0, &calls)
+	history.sample(300 + 3*60 + 1)
+	if series := history.Series("a", 0, 1000); len(series) != 0 {
+		t.Errorf("expired topic kept %v", series)
+	}
+}
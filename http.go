@@ -2,57 +2,120 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
+	"sync"
 	"time"
 )
 
-func HttpPostJson(httpUrl string, headers map[string]string, params interface{}, timeout int) (Dict, Error) {
-	log.Debug("http post <%v> to %s", params, httpUrl)
+/**
+ * 每个对端共用一个http client
+ * 1、长连接复用，不再每次请求都握手
+ * 2、超时用请求的context控制，覆盖建连、发送、等待和读取
+ * 3、每个对端的并发请求数有上限，超出的请求排队等待(同样受超时控制)
+ * 4、对端地址都是 http://，只用 HTTP/1.1，不支持 h2c；直连对端，不走环境变量中的代理
+ */
+var (
+	httpPeers     = map[string]*HttpPeer{}
+	httpPeersLock sync.Mutex
+)
 
-	jstr, _ := json.Marshal(params)
-	body := bytes.NewBuffer(jstr)
-	log.Debug("http post <%v> to %s", string(jstr), httpUrl)
+type HttpPeer struct {
+	client *http.Client
+	sem    chan bool
+}
 
-	client := &http.Client{
-		Transport: &http.Transport{
-			Dial: func(netw, addr string) (net.Conn, error) {
-				c, err := net.DialTimeout(netw, addr, time.Second*time.Duration(timeout)) //设置建立连接超时
-				if err != nil {
-					return nil, err
-				}
-				c.SetDeadline(time.Now().Add(time.Second * time.Duration(timeout))) //设置发送接收数据超时
-				return c, nil
-			},
-		},
+func GetHttpPeer(host string) *HttpPeer {
+	httpPeersLock.Lock()
+	defer httpPeersLock.Unlock()
+
+	peer, ok := httpPeers[host]
+	if ok {
+		return peer
 	}
-	req, _ := http.NewRequest("POST", httpUrl, body)
-	req.Header.Set("Content-Type", "application/json")
 
-	for k, v := range headers {
-		req.Header.Set(k, v)
+	maxConns := configOpt.httpMaxConnsPerPeer
+	if maxConns <= 0 {
+		maxConns = 32
+	}
+	transport := &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   time.Second * time.Duration(configOpt.httpRpcTimeout),
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:        maxConns,
+		MaxIdleConnsPerHost: maxConns,
+		MaxConnsPerHost:     maxConns,
+		IdleConnTimeout:     90 * time.Second,
 	}
+	peer = &HttpPeer{
+		client: &http.Client{Transport: transport},
+		sem:    make(chan bool, maxConns),
+	}
+	httpPeers[host] = peer
+	return peer
+}
+
+func (p *HttpPeer) Do(req *http.Request) (*http.Response, error) {
+	select {
+	case p.sem <- true:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	defer func() { <-p.sem }()
+	return p.client.Do(req)
+}
+
+func doHttpRequest(req *http.Request, timeout int) ([]byte, Error) {
+	ctx, cancel := context.WithTimeout(req.Context(), time.Second*time.Duration(timeout))
+	defer cancel()
+	req = req.WithContext(ctx)
 
-	resp, err := client.Do(req)
+	resp, err := GetHttpPeer(req.URL.Host).Do(req)
 	if err != nil {
-		log.Error("post<%v> to <%s>failed, %s", params, httpUrl, err)
+		log.Error("%s <%s>failed, %s", req.Method, req.URL, err)
 		return nil, NewError(REMOTE_CONN_ERR, err, "Remote serever can't access")
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
-		log.Error("post<%s> failed,err code: %d", httpUrl, resp.StatusCode)
+		//读完响应体，连接才能复用
+		ioutil.ReadAll(resp.Body)
+		log.Error("%s <%s> failed,err code: %d", req.Method, req.URL, resp.StatusCode)
 		return nil, NewError(REMOTE_RESP_ERR, err, fmt.Sprintf("err code: %d", resp.StatusCode))
 	}
 
 	result, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		log.Error("post<%s> failed, %s", httpUrl, err)
+		log.Error("%s <%s> failed, %s", req.Method, req.URL, err)
 		return nil, NewError(REMOTE_RESP_ERR, err, "Remote serever response error")
 	}
+	return result, OK
+}
+
+func HttpPostJson(httpUrl string, headers map[string]string, params interface{}, timeout int) (Dict, Error) {
+	log.Debug("http post <%v> to %s", params, httpUrl)
+
+	jstr, _ := json.Marshal(params)
+	body := bytes.NewBuffer(jstr)
+	log.Debug("http post <%v> to %s", string(jstr), httpUrl)
+
+	req, _ := http.NewRequest("POST", httpUrl, body)
+	req.Header.Set("Content-Type", "application/json")
+
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	result, ret := doHttpRequest(req, timeout)
+	if !ret.Ok() {
+		return nil, ret
+	}
 
 	dict := Dict{}
 	json.Unmarshal([]byte(result), &dict)
@@ -88,46 +151,18 @@ func HttpGetJson(httpUrl string, params Dict, timeout int) (Dict, Error) {
 
 	l := httpUrl
 	if params != nil {
-		buf := ""
+		values := url.Values{}
 		for k, v := range params {
-			buf = fmt.Sprintf("%s%s=%s&", buf, k, v)
-		}
-		if len(buf) > 0 {
-			buf = buf[0 : len(buf)-1]
+			values.Set(k, fmt.Sprintf("%v", v))
 		}
-		l = fmt.Sprintf("%s?%s", httpUrl, buf)
+		l = fmt.Sprintf("%s?%s", httpUrl, values.Encode())
 	}
 
-	client := &http.Client{
-		Transport: &http.Transport{
-			Dial: func(netw, addr string) (net.Conn, error) {
-				c, err := net.DialTimeout(netw, addr, time.Second*time.Duration(timeout)) //设置建立连接超时
-				if err != nil {
-					return nil, err
-				}
-				c.SetDeadline(time.Now().Add(time.Second * time.Duration(timeout))) //设置发送接收数据超时
-				return c, nil
-			},
-		},
-	}
 	req, _ := http.NewRequest("GET", l, nil)
 
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Error("get<%v> to <%s>failed, %s", params, httpUrl, err)
-		return nil, NewError(REMOTE_CONN_ERR, err, "Remote serever can't access")
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 200 {
-		log.Error("get<%s> failed,err code: %d", httpUrl, resp.StatusCode)
-		return nil, NewError(REMOTE_RESP_ERR, err, fmt.Sprintf("err code: %d", resp.StatusCode))
-	}
-
-	result, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Error("get<%s> failed, %s", httpUrl, err)
-		return nil, NewError(REMOTE_RESP_ERR, err, "Remote serever response error")
+	result, ret := doHttpRequest(req, timeout)
+	if !ret.Ok() {
+		return nil, ret
 	}
 	//fmt.Printf("http response:<%s>\n", string(result))
 
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//本地的对端，统计新建连接数和最大并发数
+type stubPeer struct {
+	server  *httptest.Server
+	conns   int64
+	running int64
+	peak    int64
+	delay   time.Duration
+}
+
+func newStubPeer(t testing.TB, delay time.Duration) *stubPeer {
+	p := &stubPeer{delay: delay}
+	p.server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		running := atomic.AddInt64(&p.running, 1)
+		defer atomic.AddInt64(&p.running, -1)
+		for {
+			peak := atomic.LoadInt64(&p.peak)
+			if running <= peak || atomic.CompareAndSwapInt64(&p.peak, peak, running) {
+				break
+			}
+		}
+		time.Sleep(p.delay)
+		fmt.Fprint(w, `{"err_code": 200, "err_msg": "", "data": {"online": 1}}`)
+	}))
+	p.server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&p.conns, 1)
+		}
+	}
+	p.server.Start()
+	t.Cleanup(p.server.Close)
+	return p
+}
+
+//清空对端的client，测试结束后恢复配置
+func resetHttpPeers(t testing.TB, maxConns int, timeout int) {
+	savedMaxConns := configOpt.httpMaxConnsPerPeer
+	savedTimeout := configOpt.httpRpcTimeout
+	t.Cleanup(func() {
+		configOpt.httpMaxConnsPerPeer = savedMaxConns
+		configOpt.httpRpcTimeout = savedTimeout
+		httpPeersLock.Lock()
+		httpPeers = map[string]*HttpPeer{}
+		httpPeersLock.Unlock()
+	})
+	httpPeersLock.Lock()
+	httpPeers = map[string]*HttpPeer{}
+	httpPeersLock.Unlock()
+	configOpt.httpMaxConnsPerPeer = maxConns
+	configOpt.httpRpcTimeout = timeout
+}
+
+//大量并发请求: 全部成功，并发和连接数不超过上限，连接复用
+func TestHttpPeerLoad(t *testing.T) {
+	resetHttpPeers(t, 4, 3)
+	peer := newStubPeer(t, time.Millisecond)
+	httpUrl := peer.server.URL + "/provider/collect/v1/online"
+
+	var failed int64
+	wg := sync.WaitGroup{}
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				data, ret := HttpPostJson(httpUrl, nil, Dict{"Topics": []string{"a"}}, configOpt.httpRpcTimeout)
+				if ret.Ok() {
+					_, ret = TransProviderResult(data)
+				}
+				if !ret.Ok() {
+					atomic.AddInt64(&failed, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if failed > 0 {
+		t.Errorf("%d requests failed", failed)
+	}
+	if peak := atomic.LoadInt64(&peer.peak); peak > 4 {
+		t.Errorf("peak concurrency %d over limit", peak)
+	}
+	if conns := atomic.LoadInt64(&peer.conns); conns > 4 {
+		t.Errorf("%d connections for 1000 requests, want reuse", conns)
+	}
+}
+
+//对端太慢，排队和等待都受超时控制
+func TestHttpPeerTimeout(t *testing.T) {
+	resetHttpPeers(t, 1, 1)
+	peer := newStubPeer(t, 1500*time.Millisecond)
+	httpUrl := peer.server.URL + "/provider/collect/v1/online"
+
+	start := time.Now()
+	wg := sync.WaitGroup{}
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, ret := HttpPostJson(httpUrl, nil, Dict{}, configOpt.httpRpcTimeout)
+			if ret.Code != REMOTE_CONN_ERR || !strings.Contains(ret.Error(), "deadline") {
+				t.Errorf("unexpected result %v", ret)
+			}
+		}()
+	}
+	wg.Wait()
+	if cost := time.Since(start); cost > 1400*time.Millisecond {
+		t.Errorf("requests took %v, want timeout", cost)
+	}
+}
+
+//共用的对端client
+func BenchmarkHttpPeerPooled(b *testing.B) {
+	resetHttpPeers(b, 32, 3)
+	peer := newStubPeer(b, 0)
+	httpUrl := peer.server.URL + "/provider/collect/v1/online"
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, ret := HttpPostJson(httpUrl, nil, Dict{"Topics": []string{"a"}}, 3); !ret.Ok() {
+				b.Error(ret)
+			}
+		}
+	})
+	b.ReportMetric(float64(atomic.LoadInt64(&peer.conns)), "conns")
+}
+
+//基准: 原来的用法，每次请求新建client，连接不复用
+func BenchmarkHttpPerCall(b *testing.B) {
+	peer := newStubPeer(b, 0)
+	httpUrl := peer.server.URL + "/provider/collect/v1/online"
+	timeout := 3 * time.Second
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			client := &http.Client{
+				Transport: &http.Transport{
+					Dial: func(netw, addr string) (net.Conn, error) {
+						c, err := net.DialTimeout(netw, addr, timeout)
+						if err != nil {
+							return nil, err
+						}
+						c.SetDeadline(time.Now().Add(timeout))
+						return c, nil
+					},
+				},
+			}
+			resp, err := client.Post(httpUrl, "application/json", strings.NewReader(`{"Topics": ["a"]}`))
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+	})
+	b.ReportMetric(float64(atomic.LoadInt64(&peer.conns)), "conns")
+}
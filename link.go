@@ -0,0 +1,546 @@
+package main
+
+/**
+ * provider 之间的长连接
+ * 1、每个对端一条tcp连接，建立后用invoker签名认证一次
+ *    服务端先下发随机的 nonce，签名覆盖时间和 nonce，截获的认证帧不能在别的连接上重放
+ * 2、帧格式: 4字节长度(大端) + json
+ * 3、同一条连接上复用消息转发(relay/bridge)和在线人数收集，按seq匹配应答
+ *    转发的消息按收到的顺序逐条处理，在线人数查询并发处理
+ * 4、定时心跳，超时未收到应答则断开，断开后自动重连
+ * 5、长连接不可用时调用方退回到http接口
+ */
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	LINK_CHALLENGE    = "challenge"
+	LINK_AUTH         = "auth"
+	LINK_AUTH_ACK     = "auth_ack"
+	LINK_PUBLISH      = "publish"
+	LINK_PUBLISH_ACK  = "publish_ack"
+	LINK_ONLINE       = "online"
+	LINK_ONLINE_ACK   = "online_ack"
+	LINK_SNAPSHOT     = "snapshot"
+	LINK_SNAPSHOT_ACK = "snapshot_ack"
+	LINK_PING         = "ping"
+	LINK_PONG         = "pong"
+
+	LINK_KIND_RELAY  = "relay"
+	LINK_KIND_BRIDGE = "bridge"
+
+	LINK_MAX_FRAME = 16 * 1024 * 1024
+	//每条连接等待处理的转发消息，满了不再读取，由tcp反压
+	LINK_PUBLISH_BUFFER = 1024
+)
+
+var (
+	peerLinks     = map[string]*PeerLink{}
+	peerLinksLock sync.Mutex
+)
+
+type LinkFrame struct {
+	Type string
+	Seq  uint64
+
+	//认证
+	Invoker string `json:",omitempty"`
+	Time    int64  `json:",omitempty"`
+	Nonce   string `json:",omitempty"`
+	Sign    string `json:",omitempty"`
+
+	//消息转发
+	Kind string       `json:",omitempty"`
+	Pub  *PublishForm `json:",omitempty"`
+
+	//在线人数
+	Topic  string `json:",omitempty"`
+	Online int64  `json:",omitempty"`
+
+	//在线人数快照
+	Snapshot *OnlineSnapshot `json:",omitempty"`
+	Topics   []string        `json:",omitempty"`
+
+	//批量在线人数
+	Onlines map[string]int64 `json:",omitempty"`
+
+	//应答
+	Code int    `json:",omitempty"`
+	Msg  string `json:",omitempty"`
+}
+
+func readLinkFrame(reader io.Reader) (*LinkFrame, error) {
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(reader, head); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(head)
+	if length > LINK_MAX_FRAME {
+		return nil, fmt.Errorf("frame too large <%d>", length)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, err
+	}
+	frame := &LinkFrame{}
+	if err := json.Unmarshal(body, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+func writeLinkFrame(conn net.Conn, frame *LinkFrame, timeout int) error {
+	body, err := json.Marshal(frame)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 4+len(body))
+	binary.BigEndian.PutUint32(buf, uint32(len(body)))
+	copy(buf[4:], body)
+
+	if timeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(time.Second * time.Duration(timeout)))
+	}
+	_, err = conn.Write(buf)
+	return err
+}
+
+func getInvokerKey(invoker string) (string, bool) {
+	dict, ok := configOpt.invokerMap[invoker].(map[string]interface{})
+	if !ok {
+		return "", false
+	}
+	key, ok := dict["key"].(string)
+	return key, ok
+}
+
+func linkAuthSign(t int64, nonce, invoker, key string) string {
+	return Md5Sig(fmt.Sprintf("%d:%s", t, nonce), invoker, key)
+}
+
+func linkNonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+//长连接地址: 对端的http地址host + 长连接端口
+func peerLinkAddr(addr string) string {
+	host := addr
+	if pos := strings.LastIndex(addr, ":"); pos > 0 {
+		host = addr[0:pos]
+	}
+	return fmt.Sprintf("%s:%d", host, configOpt.peerLinkPort)
+}
+
+/******************** 服务端 ********************/
+
+func StartPeerLinkServer() {
+	if configOpt.peerLinkPort <= 0 {
+		return
+	}
+	listen := fmt.Sprintf("0.0.0.0:%d", configOpt.peerLinkPort)
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		log.Error("listen peer link <%s> failed, %v", listen, err)
+		return
+	}
+	log.Info("peer link listen on <%s>", listen)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				log.Error("accept peer link failed, %v", err)
+				time.Sleep(time.Second)
+				continue
+			}
+			go servePeerLink(conn)
+		}
+	}()
+}
+
+func servePeerLink(conn net.Conn) {
+	defer conn.Close()
+	remote := conn.RemoteAddr().String()
+	reader := bufio.NewReader(conn)
+	timeout := configOpt.httpRpcTimeout
+
+	//先下发nonce，第一帧必须是认证
+	nonce := linkNonce()
+	if err := writeLinkFrame(conn, &LinkFrame{Type: LINK_CHALLENGE, Nonce: nonce}, timeout); err != nil {
+		return
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second * time.Duration(timeout)))
+	frame, err := readLinkFrame(reader)
+	if err != nil || frame.Type != LINK_AUTH {
+		log.Error("peer link <%s> auth failed, %v", remote, err)
+		return
+	}
+	key, ok := getInvokerKey(frame.Invoker)
+	delta := Gtimer.Unix - frame.Time
+	if !ok || delta > 60 || delta < -60 ||
+		strings.ToLower(frame.Sign) != linkAuthSign(frame.Time, nonce, frame.Invoker, key) {
+		log.Error("peer link <%s> invalid invoker<%s> or sign", remote, frame.Invoker)
+		ret := NewError(NO_PERM, nil, "no perm")
+		writeLinkFrame(conn, &LinkFrame{Type: LINK_AUTH_ACK, Seq: frame.Seq, Code: ret.Code, Msg: ret.Msg}, timeout)
+		return
+	}
+	invoker := frame.Invoker
+	if err := writeLinkFrame(conn, &LinkFrame{Type: LINK_AUTH_ACK, Seq: frame.Seq}, timeout); err != nil {
+		return
+	}
+	log.Info("peer link <%s> auth success, invoker: %s", remote, invoker)
+
+	var writeLock sync.Mutex
+	reply := func(frame *LinkFrame) {
+		writeLock.Lock()
+		defer writeLock.Unlock()
+		if err := writeLinkFrame(conn, frame, timeout); err != nil {
+			log.Error("peer link <%s> write failed, %v", remote, err)
+			conn.Close()
+		}
+	}
+
+	//转发的消息在一个协程里按顺序处理
+	publishes := make(chan *LinkFrame, LINK_PUBLISH_BUFFER)
+	defer close(publishes)
+	go func() {
+		for frame := range publishes {
+			ret := handleLinkPublish(frame, invoker)
+			reply(&LinkFrame{Type: LINK_PUBLISH_ACK, Seq: frame.Seq, Code: ret.Code, Msg: ret.Msg})
+		}
+	}()
+
+	idle := time.Second * time.Duration(configOpt.peerLinkPing*3)
+	for {
+		if idle > 0 {
+			conn.SetReadDeadline(time.Now().Add(idle))
+		} else {
+			conn.SetReadDeadline(time.Time{})
+		}
+		frame, err := readLinkFrame(reader)
+		if err != nil {
+			log.Info("peer link <%s> closed, %v", remote, err)
+			return
+		}
+		switch frame.Type {
+		case LINK_PING:
+			reply(&LinkFrame{Type: LINK_PONG, Seq: frame.Seq})
+		case LINK_PUBLISH:
+			publishes <- frame
+		case LINK_ONLINE:
+			go func(frame *LinkFrame) {
+				if len(frame.Topics) > 0 {
+					onlines := onlineCache.GetLocalOnlineBatch(frame.Topics)
+					reply(&LinkFrame{Type: LINK_ONLINE_ACK, Seq: frame.Seq, Onlines: onlines})
+					return
+				}
+				data, ret := ServiceGetLocalOnline(frame.Topic)
+				online, _ := data["online"].(int64)
+				reply(&LinkFrame{Type: LINK_ONLINE_ACK, Seq: frame.Seq, Online: online,
+					Code: ret.Code, Msg: ret.Msg})
+			}(frame)
+		case LINK_SNAPSHOT:
+			go func(frame *LinkFrame) {
+				ack := &LinkFrame{Type: LINK_SNAPSHOT_ACK, Seq: frame.Seq}
+				if frame.Snapshot == nil {
+					ack.Code, ack.Msg = INVALID_PARAM, "invalid params"
+				} else {
+					wants, ret := ServicePushOnline(frame.Snapshot)
+					ack.Topics, ack.Code, ack.Msg = wants, ret.Code, ret.Msg
+				}
+				reply(ack)
+			}(frame)
+		default:
+			log.Error("peer link <%s> unknown frame <%s>", remote, frame.Type)
+		}
+	}
+}
+
+func handleLinkPublish(frame *LinkFrame, invoker string) Error {
+	form := frame.Pub
+	if form == nil {
+		return NewError(INVALID_PARAM, nil, "invalid params")
+	}
+	form.Invoker = invoker
+	normalizePublishForm(form)
+
+	var ret Error
+	if frame.Kind == LINK_KIND_BRIDGE {
+		ret = ServiceBridgePublish(form)
+	} else {
+		ret = ServiceRelayPublish(form)
+	}
+	if !ret.Ok() {
+		log.Error("link %s publish<%+v> failed, %s", frame.Kind, form, ret)
+	} else {
+		log.Info("link %s publish<%+v> success", frame.Kind, form)
+	}
+	return ret
+}
+
+/******************** 客户端 ********************/
+
+type PeerLink struct {
+	addr    string
+	invoker string
+
+	conn      net.Conn
+	connected bool
+	lock      sync.Mutex //保护conn和pending
+	writeLock sync.Mutex
+	pending   map[uint64]chan *LinkFrame
+	seq       uint64
+	lastPong  int64
+}
+
+//获取到对端的长连接，未开启返回nil
+func GetPeerLink(addr string, invoker string) *PeerLink {
+	if configOpt.peerLinkPort <= 0 {
+		return nil
+	}
+
+	peerLinksLock.Lock()
+	defer peerLinksLock.Unlock()
+
+	link, ok := peerLinks[addr]
+	if ok {
+		return link
+	}
+	link = &PeerLink{
+		addr:    peerLinkAddr(addr),
+		invoker: invoker,
+		pending: map[uint64]chan *LinkFrame{},
+	}
+	peerLinks[addr] = link
+	go link.keep()
+	return link
+}
+
+//各对端长连接的状态
+func GetPeerLinkStats() Dict {
+	peerLinksLock.Lock()
+	defer peerLinksLock.Unlock()
+
+	stats := Dict{}
+	for addr, link := range peerLinks {
+		stats[addr] = Dict{
+			"connected": link.Connected(),
+			"lastPong":  atomic.LoadInt64(&link.lastPong),
+		}
+	}
+	return stats
+}
+
+func (p *PeerLink) Connected() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.connected
+}
+
+//维持连接：断开后按间隔重连，连上后定时心跳
+func (p *PeerLink) keep() {
+	interval := time.Second * time.Duration(configOpt.peerLinkPing)
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	for {
+		if err := p.connect(); err != nil {
+			log.Error("peer link <%s> connect failed, %v", p.addr, err)
+			time.Sleep(interval)
+			continue
+		}
+		log.Info("peer link <%s> connected", p.addr)
+
+		for p.Connected() {
+			time.Sleep(interval)
+			if Gtimer.Unix-atomic.LoadInt64(&p.lastPong) > int64(3*interval/time.Second) {
+				log.Error("peer link <%s> heartbeat timeout", p.addr)
+				p.lock.Lock()
+				conn := p.conn
+				p.lock.Unlock()
+				p.close(conn)
+				break
+			}
+			go p.call(&LinkFrame{Type: LINK_PING})
+		}
+	}
+}
+
+func (p *PeerLink) connect() error {
+	timeout := configOpt.httpRpcTimeout
+	conn, err := net.DialTimeout("tcp", p.addr, time.Second*time.Duration(timeout))
+	if err != nil {
+		return err
+	}
+	key, ok := getInvokerKey(p.invoker)
+	if !ok {
+		conn.Close()
+		return fmt.Errorf("invalid invoker:%s", p.invoker)
+	}
+
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(time.Second * time.Duration(timeout)))
+	challenge, err := readLinkFrame(reader)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if challenge.Type != LINK_CHALLENGE || len(challenge.Nonce) == 0 {
+		conn.Close()
+		return fmt.Errorf("invalid challenge <%s>", challenge.Type)
+	}
+
+	now := Gtimer.Unix
+	auth := &LinkFrame{
+		Type:    LINK_AUTH,
+		Invoker: p.invoker,
+		Time:    now,
+		Sign:    linkAuthSign(now, challenge.Nonce, p.invoker, key),
+	}
+	if err := writeLinkFrame(conn, auth, timeout); err != nil {
+		conn.Close()
+		return err
+	}
+	ack, err := readLinkFrame(reader)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if ack.Type != LINK_AUTH_ACK || ack.Code != SUCCESS {
+		conn.Close()
+		return fmt.Errorf("auth failed, %s", ack.Msg)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	p.lock.Lock()
+	p.conn = conn
+	p.connected = true
+	p.lock.Unlock()
+	atomic.StoreInt64(&p.lastPong, Gtimer.Unix)
+
+	go p.readLoop(conn, reader)
+	return nil
+}
+
+func (p *PeerLink) readLoop(conn net.Conn, reader *bufio.Reader) {
+	for {
+		frame, err := readLinkFrame(reader)
+		if err != nil {
+			log.Error("peer link <%s> read failed, %v", p.addr, err)
+			p.close(conn)
+			return
+		}
+		atomic.StoreInt64(&p.lastPong, Gtimer.Unix)
+
+		p.lock.Lock()
+		ch, ok := p.pending[frame.Seq]
+		delete(p.pending, frame.Seq)
+		p.lock.Unlock()
+		if ok {
+			ch <- frame
+		}
+	}
+}
+
+//关闭连接，已经重连过的新连接不受影响
+func (p *PeerLink) close(conn net.Conn) {
+	conn.Close()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.conn != conn {
+		return
+	}
+	p.connected = false
+	//唤醒所有等待应答的请求
+	for seq, ch := range p.pending {
+		close(ch)
+		delete(p.pending, seq)
+	}
+}
+
+//发送请求并等待应答
+func (p *PeerLink) call(frame *LinkFrame) (*LinkFrame, Error) {
+	timeout := configOpt.httpRpcTimeout
+
+	p.lock.Lock()
+	if !p.connected {
+		p.lock.Unlock()
+		return nil, NewError(REMOTE_CONN_ERR, nil, "peer link not connected")
+	}
+	conn := p.conn
+	p.seq++
+	frame.Seq = p.seq
+	ch := make(chan *LinkFrame, 1)
+	p.pending[frame.Seq] = ch
+	p.lock.Unlock()
+
+	p.writeLock.Lock()
+	err := writeLinkFrame(conn, frame, timeout)
+	p.writeLock.Unlock()
+	if err != nil {
+		p.close(conn)
+		return nil, NewError(REMOTE_CONN_ERR, err, "peer link write failed")
+	}
+
+	select {
+	case ack, ok := <-ch:
+		if !ok {
+			return nil, NewError(REMOTE_CONN_ERR, nil, "peer link closed")
+		}
+		if ack.Code != SUCCESS {
+			return nil, NewError(ack.Code, nil, ack.Msg)
+		}
+		return ack, OK
+	case <-time.After(time.Second * time.Duration(timeout)):
+		p.lock.Lock()
+		delete(p.pending, frame.Seq)
+		p.lock.Unlock()
+		return nil, NewError(REMOTE_CONN_ERR, nil, "peer link timeout")
+	}
+}
+
+func (p *PeerLink) Publish(kind string, pub *PublishForm) Error {
+	_, ret := p.call(&LinkFrame{Type: LINK_PUBLISH, Kind: kind, Pub: pub})
+	return ret
+}
+
+func (p *PeerLink) QueryOnline(topic string) (int64, Error) {
+	ack, ret := p.call(&LinkFrame{Type: LINK_ONLINE, Topic: topic})
+	if !ret.Ok() {
+		return 0, ret
+	}
+	return ack.Online, OK
+}
+
+func (p *PeerLink) QueryOnlineBatch(topics []string) (map[string]int64, Error) {
+	ack, ret := p.call(&LinkFrame{Type: LINK_ONLINE, Topics: topics})
+	if !ret.Ok() {
+		return map[string]int64{}, ret
+	}
+	return ack.Onlines, OK
+}
+
+func (p *PeerLink) PushOnline(snapshot *OnlineSnapshot) ([]string, Error) {
+	ack, ret := p.call(&LinkFrame{Type: LINK_SNAPSHOT, Snapshot: snapshot})
+	if !ret.Ok() {
+		return nil, ret
+	}
+	return ack.Topics, OK
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"testing"
+)
+
+const (
+	testLinkInvoker = "relay"
+	testLinkKey     = "relay-key"
+)
+
+//前一个测试的连接可能还在读配置，只设置一次
+var testLinkConfig sync.Once
+
+func startTestLinkServer(t *testing.T) string {
+	testLinkConfig.Do(func() {
+		configOpt.invokerMap = map[string]interface{}{
+			testLinkInvoker: map[string]interface{}{"key": testLinkKey},
+		}
+		configOpt.httpRpcTimeout = 2
+		configOpt.peerLinkPing = 0
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed, %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go servePeerLink(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+//建立连接并读取服务端下发的nonce
+func dialTestLink(t *testing.T, addr string) (net.Conn, *bufio.Reader, string) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial failed, %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	reader := bufio.NewReader(conn)
+	challenge, err := readLinkFrame(reader)
+	if err != nil || challenge.Type != LINK_CHALLENGE || len(challenge.Nonce) == 0 {
+		t.Fatalf("invalid challenge %+v, %v", challenge, err)
+	}
+	return conn, reader, challenge.Nonce
+}
+
+func authTestLink(t *testing.T, conn net.Conn, reader *bufio.Reader, auth *LinkFrame) *LinkFrame {
+	if err := writeLinkFrame(conn, auth, 2); err != nil {
+		t.Fatalf("write auth failed, %v", err)
+	}
+	ack, err := readLinkFrame(reader)
+	if err != nil || ack.Type != LINK_AUTH_ACK {
+		t.Fatalf("invalid auth ack %+v, %v", ack, err)
+	}
+	return ack
+}
+
+func TestLinkAuthReplay(t *testing.T) {
+	addr := startTestLinkServer(t)
+
+	conn, reader, nonce := dialTestLink(t, addr)
+	auth := &LinkFrame{
+		Type:    LINK_AUTH,
+		Invoker: testLinkInvoker,
+		Time:    Gtimer.Unix,
+		Sign:    linkAuthSign(Gtimer.Unix, nonce, testLinkInvoker, testLinkKey),
+	}
+	if ack := authTestLink(t, conn, reader, auth); ack.Code != SUCCESS {
+		t.Fatalf("auth failed, %+v", ack)
+	}
+
+	//同一个认证帧在新连接上重放
+	conn, reader, nonce2 := dialTestLink(t, addr)
+	if nonce2 == nonce {
+		t.Fatalf("nonce reused")
+	}
+	if ack := authTestLink(t, conn, reader, auth); ack.Code != NO_PERM {
+		t.Fatalf("replayed auth accepted, %+v", ack)
+	}
+}
+
+func TestLinkClientConnect(t *testing.T) {
+	addr := startTestLinkServer(t)
+
+	link := &PeerLink{addr: addr, invoker: testLinkInvoker, pending: map[uint64]chan *LinkFrame{}}
+	if err := link.connect(); err != nil {
+		t.Fatalf("connect failed, %v", err)
+	}
+	defer link.close(link.conn)
+	if _, ret := link.call(&LinkFrame{Type: LINK_PING}); !ret.Ok() {
+		t.Fatalf("ping failed, %s", ret)
+	}
+}
+
+//同一条连接上的转发消息按顺序处理，应答顺序和发送顺序一致
+func TestLinkPublishOrder(t *testing.T) {
+	addr := startTestLinkServer(t)
+
+	conn, reader, nonce := dialTestLink(t, addr)
+	auth := &LinkFrame{
+		Type:    LINK_AUTH,
+		Invoker: testLinkInvoker,
+		Time:    Gtimer.Unix,
+		Sign:    linkAuthSign(Gtimer.Unix, nonce, testLinkInvoker, testLinkKey),
+	}
+	if ack := authTestLink(t, conn, reader, auth); ack.Code != SUCCESS {
+		t.Fatalf("auth failed, %+v", ack)
+	}
+
+	const count = 200
+	go func() {
+		for i := 1; i <= count; i++ {
+			writeLinkFrame(conn, &LinkFrame{Type: LINK_PUBLISH, Seq: uint64(i), Kind: LINK_KIND_RELAY}, 2)
+		}
+	}()
+	for i := 1; i <= count; i++ {
+		ack, err := readLinkFrame(reader)
+		if err != nil {
+			t.Fatalf("read ack failed, %v", err)
+		}
+		if ack.Type != LINK_PUBLISH_ACK || ack.Seq != uint64(i) {
+			t.Fatalf("ack %d got seq %d", i, ack.Seq)
+		}
+	}
+}
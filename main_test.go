@@ -0,0 +1,15 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/op/go-logging"
+)
+
+func TestMain(m *testing.M) {
+	log = logging.MustGetLogger("test")
+	logging.SetLevel(logging.ERROR, "test")
+	Gtimer = NewTimer()
+	os.Exit(m.Run())
+}
@@ -4,6 +4,7 @@ import (
 	"crypto/md5"
 	"fmt"
 	"io"
+	"os"
 	"strings"
 
 	"github.com/satori/go.uuid"
@@ -23,3 +24,12 @@ func Md5Sig(body, invoker, key string) string {
 	io.WriteString(t, buf)
 	return fmt.Sprintf("%x", t.Sum(nil))
 }
+
+//本节点标识，没有配置时用 主机名:端口
+func LocalNodeId() string {
+	if len(configOpt.nodeId) > 0 {
+		return configOpt.nodeId
+	}
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s:%d", host, configOpt.listenPort)
+}
@@ -2,20 +2,19 @@ package main
 
 /**
  * 在线人数统计方式
- * 1、建立一个全局缓存map: 缓存topic在线人数
- * 2、每隔3秒标记一次缓存失效（不删除原数据，如果下次获取出错，需要继续使用现有数据）
- * 3、获取topic在线人数先命中缓存，缓存没有则进行分布式拉取
- * 4、向各分布式代理节点发送统计命令，如果有一个出错超时，则沿用原缓存
- * 4、定时器每秒进行重置
+ * 1、建立两张缓存表: 本地在线人数和总在线人数，每张表一把互斥锁保护(查询也要调整LRU顺序，不能用读锁)
+ * 2、记录超过缓存时间视为过期（不删除原数据，如果下次获取出错，需要继续使用现有数据）
+ * 3、获取topic在线人数先命中缓存，过期则异步刷新，缓存没有则同步拉取
+ * 4、同一个topic同时只有一个刷新请求，其它请求等待这次结果（singleflight）
+ * 5、向各broker、分布式代理节点发送统计命令，每个来源的结果分开保存
+ *    某个来源出错超时，则沿用该来源上次成功的数据，并把记录标记为降级(degraded)
+ * 6、缓存的topic个数有上限，超过上限淘汰最久没有访问的topic（LRU）
  */
 
-//如果没有
-//要去抢夺资源锁，防止并发
-
 import (
+	"container/list"
 	"fmt"
 	"sync"
-	"sync/atomic"
 	"time"
 )
 
@@ -26,150 +25,423 @@ var (
 //子主题 有效客户端缓存一秒
 //父主题 有效客户端缓存3秒
 type OnlineCache struct {
-	TotalOnline map[string]int64
-	TotalExpire map[string]bool
-
-	LocalOnline map[string]int64
-	LocalExpire map[string]bool
+	Total *OnlineTable
+	Local *OnlineTable
 }
 
 func CreateOnlineCache() {
 	onlineCache = &OnlineCache{
-		TotalOnline: map[string]int64{},
-		TotalExpire: map[string]bool{},
-		LocalOnline: map[string]int64{},
-		LocalExpire: map[string]bool{},
+		Total: NewOnlineTable("total", configOpt.totalOnlineCacheExpire,
+			configOpt.onlineCacheMaxTopics, CollectTotalOnline, CollectTotalOnlineBatch),
+		Local: NewOnlineTable("local", configOpt.localOnlineCacheExpire,
+			configOpt.onlineCacheMaxTopics, CollectLocalOnline, CollectLocalOnlineBatch),
 	}
+}
+
+func (p *OnlineCache) GetLocalDetail(topic string) *OnlineDetail {
+	return p.Local.GetDetail([]string{topic})[topic]
+}
+
+func (p *OnlineCache) GetTotalDetail(topic string) *OnlineDetail {
+	return p.Total.GetDetail([]string{topic})[topic]
+}
+
+func (p *OnlineCache) GetTotalDetailBatch(topics []string) map[string]*OnlineDetail {
+	return p.Total.GetDetail(topics)
+}
 
-	onlineCache.startWatch()
+func (p *OnlineCache) GetLocalDetailBatch(topics []string) map[string]*OnlineDetail {
+	return p.Local.GetDetail(topics)
+}
+
+func (p *OnlineCache) GetLocalOnline(topic string) int64 {
+	return p.Local.Get(topic)
 }
 
-func (p *OnlineCache) expireTotalCache() {
-	//定时标记缓存不可用
-	for k := range p.TotalExpire {
-		p.TotalExpire[k] = true
+func (p *OnlineCache) GetTotalOnline(topic string) int64 {
+	return p.Total.Get(topic)
+}
+
+//批量获取本地在线人数，没有缓存的topic一次性拉取
+func (p *OnlineCache) GetLocalOnlineBatch(topics []string) map[string]int64 {
+	return p.Local.GetBatch(topics)
+}
+
+//批量获取总在线人数，没有缓存的topic一次性拉取
+func (p *OnlineCache) GetTotalOnlineBatch(topics []string) map[string]int64 {
+	return p.Total.GetBatch(topics)
+}
+
+//返回的是副本
+func (p *OnlineCache) GetAllTotalOnline(local bool) map[string]int64 {
+	if local {
+		return p.Local.GetAll()
+	} else {
+		return p.Total.GetAll()
 	}
 }
 
-func (p *OnlineCache) expireLocalCache() {
-	//定时标记缓存不可用
-	for k := range p.LocalExpire {
-		p.LocalExpire[k] = true
+//单个来源(broker、对端provider、本地)的在线人数
+type SourceOnline struct {
+	Online  int64
+	Updated int64  //最后一次成功的时间
+	Failed  string //最后一次出错的原因，成功则为空
+}
+
+//返回给调用方的在线人数，是缓存的副本
+type OnlineDetail struct {
+	Online   int64
+	Degraded bool  //有来源出错，部分数据是沿用的旧值
+	Updated  int64 //最后一次刷新的时间
+	Sources  map[string]SourceOnline
+}
+
+//一次统计的结果，按来源分开
+type OnlineSources struct {
+	Onlines      map[string]map[string]int64 //来源 -> topic -> 在线人数
+	Failed       map[string]string           //来源 -> 出错原因
+	FailedTopics map[string]map[string]bool  //来源 -> 出错的topic，没有记录表示整个来源出错
+	lock         sync.Mutex
+}
+
+func NewOnlineSources() *OnlineSources {
+	return &OnlineSources{
+		Onlines:      map[string]map[string]int64{},
+		Failed:       map[string]string{},
+		FailedTopics: map[string]map[string]bool{},
 	}
 }
 
-func (p *OnlineCache) cleanCache() {
-	//定时标记缓存不可用
-	for k := range p.TotalExpire {
-		delete(p.TotalOnline, k)
-		delete(p.TotalExpire, k)
+func (p *OnlineSources) Success(source string, onlines map[string]int64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	old, ok := p.Onlines[source]
+	if !ok {
+		old = map[string]int64{}
+		p.Onlines[source] = old
+	}
+	for topic, online := range onlines {
+		old[topic] = online
+	}
+}
+
+//整个来源出错
+func (p *OnlineSources) Fail(source string, reason string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.Failed[source] = reason
+	delete(p.FailedTopics, source)
+}
+
+//来源的部分topic出错(如分批请求中的一批)，其它topic的数据仍然有效
+func (p *OnlineSources) FailTopics(source string, topics []string, reason string) {
+	if len(topics) == 0 {
+		return
 	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
 
-	for k := range p.LocalExpire {
-		delete(p.LocalOnline, k)
-		delete(p.LocalExpire, k)
+	failed, partial := p.FailedTopics[source]
+	if _, ok := p.Failed[source]; ok && !partial {
+		return
+	}
+	if !partial {
+		failed = map[string]bool{}
+		p.FailedTopics[source] = failed
+	}
+	for _, topic := range topics {
+		failed[topic] = true
 	}
+	p.Failed[source] = reason
+}
 
+//来源对这个topic是否出错，统计结束后调用
+func (p *OnlineSources) failedReason(source string, topic string) (string, bool) {
+	reason, ok := p.Failed[source]
+	if !ok {
+		return "", false
+	}
+	if failed, partial := p.FailedTopics[source]; partial && !failed[topic] {
+		return "", false
+	}
+	return reason, true
 }
 
-func (p *OnlineCache) startWatch() {
-	go func() { //定时标记缓存不可用
-		for {
-			//log.Debug("sub topic push clients expire")
-			p.expireTotalCache()
+//所有来源的在线人数之和，不区分成功失败
+func (p *OnlineSources) Sum() map[string]int64 {
+	p.lock.Lock()
+	defer p.lock.Unlock()
 
-			<-time.After(time.Second *
-				time.Duration(configOpt.totalOnlineCacheExpire))
+	result := map[string]int64{}
+	for _, onlines := range p.Onlines {
+		for topic, online := range onlines {
+			result[topic] += online
 		}
-	}()
+	}
+	return result
+}
 
-	go func() { //定时标记缓存不可用
-		for {
-			//log.Debug("sub topic push clients expire")
-			p.expireLocalCache()
+type onlineEntry struct {
+	topic    string
+	online   int64
+	degraded bool
+	updated  time.Time
+	sources  map[string]*SourceOnline
+}
 
-			<-time.After(time.Second *
-				time.Duration(configOpt.localOnlineCacheExpire))
+//合并一次统计的结果，出错的来源保留上次成功的数据
+func (p *onlineEntry) merge(result *OnlineSources, now time.Time) {
+	for source, onlines := range result.Onlines {
+		online, ok := onlines[p.topic]
+		if !ok {
+			continue
 		}
-	}()
+		src, ok := p.sources[source]
+		if !ok {
+			src = &SourceOnline{}
+			p.sources[source] = src
+		}
+		src.Online = online
+		src.Updated = now.Unix()
+		src.Failed = ""
+	}
+	for source := range result.Failed {
+		reason, failed := result.failedReason(source, p.topic)
+		if !failed {
+			continue
+		}
+		src, ok := p.sources[source]
+		if !ok {
+			src = &SourceOnline{}
+			p.sources[source] = src
+		}
+		src.Failed = reason
+	}
 
-	go func() { //每隔3小时清空所有缓存，防止堆积垃圾数据
-		for {
-			//log.Debug("sub topic push clients expire")
-			p.cleanCache()
+	//这次没有出现的来源(如已下线的节点)不再参与计算
+	for source := range p.sources {
+		_, ok := result.Onlines[source]
+		_, failed := result.Failed[source]
+		if !ok && !failed {
+			delete(p.sources, source)
+		}
+	}
 
-			<-time.After(time.Hour * 3)
+	p.online = 0
+	p.degraded = false
+	for _, src := range p.sources {
+		p.online += src.Online
+		if len(src.Failed) > 0 {
+			p.degraded = true
 		}
-	}()
+	}
+	p.updated = now
+}
+
+func (p *onlineEntry) detail() *OnlineDetail {
+	detail := &OnlineDetail{
+		Online:   p.online,
+		Degraded: p.degraded,
+		Updated:  p.updated.Unix(),
+		Sources:  make(map[string]SourceOnline, len(p.sources)),
+	}
+	for source, src := range p.sources {
+		detail.Sources[source] = *src
+	}
+	return detail
+}
 
+//正在进行的刷新
+type onlineFlight struct {
+	wg     sync.WaitGroup
+	detail *OnlineDetail
 }
 
-func (p *OnlineCache) updateLocal(topic string) int64 {
-	//获取最新记录
-	online, _ := CollectLocalOnline(topic)
+type OnlineTable struct {
+	name    string
+	expire  time.Duration
+	max     int
+	entries map[string]*list.Element
+	lru     *list.List //最近访问的在前
+	flights map[string]*onlineFlight
+	lock    sync.Mutex
+
+	collect      func(string) *OnlineSources
+	collectBatch func([]string) *OnlineSources
+}
 
-	p.LocalOnline[topic] = online
-	p.LocalExpire[topic] = false
-	return online
+func NewOnlineTable(name string, expire int, max int,
+	collect func(string) *OnlineSources,
+	collectBatch func([]string) *OnlineSources) *OnlineTable {
+	if max <= 0 {
+		max = 100000
+	}
+	return &OnlineTable{
+		name:         name,
+		expire:       time.Second * time.Duration(expire),
+		max:          max,
+		entries:      map[string]*list.Element{},
+		lru:          list.New(),
+		flights:      map[string]*onlineFlight{},
+		collect:      collect,
+		collectBatch: collectBatch,
+	}
 }
 
-func (p *OnlineCache) GetLocalOnline(topic string) int64 {
-	online, ok := p.LocalOnline[topic]
-	if ok { //已经存在记录，直接返回
-		if expire, _ := p.LocalExpire[topic]; expire { //已经过期了，异步更新下数据，方便下次的人用
-			go p.updateLocal(topic)
+//查询缓存，返回记录、是否过期
+func (p *OnlineTable) lookup(topic string) (*onlineEntry, bool) {
+	elem, ok := p.entries[topic]
+	if !ok {
+		return nil, false
+	}
+	p.lru.MoveToFront(elem)
+	entry := elem.Value.(*onlineEntry)
+	return entry, time.Since(entry.updated) >= p.expire
+}
+
+func (p *OnlineTable) entry(topic string) *onlineEntry {
+	if elem, ok := p.entries[topic]; ok {
+		p.lru.MoveToFront(elem)
+		return elem.Value.(*onlineEntry)
+	}
+	entry := &onlineEntry{
+		topic:   topic,
+		sources: map[string]*SourceOnline{},
+	}
+	p.entries[topic] = p.lru.PushFront(entry)
+	for p.lru.Len() > p.max {
+		elem := p.lru.Back()
+		p.lru.Remove(elem)
+		delete(p.entries, elem.Value.(*onlineEntry).topic)
+	}
+	return entry
+}
 
+//为没有在刷新的topic登记刷新，返回需要自己刷新的topic和需要等待的刷新
+func (p *OnlineTable) startFlights(topics []string) ([]string, map[string]*onlineFlight) {
+	mine := []string{}
+	others := map[string]*onlineFlight{}
+	for _, topic := range topics {
+		if flight, ok := p.flights[topic]; ok {
+			others[topic] = flight
+			continue
 		}
-		return online
+		flight := &onlineFlight{}
+		flight.wg.Add(1)
+		p.flights[topic] = flight
+		mine = append(mine, topic)
 	}
-	//不存在记录，则必须等待返回
-	online = p.updateLocal(topic)
-	return online
+	return mine, others
 }
 
-func (p *OnlineCache) updateTotal(topic string) int64 {
-	//获取最新记录
-	online, _ := CollectTotalOnline(topic)
+//拉取最新数据，合并到缓存并唤醒等待者
+func (p *OnlineTable) refresh(topics []string) map[string]*OnlineDetail {
+	var result *OnlineSources
+	if len(topics) == 1 {
+		result = p.collect(topics[0])
+	} else {
+		result = p.collectBatch(topics)
+	}
+	if len(result.Failed) > 0 {
+		log.Warning("refresh %s online of <%d> topics degraded, failed sources: %v",
+			p.name, len(topics), result.Failed)
+	}
 
-	p.TotalOnline[topic] = online
-	p.TotalExpire[topic] = false
-	return online
+	details := make(map[string]*OnlineDetail, len(topics))
+	now := time.Now()
+	p.lock.Lock()
+	for _, topic := range topics {
+		entry := p.entry(topic)
+		entry.merge(result, now)
+		detail := entry.detail()
+		details[topic] = detail
+		if flight, ok := p.flights[topic]; ok {
+			flight.detail = detail
+			delete(p.flights, topic)
+			flight.wg.Done()
+		}
+	}
+	p.lock.Unlock()
+	return details
 }
 
-func (p *OnlineCache) GetTotalOnline(topic string) int64 {
-	online, ok := p.TotalOnline[topic]
-	if ok { //已经存在记录，直接返回
-		if expire, _ := p.TotalExpire[topic]; expire { //已经过期了，异步更新下数据，方便下次的人用
-			go p.updateTotal(topic)
+func (p *OnlineTable) Get(topic string) int64 {
+	return p.GetDetail([]string{topic})[topic].Online
+}
 
+func (p *OnlineTable) GetBatch(topics []string) map[string]int64 {
+	result := make(map[string]int64, len(topics))
+	for topic, detail := range p.GetDetail(topics) {
+		result[topic] = detail.Online
+	}
+	return result
+}
+
+func (p *OnlineTable) GetDetail(topics []string) map[string]*OnlineDetail {
+	result := map[string]*OnlineDetail{}
+	missing := []string{}
+	expired := []string{}
+
+	p.lock.Lock()
+	for _, topic := range topics {
+		entry, expire := p.lookup(topic)
+		if nil == entry {
+			missing = append(missing, topic)
+			continue
 		}
-		return online
+		if expire {
+			expired = append(expired, topic)
+		}
+		result[topic] = entry.detail()
 	}
+	//已经过期了，异步更新下数据，方便下次的人用
+	refreshing, _ := p.startFlights(expired)
 	//不存在记录，则必须等待返回
-	online = p.updateTotal(topic)
-	return online
+	loading, waiting := p.startFlights(missing)
+	p.lock.Unlock()
+
+	if len(refreshing) > 0 {
+		go p.refresh(refreshing)
+	}
+	if len(loading) > 0 {
+		for topic, detail := range p.refresh(loading) {
+			result[topic] = detail
+		}
+	}
+	for topic, flight := range waiting {
+		flight.wg.Wait()
+		result[topic] = flight.detail
+	}
+	return result
 }
 
-func (p *OnlineCache) GetAllTotalOnline(local bool) map[string]int64 {
-	if local {
-		return p.LocalOnline
-	} else {
-		return p.TotalOnline
+func (p *OnlineTable) GetAll() map[string]int64 {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	all := make(map[string]int64, len(p.entries))
+	for topic, elem := range p.entries {
+		all[topic] = elem.Value.(*onlineEntry).online
 	}
+	return all
+}
+
+func (p *OnlineTable) Len() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.lru.Len()
 }
 
 /**
 *分布式部署在线人数要分开统计， 这是一个对内接口，返回本中心的在线数据
  */
-func CollectLocalOnline(topic string) (int64, bool) {
-
-	var total int64 = 0
-	//分散收集收集本中心和其它中心的数据
+func CollectLocalOnline(topic string) *OnlineSources {
+	result := NewOnlineSources()
+	//分散收集本中心各broker的数据
 	var wg sync.WaitGroup
 	wg.Add(len(configOpt.brokerAddrs))
 
-	haveError := false
-
 	//收集broker
 	for _, addrStr := range configOpt.brokerAddrs {
 		go func(addr string) {
@@ -177,6 +449,7 @@ func CollectLocalOnline(topic string) (int64, bool) {
 			conn, _ := brokerPool.GetBrokerConn(addr, true)
 			if nil == conn {
 				log.Error("get connection to <%s> failed", addr)
+				result.Fail(addr, "get connection failed")
 				return
 			}
 			defer conn.Release()
@@ -185,28 +458,48 @@ func CollectLocalOnline(topic string) (int64, bool) {
 			if nil != err {
 				log.Error("query topic <%s> online count at local broker<%s>failed, %v",
 					topic, addr, err)
-				haveError = true
-			} else {
-				log.Debug("query topic <%s> online count at local broker<%s>success, %d",
-					topic, addr, online)
+				result.Fail(addr, fmt.Sprintf("%v", err))
+				return
 			}
-			atomic.AddInt64(&total, online)
+			log.Debug("query topic <%s> online count at local broker<%s>success, %d",
+				topic, addr, online)
+			result.Success(addr, map[string]int64{topic: online})
 		}(addrStr)
 	}
 
 	wg.Wait()
 
-	return total, haveError
+	return result
+}
+
+//本地来源的名字
+const ONLINE_SOURCE_LOCAL = "local"
+
+//本地数据作为总在线人数的一个来源，本地降级时总数也降级
+func collectLocalSource(result *OnlineSources, topics []string) {
+	onlines := map[string]int64{}
+	degraded := []string{}
+	for topic, detail := range onlineCache.GetLocalDetailBatch(topics) {
+		onlines[topic] = detail.Online
+		if detail.Degraded {
+			degraded = append(degraded, topic)
+		}
+	}
+	result.Success(ONLINE_SOURCE_LOCAL, onlines)
+	result.FailTopics(ONLINE_SOURCE_LOCAL, degraded, "local degraded")
 }
 
-func CollectTotalOnline(topic string) (int64, bool) {
-	var total int64 = 0
+func CollectTotalOnline(topic string) *OnlineSources {
+	//推模式直接用收到的快照计算
+	if OnlinePushMode() {
+		return CollectPushedOnline([]string{topic})
+	}
+
+	result := NewOnlineSources()
 	//分散收集收集本中心和其它中心的数据
 	var wg sync.WaitGroup
 	wg.Add(len(configOpt.relayList) + 1)
 
-	haveError := false
-
 	form := &OnlineForm{
 		Topic: topic,
 	}
@@ -214,37 +507,181 @@ func CollectTotalOnline(topic string) (int64, bool) {
 	//收集本地
 	go func() {
 		defer wg.Done()
-		online := onlineCache.GetLocalOnline(topic)
-		atomic.AddInt64(&total, online)
+		collectLocalSource(result, []string{topic})
 	}()
 
 	//收集异地
 	for _, addrStr := range configOpt.relayList {
 		go func(addr string) {
 			defer wg.Done()
-			httpUrl := fmt.Sprintf("http://%s%s", addr, configOpt.urlCollectOnline)
-			data, ret := HttpPostJson(httpUrl, nil, form, configOpt.httpRpcTimeout)
+			online, ret := collectRemoteOnline(addr, form)
 			if !ret.Ok() {
 				log.Error("collect online for<%s> at <%s> failed, %s", topic, addr, ret)
-				haveError = true
+				result.Fail(addr, ret.Error())
 				return
 			}
-			data, ret = TransProviderResult(data)
-			if !ret.Ok() {
-				log.Error("collect online for<%s> at <%s> failed, %s", topic, addr, ret)
-				haveError = true
+			result.Success(addr, map[string]int64{topic: online})
+		}(addrStr)
+	}
+	wg.Wait()
+
+	return result
+}
+
+func collectRemoteOnline(addr string, form *OnlineForm) (int64, Error) {
+	//优先使用长连接
+	if link := GetPeerLink(addr, configOpt.relayInvoker); link != nil && link.Connected() {
+		return link.QueryOnline(form.Topic)
+	}
+
+	httpUrl := fmt.Sprintf("http://%s%s", addr, configOpt.urlCollectOnline)
+	data, ret := HttpPostJson(httpUrl, nil, form, configOpt.httpRpcTimeout)
+	if !ret.Ok() {
+		return 0, ret
+	}
+	data, ret = TransProviderResult(data)
+	if !ret.Ok() {
+		return 0, ret
+	}
+	online, ok := data["online"].(float64)
+	if !ok {
+		return 0, NewError(REMOTE_RESP_ERR, nil, "invalid data")
+	}
+	return int64(online), OK
+}
+
+//每个批量请求最多的topic个数
+const ONLINE_BATCH_CHUNK = 1000
+
+func splitTopics(topics []string) [][]string {
+	chunks := [][]string{}
+	for len(topics) > ONLINE_BATCH_CHUNK {
+		chunks = append(chunks, topics[:ONLINE_BATCH_CHUNK])
+		topics = topics[ONLINE_BATCH_CHUNK:]
+	}
+	if len(topics) > 0 {
+		chunks = append(chunks, topics)
+	}
+	return chunks
+}
+
+//没有拿到数据的topic
+func missingTopics(topics []string, onlines map[string]int64) []string {
+	missing := []string{}
+	for _, topic := range topics {
+		if _, ok := onlines[topic]; !ok {
+			missing = append(missing, topic)
+		}
+	}
+	return missing
+}
+
+/**
+*批量收集本中心的在线数据，每个broker一次请求
+ */
+func CollectLocalOnlineBatch(topics []string) *OnlineSources {
+	result := NewOnlineSources()
+	var wg sync.WaitGroup
+	wg.Add(len(configOpt.brokerAddrs))
+
+	for _, addrStr := range configOpt.brokerAddrs {
+		go func(addr string) {
+			defer wg.Done()
+			conn, _ := brokerPool.GetBrokerConn(addr, true)
+			if nil == conn {
+				log.Error("get connection to <%s> failed", addr)
+				result.Fail(addr, "get connection failed")
 				return
 			}
-			online, ok := data["online"].(float64)
-			if !ok {
-				log.Error("collect online for<%s> at <%s> failed, invalid data", topic, addr)
-				haveError = true
-				return
+			defer conn.Release()
+
+			//出错后连接不能再用，这一批没有返回的和后面所有批次的topic都算出错
+			for i, chunk := range splitTopics(topics) {
+				onlines, err := conn.QueryMultiTopicOnline(chunk)
+				result.Success(addr, onlines)
+				if nil != err {
+					log.Error("query <%d> topics online count at local broker<%s>failed, %v",
+						len(chunk), addr, err)
+					result.FailTopics(addr, missingTopics(topics[i*ONLINE_BATCH_CHUNK:], onlines),
+						fmt.Sprintf("%v", err))
+					return
+				}
+			}
+		}(addrStr)
+	}
+
+	wg.Wait()
+
+	return result
+}
+
+/**
+*批量收集所有中心的在线数据，每个对端一次请求
+ */
+func CollectTotalOnlineBatch(topics []string) *OnlineSources {
+	//推模式直接用收到的快照计算
+	if OnlinePushMode() {
+		return CollectPushedOnline(topics)
+	}
+
+	result := NewOnlineSources()
+	var wg sync.WaitGroup
+	wg.Add(len(configOpt.relayList) + 1)
+
+	//收集本地
+	go func() {
+		defer wg.Done()
+		collectLocalSource(result, topics)
+	}()
+
+	//收集异地
+	for _, addrStr := range configOpt.relayList {
+		go func(addr string) {
+			defer wg.Done()
+			onlines, ret := collectRemoteOnlineBatch(addr, topics)
+			result.Success(addr, onlines)
+			if !ret.Ok() {
+				failed := missingTopics(topics, onlines)
+				log.Error("collect <%d/%d> topics online at <%s> failed, %s",
+					len(failed), len(topics), addr, ret)
+				result.FailTopics(addr, failed, ret.Error())
 			}
-			atomic.AddInt64(&total, int64(online))
 		}(addrStr)
 	}
 	wg.Wait()
 
-	return total, haveError
+	return result
+}
+
+func collectRemoteOnlineBatch(addr string, topics []string) (map[string]int64, Error) {
+	//优先使用长连接
+	if link := GetPeerLink(addr, configOpt.relayInvoker); link != nil && link.Connected() {
+		return link.QueryOnlineBatch(topics)
+	}
+
+	result := map[string]int64{}
+	httpUrl := fmt.Sprintf("http://%s%s", addr, configOpt.urlCollectOnline)
+	for _, chunk := range splitTopics(topics) {
+		form := &OnlineForm{
+			Topics: chunk,
+		}
+		data, ret := HttpPostJson(httpUrl, nil, form, configOpt.httpRpcTimeout)
+		if !ret.Ok() {
+			return result, ret
+		}
+		data, ret = TransProviderResult(data)
+		if !ret.Ok() {
+			return result, ret
+		}
+		onlines, ok := data["onlines"].(map[string]interface{})
+		if !ok {
+			return result, NewError(REMOTE_RESP_ERR, nil, "invalid data")
+		}
+		for topic, v := range onlines {
+			if online, ok := v.(float64); ok {
+				result[topic] = int64(online)
+			}
+		}
+	}
+	return result, OK
 }
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//在线人数固定为topic的长度，方便校验
+func newTestOnlineTable(expire int, max int, calls *int64) *OnlineTable {
+	collectBatch := func(topics []string) *OnlineSources {
+		atomic.AddInt64(calls, 1)
+		time.Sleep(time.Millisecond)
+		onlines := map[string]int64{}
+		for _, topic := range topics {
+			onlines[topic] = int64(len(topic))
+		}
+		result := NewOnlineSources()
+		result.Success("local", onlines)
+		return result
+	}
+	collect := func(topic string) *OnlineSources {
+		return collectBatch([]string{topic})
+	}
+	return NewOnlineTable("test", expire, max, collect, collectBatch)
+}
+
+//测试期间替换全局的在线人数缓存
+func useTestOnlineCache(t *testing.T) {
+	var calls int64
+	saved := onlineCache
+	onlineCache = &OnlineCache{
+		Total: newTestOnlineTable(60, 0, &calls),
+		Local: newTestOnlineTable(60, 0, &calls),
+	}
+	t.Cleanup(func() { onlineCache = saved })
+}
+
+func TestOnlineTableSingleflight(t *testing.T) {
+	var calls int64
+	table := newTestOnlineTable(60, 0, &calls)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if online := table.Get("live/room"); online != 9 {
+				t.Errorf("online %d, want 9", online)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt64(&calls); n != 1 {
+		t.Errorf("collect called %d times, want 1", n)
+	}
+}
+
+func TestOnlineTableConcurrentRefresh(t *testing.T) {
+	var calls int64
+	//过期时间为0，每次查询都触发异步刷新
+	table := newTestOnlineTable(0, 0, &calls)
+	topics := []string{"a", "bb", "ccc", "dddd"}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				topic := topics[(i+j)%len(topics)]
+				if online := table.Get(topic); online != int64(len(topic)) {
+					t.Errorf("online of %s is %d", topic, online)
+					return
+				}
+				for topic, online := range table.GetBatch(topics) {
+					if online != int64(len(topic)) {
+						t.Errorf("batch online of %s is %d", topic, online)
+						return
+					}
+				}
+				table.GetAll()
+			}
+		}(i)
+	}
+	wg.Wait()
+	//等待异步刷新结束
+	time.Sleep(10 * time.Millisecond)
+	if n := atomic.LoadInt64(&calls); n < 2 {
+		t.Errorf("collect called %d times, want async refreshes", n)
+	}
+}
+
+func TestOnlineTableConcurrentEviction(t *testing.T) {
+	var calls int64
+	table := newTestOnlineTable(60, 10, &calls)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				topic := fmt.Sprintf("topic/%d", (i*50+j)%100)
+				if online := table.Get(topic); online != int64(len(topic)) {
+					t.Errorf("online of %s is %d", topic, online)
+					return
+				}
+				if n := table.Len(); n > 10 {
+					t.Errorf("table len %d over max", n)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	//最近访问的留下，最久没访问的被淘汰
+	table.Get("topic/recent")
+	for i := 0; i < 9; i++ {
+		table.Get(fmt.Sprintf("topic/new/%d", i))
+	}
+	all := table.GetAll()
+	if len(all) != 10 {
+		t.Errorf("table len %d, want 10", len(all))
+	}
+	if _, ok := all["topic/recent"]; !ok {
+		t.Errorf("recent topic evicted")
+	}
+}
+
+//应答中只带新增的topic，推送方重启后重新告知
+func TestPushOnlineWants(t *testing.T) {
+	useTestOnlineCache(t)
+	t.Cleanup(func() {
+		onlineSnapshotsLock.Lock()
+		onlineSnapshots = map[string]*PeerSnapshot{}
+		onlineSnapshotsLock.Unlock()
+	})
+	onlineCache.GetTotalOnlineBatch([]string{"a", "bb"})
+
+	push := func(seq int64, base int64) []string {
+		wants, ret := ServicePushOnline(&OnlineSnapshot{Node: "peer", Seq: seq, BaseSeq: base,
+			Online: map[string]int64{"a": 1}})
+		if !ret.Ok() {
+			t.Fatalf("push seq %d failed, %s", seq, ret)
+		}
+		return wants
+	}
+	if wants := push(1, 0); len(wants) != 2 {
+		t.Errorf("first push wants %v", wants)
+	}
+	if wants := push(2, 1); len(wants) != 0 {
+		t.Errorf("delta push wants %v", wants)
+	}
+	onlineCache.GetTotalOnline("ccc")
+	if wants := push(3, 0); len(wants) != 1 || wants[0] != "ccc" {
+		t.Errorf("full push wants %v", wants)
+	}
+	//序号倒退，推送方重启过
+	if wants := push(1, 0); len(wants) != 3 {
+		t.Errorf("restarted push wants %v", wants)
+	}
+}
+
+//推送的表包含本地缓存和其它节点关心的topic
+func TestGainLocalOnlineTable(t *testing.T) {
+	useTestOnlineCache(t)
+	t.Cleanup(func() {
+		onlineWantsLock.Lock()
+		onlineWants = map[string]int64{}
+		onlineWantsLock.Unlock()
+	})
+	onlineCache.GetLocalOnline("a")
+	onlineWantsLock.Lock()
+	onlineWants["bb"] = Gtimer.Unix
+	onlineWants["old"] = 0
+	onlineWantsLock.Unlock()
+
+	table := gainLocalOnlineTable()
+	if len(table) != 2 || table["a"] != 1 || table["bb"] != 2 {
+		t.Errorf("unexpected table %v", table)
+	}
+}
+
+//来源的部分topic出错，只有这些topic沿用旧值并标记降级
+func TestOnlineSourcesPartialFailure(t *testing.T) {
+	round := int64(0)
+	collectBatch := func(topics []string) *OnlineSources {
+		round++
+		result := NewOnlineSources()
+		result.Success("local", map[string]int64{"a": 1, "bb": 1, "ccc": 1})
+		if round == 1 {
+			result.Success("peer", map[string]int64{"a": 10, "bb": 10, "ccc": 10})
+		} else {
+			//第二批请求失败
+			result.Success("peer", map[string]int64{"a": 20})
+			result.FailTopics("peer", []string{"bb", "ccc"}, "timeout")
+		}
+		return result
+	}
+	collect := func(topic string) *OnlineSources {
+		return collectBatch([]string{topic})
+	}
+	table := NewOnlineTable("test", 0, 0, collect, collectBatch)
+	topics := []string{"a", "bb", "ccc"}
+	table.refresh(topics)
+	details := table.refresh(topics)
+
+	for _, c := range []struct {
+		topic    string
+		online   int64
+		degraded bool
+	}{
+		{"a", 21, false},
+		{"bb", 11, true},
+		{"ccc", 11, true},
+	} {
+		detail := details[c.topic]
+		if detail.Online != c.online || detail.Degraded != c.degraded {
+			t.Errorf("%s: online %d degraded %v, want %d %v",
+				c.topic, detail.Online, detail.Degraded, c.online, c.degraded)
+		}
+	}
+
+	//整个来源出错后所有topic都降级
+	result := NewOnlineSources()
+	result.FailTopics("peer", []string{"a"}, "timeout")
+	result.Fail("peer", "conn refused")
+	result.FailTopics("peer", []string{"bb"}, "timeout")
+	for _, topic := range topics {
+		if reason, failed := result.failedReason("peer", topic); !failed || reason != "conn refused" {
+			t.Errorf("%s: failed %v reason %s", topic, failed, reason)
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+/**
+ * 推模式的在线人数汇总 (OnlineAggregate = "push")
+ * 1、每个provider定时把本地 topic->在线人数 推给集群内其它节点(relayList)
+ * 2、每隔 OnlinePushFullEvery 次推一次全量，其余只推变化的部分(增量)
+ *    增量带上基准序号，接收方序号对不上则要求下次推全量
+ * 3、接收方按节点保存最新快照，超过 OnlineSnapshotTimeout 没有更新的快照不再参与计算
+ * 4、总在线人数 = 本地在线人数 + 所有有效快照中该topic的人数，不再逐个topic拉取
+ * 5、应答中带上接收方关心的topic，推送方下次会统计这些topic(即使本地没有人查询过)
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	ONLINE_AGGREGATE_PULL = "pull"
+	ONLINE_AGGREGATE_PUSH = "push"
+)
+
+var (
+	onlineSnapshots     = map[string]*PeerSnapshot{}
+	onlineSnapshotsLock sync.RWMutex
+
+	//其它节点关心的topic -> 最后一次请求的时间
+	onlineWants     = map[string]int64{}
+	onlineWantsLock sync.Mutex
+
+	OnlineNodeId = ""
+)
+
+//推送的快照
+type OnlineSnapshot struct {
+	Node    string
+	Seq     int64
+	BaseSeq int64 //增量的基准序号，0 表示全量
+	Time    int64 //推送方的时间
+	Online  map[string]int64
+}
+
+//接收方保存的快照
+type PeerSnapshot struct {
+	Seq     int64
+	Time    int64 //推送方的时间
+	Receive int64 //收到的时间，用于判断是否过期
+	Online  map[string]int64
+	Wants   map[string]int64 //已告知推送方的topic -> 告知的时间
+}
+
+func OnlinePushMode() bool {
+	return configOpt.onlineAggregate == ONLINE_AGGREGATE_PUSH
+}
+
+func snapshotTimeout() int64 {
+	if configOpt.onlineSnapshotTimeout > 0 {
+		return int64(configOpt.onlineSnapshotTimeout)
+	}
+	return int64(3 * onlinePushInterval())
+}
+
+func onlinePushInterval() int {
+	if configOpt.onlinePushInterval > 0 {
+		return configOpt.onlinePushInterval
+	}
+	return 1
+}
+
+func StartOnlinePush() {
+	if !OnlinePushMode() {
+		return
+	}
+	OnlineNodeId = LocalNodeId()
+	log.Info("online aggregate by push, node: %s", OnlineNodeId)
+
+	for _, addr := range configOpt.relayList {
+		pusher := &OnlinePusher{addr: addr}
+		go pusher.loop()
+	}
+
+	go func() { //定时清理过期的快照
+		for {
+			<-time.After(time.Second * time.Duration(snapshotTimeout()))
+			cleanOnlineSnapshots()
+		}
+	}()
+}
+
+/******************** 推送方 ********************/
+
+type OnlinePusher struct {
+	addr     string
+	seq      int64
+	lastSent map[string]int64
+	count    int
+}
+
+func (p *OnlinePusher) loop() {
+	interval := time.Second * time.Duration(onlinePushInterval())
+	for {
+		<-time.After(interval)
+		p.push()
+	}
+}
+
+//本地需要推送的topic: 本地缓存中的 + 其它节点关心的
+//过期的一次批量刷新，不会一直推送缓存中的旧值
+func gainLocalOnlineTable() map[string]int64 {
+	keys := map[string]bool{}
+	for topic := range onlineCache.GetAllTotalOnline(true) {
+		keys[topic] = true
+	}
+
+	expire := Gtimer.Unix - 10*snapshotTimeout()
+	onlineWantsLock.Lock()
+	for topic, t := range onlineWants {
+		if t < expire {
+			delete(onlineWants, topic)
+			continue
+		}
+		keys[topic] = true
+	}
+	onlineWantsLock.Unlock()
+
+	topics := make([]string, 0, len(keys))
+	for topic := range keys {
+		topics = append(topics, topic)
+	}
+	return onlineCache.GetLocalOnlineBatch(topics)
+}
+
+func (p *OnlinePusher) push() {
+	table := gainLocalOnlineTable()
+
+	full := p.lastSent == nil || configOpt.onlinePushFullEvery <= 1 ||
+		p.count%configOpt.onlinePushFullEvery == 0
+	snapshot := &OnlineSnapshot{
+		Node: OnlineNodeId,
+		Seq:  p.seq + 1,
+		Time: Gtimer.Unix,
+	}
+	if full {
+		snapshot.Online = table
+	} else {
+		snapshot.BaseSeq = p.seq
+		delta := map[string]int64{}
+		for topic, online := range table {
+			if old, ok := p.lastSent[topic]; !ok || old != online {
+				delta[topic] = online
+			}
+		}
+		//消失的topic用0表示删除
+		for topic := range p.lastSent {
+			if _, ok := table[topic]; !ok {
+				delta[topic] = 0
+			}
+		}
+		snapshot.Online = delta
+	}
+
+	wants, ret := p.send(snapshot)
+	if !ret.Ok() {
+		log.Error("push online snapshot to <%s> failed, %s", p.addr, ret)
+		//对端状态未知，下次推全量
+		p.lastSent = nil
+		p.count = 0
+		return
+	}
+	p.seq = snapshot.Seq
+	p.lastSent = table
+	p.count++
+
+	now := Gtimer.Unix
+	onlineWantsLock.Lock()
+	for _, topic := range wants {
+		onlineWants[topic] = now
+	}
+	onlineWantsLock.Unlock()
+}
+
+func (p *OnlinePusher) send(snapshot *OnlineSnapshot) ([]string, Error) {
+	//优先使用长连接
+	if link := GetPeerLink(p.addr, configOpt.relayInvoker); link != nil && link.Connected() {
+		return link.PushOnline(snapshot)
+	}
+
+	jstr, _ := json.Marshal(snapshot)
+	key, ok := getInvokerKey(configOpt.relayInvoker)
+	if !ok {
+		return nil, NewError(INVALID_PARAM, nil, "invalid invoker")
+	}
+	headerMap := map[string]string{
+		configOpt.requestInvokerKey: configOpt.relayInvoker,
+		configOpt.requestSignKey:    Md5Sig(string(jstr), configOpt.relayInvoker, key),
+	}
+
+	httpUrl := fmt.Sprintf("http://%s%s", p.addr, configOpt.urlPushOnline)
+	data, ret := HttpPostJson(httpUrl, headerMap, snapshot, configOpt.httpRpcTimeout)
+	if !ret.Ok() {
+		return nil, ret
+	}
+	data, ret = TransProviderResult(data)
+	if !ret.Ok() {
+		return nil, ret
+	}
+	wants := []string{}
+	if list, ok := data["wants"].([]interface{}); ok {
+		for _, v := range list {
+			if topic, ok := v.(string); ok {
+				wants = append(wants, topic)
+			}
+		}
+	}
+	return wants, OK
+}
+
+/******************** 接收方 ********************/
+
+//保存收到的快照，返回本节点关心的topic
+func ServicePushOnline(snapshot *OnlineSnapshot) ([]string, Error) {
+	if len(snapshot.Node) == 0 {
+		return nil, NewError(INVALID_PARAM, nil, "invalid node")
+	}
+
+	onlineSnapshotsLock.Lock()
+	old, ok := onlineSnapshots[snapshot.Node]
+	if snapshot.BaseSeq == 0 {
+		full := &PeerSnapshot{Online: map[string]int64{}, Wants: map[string]int64{}}
+		for topic, online := range snapshot.Online {
+			full.Online[topic] = online
+		}
+		//序号没有倒退说明推送方没有重启，已告知的topic它还记得
+		if ok && snapshot.Seq > old.Seq {
+			full.Wants = old.Wants
+		}
+		old = full
+		onlineSnapshots[snapshot.Node] = old
+	} else {
+		if !ok || old.Seq != snapshot.BaseSeq {
+			onlineSnapshotsLock.Unlock()
+			return nil, NewError(INVALID_PARAM, nil, "need full snapshot")
+		}
+		for topic, online := range snapshot.Online {
+			if online == 0 {
+				delete(old.Online, topic)
+			} else {
+				old.Online[topic] = online
+			}
+		}
+	}
+	old.Seq = snapshot.Seq
+	old.Time = snapshot.Time
+	old.Receive = Gtimer.Unix
+
+	//只返回新增的topic，推送方保留 10*OnlineSnapshotTimeout，过半后再告知一次
+	wants := []string{}
+	now := Gtimer.Unix
+	renew := now - 5*snapshotTimeout()
+	for topic := range onlineCache.GetAllTotalOnline(false) {
+		if t, ok := old.Wants[topic]; ok && t > renew {
+			continue
+		}
+		old.Wants[topic] = now
+		wants = append(wants, topic)
+	}
+	onlineSnapshotsLock.Unlock()
+	return wants, OK
+}
+
+func cleanOnlineSnapshots() {
+	expire := Gtimer.Unix - snapshotTimeout()
+
+	onlineSnapshotsLock.Lock()
+	defer onlineSnapshotsLock.Unlock()
+	for node, snapshot := range onlineSnapshots {
+		if snapshot.Receive < expire {
+			log.Warning("online snapshot of <%s> expired, last receive: %d", node, snapshot.Receive)
+			delete(onlineSnapshots, node)
+		}
+	}
+}
+
+//推模式下的总在线人数，每个节点的快照作为一个来源
+func CollectPushedOnline(topics []string) *OnlineSources {
+	result := NewOnlineSources()
+	collectLocalSource(result, topics)
+	expire := Gtimer.Unix - snapshotTimeout()
+
+	onlineSnapshotsLock.RLock()
+	for node, snapshot := range onlineSnapshots {
+		if snapshot.Receive < expire {
+			result.Fail(node, "snapshot expired")
+			continue
+		}
+		onlines := make(map[string]int64, len(topics))
+		for _, topic := range topics {
+			onlines[topic] = snapshot.Online[topic]
+		}
+		result.Success(node, onlines)
+	}
+	if len(onlineSnapshots) < len(configOpt.relayList) {
+		result.Fail("push", fmt.Sprintf("%d/%d snapshots received",
+			len(onlineSnapshots), len(configOpt.relayList)))
+	}
+	onlineSnapshotsLock.RUnlock()
+
+	return result
+}
+
+//各节点快照的状态
+func GetOnlineSnapshotStats() Dict {
+	onlineSnapshotsLock.RLock()
+	defer onlineSnapshotsLock.RUnlock()
+
+	stats := Dict{}
+	for node, snapshot := range onlineSnapshots {
+		stats[node] = Dict{
+			"seq":     snapshot.Seq,
+			"time":    snapshot.Time,
+			"receive": snapshot.Receive,
+			"stale":   Gtimer.Unix - snapshot.Receive,
+			"topics":  len(snapshot.Online),
+		}
+	}
+	return stats
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"io"
 	"net"
 )
 
@@ -15,6 +16,9 @@ const (
 	RPC_PURE_PUB = 0x50 //只推送消息 不发送推送列表
 	RPC_TONC     = 0x60 //统计在线用户
 	RPC_TONC_ACK = 0x70 //统计在线用户答复
+
+	RPC_TONC_MULTI     = 0x80 //批量统计多个主题的在线用户
+	RPC_TONC_MULTI_ACK = 0x90 //批量统计答复，按请求顺序每个主题4字节
 )
 
 type Packet struct {
@@ -106,7 +110,8 @@ func ReceivePacket(conn net.Conn) (*Packet, error) {
 	if packet.remainLength > 0 {
 		packet.body = make([]byte, packet.remainLength)
 
-		if _, err := conn.Read(packet.body); err != nil {
+		//批量应答可能较大，需要读满
+		if _, err := io.ReadFull(conn, packet.body); err != nil {
 			return nil, err
 		}
 	}
@@ -193,3 +198,23 @@ func GainQueryOnlinePacket(topic string) *Packet {
 	packet.writeString(topic, len(topic))
 	return packet
 }
+
+//批量统计: 2字节主题个数 + 多个(2字节长度 + 主题)
+func GainQueryMultiOnlinePacket(topics []string) *Packet {
+
+	remainLength := 2
+	for _, topic := range topics {
+		remainLength += 2 + len(topic)
+	}
+
+	packet := NewPacket(uint32(remainLength))
+	packet.remainLength = uint32(remainLength)
+	packet.command = RPC_TONC_MULTI
+	packet.fixHeader = packet.command
+
+	packet.writeInt16(uint16(len(topics)))
+	for _, topic := range topics {
+		packet.writeString(topic, len(topic))
+	}
+	return packet
+}
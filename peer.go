@@ -0,0 +1,423 @@
+package main
+
+/**
+ * relay/bridge 转发到其它provider的可靠投递
+ * 1、每个对端一个发送队列和一个发送协程，保证同一对端的消息顺序
+ * 2、发送失败后整个队列按指数退避暂停，恢复后先重试队头的消息，成功后继续发送后面的
+ *    连不上对端时一直重试到消息生命周期结束，其它错误超过最大重试次数丢弃
+ * 3、每次发送前用剩余生命周期作为对端的ttl，并重新签名
+ * 4、配置了spool目录时，入队的消息先写入磁盘，发送完成后标记删除
+ *    重启后重新加载未完成且未过期的消息
+ *    入队记录和压缩后的文件会fsync，完成标记不fsync，掉电后可能重复投递
+ */
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	peerQueues    = map[string]*PeerQueue{}
+	peerQueueLock sync.Mutex
+)
+
+type PeerJob struct {
+	Id      string
+	Url     string
+	Invoker string
+	PubTime int64
+	Tries   int
+	Pub     *PublishForm
+}
+
+type PeerStat struct {
+	Queued  int64
+	Sent    int64
+	Retried int64
+	Dropped int64
+}
+
+type PeerQueue struct {
+	addr     string
+	jobs     chan *PeerJob
+	spool    *PeerSpool
+	stat     PeerStat
+	failures int //连续失败次数，只在发送协程中使用
+}
+
+func GetPeerQueue(addr string) *PeerQueue {
+	peerQueueLock.Lock()
+	defer peerQueueLock.Unlock()
+
+	queue, ok := peerQueues[addr]
+	if ok {
+		return queue
+	}
+
+	size := configOpt.peerQueueSize
+	if size <= 0 {
+		size = 1000
+	}
+	queue = &PeerQueue{
+		addr: addr,
+		jobs: make(chan *PeerJob, size),
+	}
+	if len(configOpt.peerSpoolDir) > 0 {
+		queue.spool = OpenPeerSpool(configOpt.peerSpoolDir, addr)
+	}
+	peerQueues[addr] = queue
+
+	if queue.spool != nil {
+		for _, job := range queue.spool.Load() {
+			queue.enqueue(job, false)
+		}
+	}
+	go queue.loop()
+	return queue
+}
+
+//启动时加载所有对端未完成的消息
+func StartPeerQueues() {
+	for _, addr := range configOpt.relayList {
+		GetPeerQueue(addr)
+	}
+	for _, addr := range configOpt.bridgeList {
+		GetPeerQueue(addr)
+	}
+}
+
+func (p *PeerQueue) Put(pub *PublishForm, invoker string, url string) {
+	job := &PeerJob{
+		Id:      NewUuid(true),
+		Url:     url,
+		Invoker: invoker,
+		PubTime: pub.PubTime,
+		Pub:     pub,
+	}
+	if job.PubTime == 0 {
+		job.PubTime = Gtimer.Unix
+	}
+	p.enqueue(job, true)
+}
+
+func (p *PeerQueue) enqueue(job *PeerJob, spool bool) {
+	//先落盘再入队，防止发送协程先完成
+	if spool && p.spool != nil {
+		p.spool.Add(job)
+	}
+	select {
+	case p.jobs <- job:
+		atomic.AddInt64(&p.stat.Queued, 1)
+	default:
+		atomic.AddInt64(&p.stat.Dropped, 1)
+		log.Error("peer<%s> queue full, drop<%s>", p.addr, job.Pub.UpstreamId)
+		if p.spool != nil {
+			p.spool.Done(job)
+		}
+	}
+}
+
+func (p *PeerQueue) loop() {
+	for job := range p.jobs {
+		p.deliver(job)
+		if p.spool != nil {
+			p.spool.Done(job)
+			if len(p.jobs) == 0 {
+				p.spool.Compact()
+			}
+		}
+	}
+}
+
+//剩余生命周期，<=0 表示已经过期
+func (job *PeerJob) remainTtl() int {
+	return int(job.PubTime + int64(job.Pub.Ttl) - Gtimer.Unix)
+}
+
+func peerBackoff(tries int) time.Duration {
+	base := time.Duration(configOpt.peerRetryInterval) * time.Millisecond
+	if base <= 0 {
+		base = 200 * time.Millisecond
+	}
+	max := time.Duration(configOpt.peerRetryMaxInterval) * time.Millisecond
+	if max <= 0 {
+		max = 5 * time.Second
+	}
+	delay := base << uint(tries-1)
+	if delay > max || delay <= 0 {
+		delay = max
+	}
+	return delay
+}
+
+func (p *PeerQueue) deliver(job *PeerJob) {
+	for {
+		if job.remainTtl() <= 0 {
+			atomic.AddInt64(&p.stat.Dropped, 1)
+			log.Error("publish to provider:<%s> to <%s> expired after %d tries",
+				job.Pub.UpstreamId, p.addr, job.Tries)
+			return
+		}
+		//对端连续失败时整个队列暂停，过期的消息不用等待直接丢弃
+		if p.failures > 0 {
+			time.Sleep(peerBackoff(p.failures))
+		}
+		remain := job.remainTtl()
+		if remain <= 0 {
+			continue
+		}
+
+		job.Tries++
+		ret := p.send(job, remain)
+		if ret.Ok() {
+			p.failures = 0
+			atomic.AddInt64(&p.stat.Sent, 1)
+			log.Info("publish provider:<%s> to <%s> success", job.Pub.UpstreamId, p.addr)
+			return
+		}
+		log.Error("publish to provider:<%s> to <%s> failed(%d), %s",
+			job.Pub.UpstreamId, p.addr, job.Tries, ret)
+
+		//签名、参数错误重试也不会成功
+		if ret.Code == INVALID_PARAM || ret.Code == NO_PERM {
+			atomic.AddInt64(&p.stat.Dropped, 1)
+			return
+		}
+		p.failures++
+		//连不上对端时消息本身没有问题，不计入最大重试次数
+		if ret.Code != REMOTE_CONN_ERR && job.Tries > configOpt.peerMaxRetry {
+			atomic.AddInt64(&p.stat.Dropped, 1)
+			return
+		}
+		atomic.AddInt64(&p.stat.Retried, 1)
+	}
+}
+
+func (p *PeerQueue) send(job *PeerJob, remain int) Error {
+	pub := *job.Pub
+	pub.Ttl = remain
+
+	//优先使用长连接
+	if link := GetPeerLink(p.addr, job.Invoker); link != nil && link.Connected() {
+		kind := LINK_KIND_RELAY
+		if job.Url == configOpt.urlBridgePublish {
+			kind = LINK_KIND_BRIDGE
+		}
+		return link.Publish(kind, &pub)
+	}
+
+	headerMap, ret := signProviderRequest(&pub, job.Invoker)
+	if !ret.Ok() {
+		return ret
+	}
+
+	httpUrl := fmt.Sprintf("http://%s%s", p.addr, job.Url)
+	data, ret := HttpPostJson(httpUrl, headerMap, &pub, configOpt.httpRpcTimeout)
+	if !ret.Ok() {
+		return ret
+	}
+	_, ret = TransProviderResult(data)
+	return ret
+}
+
+func GetPeerStats() Dict {
+	peerQueueLock.Lock()
+	defer peerQueueLock.Unlock()
+
+	stats := Dict{}
+	for addr, queue := range peerQueues {
+		stats[addr] = Dict{
+			"pending": len(queue.jobs),
+			"queued":  atomic.LoadInt64(&queue.stat.Queued),
+			"sent":    atomic.LoadInt64(&queue.stat.Sent),
+			"retried": atomic.LoadInt64(&queue.stat.Retried),
+			"dropped": atomic.LoadInt64(&queue.stat.Dropped),
+		}
+	}
+	return stats
+}
+
+/**
+ * 磁盘spool，每个对端一个文件，每行一条记录
+ * + {job json}  入队
+ * - id          完成(发送成功或丢弃)
+ */
+type PeerSpool struct {
+	path    string
+	fp      *os.File
+	pending map[string]*PeerJob
+	records int //文件中的记录数
+	lock    sync.Mutex
+}
+
+func OpenPeerSpool(dir string, addr string) *PeerSpool {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Error("create spool dir<%s> failed, %v", dir, err)
+		return nil
+	}
+	name := strings.Replace(strings.Replace(addr, ":", "_", -1), "/", "_", -1)
+	spool := &PeerSpool{
+		path:    filepath.Join(dir, name+".spool"),
+		pending: map[string]*PeerJob{},
+	}
+	spool.read()
+
+	fp, err := os.OpenFile(spool.path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		log.Error("open spool<%s> failed, %v", spool.path, err)
+		return nil
+	}
+	spool.fp = fp
+	return spool
+}
+
+func (p *PeerSpool) read() {
+	fp, err := os.Open(p.path)
+	if err != nil {
+		return
+	}
+	defer fp.Close()
+
+	scanner := bufio.NewScanner(fp)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if len(line) < 2 {
+			continue
+		}
+		switch line[0] {
+		case '+':
+			job := &PeerJob{}
+			if err := json.Unmarshal([]byte(line[2:]), job); err != nil || job.Pub == nil {
+				continue
+			}
+			p.pending[job.Id] = job
+		case '-':
+			delete(p.pending, line[2:])
+		}
+	}
+}
+
+//加载未完成且未过期的消息，按发布时间排序
+func (p *PeerSpool) Load() []*PeerJob {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	jobs := []*PeerJob{}
+	for id, job := range p.pending {
+		if job.remainTtl() <= 0 {
+			delete(p.pending, id)
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	for i := 1; i < len(jobs); i++ {
+		for j := i; j > 0 && jobs[j].PubTime < jobs[j-1].PubTime; j-- {
+			jobs[j], jobs[j-1] = jobs[j-1], jobs[j]
+		}
+	}
+	log.Info("load %d jobs from spool<%s>", len(jobs), p.path)
+	p.compact()
+	return jobs
+}
+
+func (p *PeerSpool) write(line string) {
+	if p.fp == nil {
+		return
+	}
+	if _, err := p.fp.WriteString(line + "\n"); err != nil {
+		log.Error("write spool<%s> failed, %v", p.path, err)
+	}
+}
+
+func (p *PeerSpool) Add(job *PeerJob) {
+	jstr, err := json.Marshal(job)
+	if err != nil {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.pending[job.Id] = job
+	p.records++
+	p.write("+ " + string(jstr))
+	p.sync()
+}
+
+func (p *PeerSpool) sync() {
+	if p.fp == nil {
+		return
+	}
+	if err := p.fp.Sync(); err != nil {
+		log.Error("sync spool<%s> failed, %v", p.path, err)
+	}
+}
+
+func (p *PeerSpool) Done(job *PeerJob) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if _, ok := p.pending[job.Id]; !ok {
+		return
+	}
+	delete(p.pending, job.Id)
+	p.records++
+	p.write("- " + job.Id)
+}
+
+//记录数过多时压缩
+func (p *PeerSpool) Compact() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.records < 1000 {
+		return
+	}
+	p.compact()
+}
+
+//用未完成的记录重写spool文件
+func (p *PeerSpool) compact() {
+	tmp := p.path + ".tmp"
+	fp, err := os.OpenFile(tmp, os.O_RDWR|os.O_TRUNC|os.O_CREATE, 0644)
+	if err != nil {
+		log.Error("compact spool<%s> failed, %v", p.path, err)
+		return
+	}
+	for _, job := range p.pending {
+		jstr, err := json.Marshal(job)
+		if err != nil {
+			continue
+		}
+		fp.WriteString("+ " + string(jstr) + "\n")
+	}
+	//先落盘再替换，掉电后不会只剩下空文件
+	if err := fp.Sync(); err != nil {
+		log.Error("sync spool<%s> failed, %v", tmp, err)
+	}
+	fp.Close()
+	p.records = len(p.pending)
+
+	if err := os.Rename(tmp, p.path); err != nil {
+		log.Error("compact spool<%s> failed, %v", p.path, err)
+		return
+	}
+	if dir, err := os.Open(filepath.Dir(p.path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	if p.fp != nil {
+		p.fp.Close()
+	}
+	p.fp, err = os.OpenFile(p.path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		log.Error("open spool<%s> failed, %v", p.path, err)
+		p.fp = nil
+	}
+}
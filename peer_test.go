@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//对端down时直接断开连接，记录每次请求的消息
+type stubRelayPeer struct {
+	server   *httptest.Server
+	down     int32
+	lock     sync.Mutex
+	failed   []string //down期间收到的消息
+	received []string
+}
+
+func newStubRelayPeer(t *testing.T) *stubRelayPeer {
+	p := &stubRelayPeer{}
+	p.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		pub := &PublishForm{}
+		json.Unmarshal(body, pub)
+
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		if atomic.LoadInt32(&p.down) == 1 {
+			p.failed = append(p.failed, pub.UpstreamId)
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		p.received = append(p.received, pub.UpstreamId)
+		w.Write([]byte(`{"err_code": 200, "err_msg": "", "data": {}}`))
+	}))
+	t.Cleanup(p.server.Close)
+	return p
+}
+
+func usePeerQueueConfig(t *testing.T) {
+	saved := []int{configOpt.peerMaxRetry, configOpt.peerRetryInterval,
+		configOpt.peerRetryMaxInterval, configOpt.httpRpcTimeout}
+	savedInvokers := configOpt.invokerMap
+	savedKeys := []string{configOpt.requestInvokerKey, configOpt.requestSignKey}
+	t.Cleanup(func() {
+		configOpt.peerMaxRetry, configOpt.peerRetryInterval = saved[0], saved[1]
+		configOpt.peerRetryMaxInterval, configOpt.httpRpcTimeout = saved[2], saved[3]
+		configOpt.invokerMap = savedInvokers
+		configOpt.requestInvokerKey, configOpt.requestSignKey = savedKeys[0], savedKeys[1]
+	})
+	configOpt.peerMaxRetry = 1
+	configOpt.peerRetryInterval = 20
+	configOpt.peerRetryMaxInterval = 80
+	configOpt.httpRpcTimeout = 2
+	configOpt.invokerMap = map[string]interface{}{
+		testLinkInvoker: map[string]interface{}{"key": testLinkKey},
+	}
+	configOpt.requestInvokerKey = "BUGLE-INVOKER"
+	configOpt.requestSignKey = "BUGLE-SIGN"
+}
+
+//连不上对端时整个队列暂停，只重试队头的消息，恢复后按顺序发送，不计入最大重试次数
+func TestPeerQueuePauseOnConnError(t *testing.T) {
+	usePeerQueueConfig(t)
+	peer := newStubRelayPeer(t)
+	atomic.StoreInt32(&peer.down, 1)
+
+	addr := strings.TrimPrefix(peer.server.URL, "http://")
+	queue := GetPeerQueue(addr)
+	t.Cleanup(func() {
+		peerQueueLock.Lock()
+		delete(peerQueues, addr)
+		peerQueueLock.Unlock()
+		close(queue.jobs)
+	})
+
+	ids := []string{"m0", "m1", "m2", "m3", "m4"}
+	for _, id := range ids {
+		queue.Put(&PublishForm{Topic: "live/a", Msg: id, UpstreamId: id, Ttl: 60}, testLinkInvoker, "/relay")
+	}
+	time.Sleep(400 * time.Millisecond)
+	atomic.StoreInt32(&peer.down, 0)
+
+	for i := 0; i < 100 && atomic.LoadInt64(&queue.stat.Sent) < int64(len(ids)); i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	peer.lock.Lock()
+	defer peer.lock.Unlock()
+	if strings.Join(peer.received, ",") != strings.Join(ids, ",") {
+		t.Errorf("received %v, want %v", peer.received, ids)
+	}
+	//指数退避: 400ms内最多 20+40+80+80+80+80 ms 的间隔
+	if len(peer.failed) < 2 || len(peer.failed) > 8 {
+		t.Errorf("%d attempts while peer down", len(peer.failed))
+	}
+	for _, id := range peer.failed {
+		if id != "m0" {
+			t.Errorf("attempts while down %v, want only the head message", peer.failed)
+			break
+		}
+	}
+	if n := atomic.LoadInt64(&queue.stat.Dropped); n != 0 {
+		t.Errorf("%d messages dropped", n)
+	}
+}
+
+//其它错误超过最大重试次数丢弃，接着发送后面的消息
+func TestPeerQueueDropAfterMaxRetry(t *testing.T) {
+	usePeerQueueConfig(t)
+	var calls int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&calls, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	t.Cleanup(server.Close)
+
+	addr := strings.TrimPrefix(server.URL, "http://")
+	queue := GetPeerQueue(addr)
+	t.Cleanup(func() {
+		peerQueueLock.Lock()
+		delete(peerQueues, addr)
+		peerQueueLock.Unlock()
+		close(queue.jobs)
+	})
+	queue.Put(&PublishForm{Topic: "live/a", UpstreamId: "m0", Ttl: 60}, testLinkInvoker, "/relay")
+	queue.Put(&PublishForm{Topic: "live/a", UpstreamId: "m1", Ttl: 60}, testLinkInvoker, "/relay")
+
+	for i := 0; i < 100 && atomic.LoadInt64(&queue.stat.Dropped) < 2; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if n := atomic.LoadInt64(&queue.stat.Dropped); n != 2 {
+		t.Errorf("%d messages dropped, want 2", n)
+	}
+	if n := atomic.LoadInt64(&calls); n != 4 {
+		t.Errorf("peer called %d times, want 4", n)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"flag"
 	"fmt"
+	"os"
 	"runtime"
 
 	"github.com/op/go-logging"
@@ -25,6 +26,10 @@ func main() {
 	flag.Parse()
 	ParseConfig(*CONFIG_PATH, &configOpt)
 	fmt.Printf("%+v\n", configOpt)
+	if err := CheckConfig(&configOpt); err != nil {
+		fmt.Printf("invalid config, %v\n", err)
+		os.Exit(1)
+	}
 
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
@@ -37,8 +42,15 @@ func main() {
 	InitLogger(configOpt.logPath, logLevel)
 
 	SetMaxPublishCount(configOpt.publishMaxCount)
+	SetPublishQueue(configOpt.publishQueueCapacity, configOpt.publishQueueOverflow)
 	SetMaxPublishQps(configOpt.publishMaxQps)
 	SetMaxPublishWeight(configOpt.publishMaxWeight)
+	SetMaxPublishTtl(configOpt.publishMaxTtl)
+	InitPublishTtlMap(configOpt.ttlMap)
+	InitTopicLimitMap(configOpt.limitMap)
+	InitBackendOperators(configOpt.operatorMap)
+	SetDedupWindow(configOpt.publishDedupWindow)
+	SetPublishScheduler(configOpt.publishSchedule, configOpt.publishDrrQuantum)
 
 	//明确指定-p参数，使用-p, 否则仍然读配置文件
 	if *CONFIG_PORT > 0 {
@@ -46,13 +58,22 @@ func main() {
 	}
 
 	InitOnlineDecorteMap(configOpt.decorateMap)
+	LoadDecorateStore()
 	CreateOnlineCache()
 
 	Gtimer = NewTimer()
 	Gtimer.Start()
 	StartPublishConsumerLoop(configOpt.publishMaxMulti)
+	StartPeerQueues()
 
 	brokerPool = NewBrokerPool(configOpt.brokerPoolMax, configOpt.brokerTimeout)
+	StartPeerLinkServer()
+	StartOnlinePush()
+	StartOnlineHistory()
+	StartOnlineStream()
+	StartSubscribe()
+	StartTopicRegistry()
+	StartDecorateSync()
 
 	log.Debug("----------begin---------")
 	web.Get(configOpt.urlToken, DoneToken)
@@ -62,17 +83,46 @@ func main() {
 	web.Get(configOpt.urlToken, DoneToken)
 	web.Post(configOpt.urlPublish, DonePublish)
 
+	if len(configOpt.urlOnlineBatch) > 0 {
+		web.Get(configOpt.urlOnlineBatch, DoneGetOnlineBatch)
+		web.Post(configOpt.urlOnlineBatch, DoneGetOnlineBatch)
+	}
+	if len(configOpt.urlOnlineStream) > 0 {
+		web.Get(configOpt.urlOnlineStream, DoneOnlineStream)
+	}
+	if len(configOpt.urlSubscribe) > 0 {
+		web.Get(configOpt.urlSubscribe, DoneSubscribe)
+	}
+
 	/**聊天室内部转发相关接口*/
 	web.Post(configOpt.urlCollectOnline, DoneCollectLocalOnline)
 	web.Post(configOpt.urlRelayPublish, DoneRelayPublish)
 	web.Post(configOpt.urlBridgePublish, DoneBridgePublish)
+	if len(configOpt.urlPushOnline) > 0 {
+		web.Post(configOpt.urlPushOnline, DonePushOnline)
+	}
+	if len(configOpt.urlSyncDecorate) > 0 {
+		web.Post(configOpt.urlSyncDecorate, DoneSyncDecorate)
+	}
+	if len(configOpt.urlPullDecorate) > 0 {
+		web.Post(configOpt.urlPullDecorate, DonePullDecorate)
+	}
 
 	/**后端控制接口*/
 	web.Get("/provider/v1/backend/online", DoneGetPureOnline)
 	web.Get("/provider/v1/backend/decorate", DoneGetDecorate)
 	web.Post("/provider/v1/backend/decorate", DoneSetDecorate)
+	web.Delete("/provider/v1/backend/decorate", DoneDeleteDecorate)
+	web.Get("/provider/v1/backend/decorate/export", DoneExportDecorate)
+	web.Post("/provider/v1/backend/decorate/import", DoneImportDecorate)
 
 	web.Get("/provider/v1/backend/online/all", DoneGetAllPureOnline)
+	web.Get("/provider/v1/backend/online/snapshot", DoneGetOnlineSnapshot)
+	web.Get("/provider/v1/backend/online/history", DoneGetOnlineHistory)
+	web.Get("/provider/v1/backend/online/peak", DoneGetOnlinePeak)
+	web.Get("/provider/v1/backend/online/top", DoneGetOnlineTop)
+	web.Get("/provider/v1/backend/publish/stat", DoneGetPublishStat)
+	web.Get("/provider/v1/backend/health", DoneGetHealth)
 
 	listen := fmt.Sprintf("0.0.0.0:%d", configOpt.listenPort)
 	web.Config.Profiler = configOpt.enableOnlinePprof
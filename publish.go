@@ -2,12 +2,82 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
+	"sync/atomic"
 )
 
+var (
+	LoopCount      int64 = 0 //重复经过本集群被丢弃的消息数
+	HopExceedCount int64 = 0 //超过最大转发次数被丢弃的消息数
+)
+
+//本集群产生的消息，记录来源，忽略调用方传入的转发信息
+func MarkPublishOrigin(pub *PublishForm) {
+	pub.Origin = configOpt.clusterId
+	pub.Hops = 0
+	pub.Visited = nil
+	if len(configOpt.clusterId) > 0 {
+		pub.Visited = []string{configOpt.clusterId}
+	}
+}
+
+func hasVisited(pub *PublishForm, cluster string) bool {
+	for _, v := range pub.Visited {
+		if v == cluster {
+			return true
+		}
+	}
+	return false
+}
+
+//检查转发过来的消息是否形成环路
+//bridge: 已经经过本集群的消息丢弃
+//relay:  只接收本集群内转发的消息，最后经过的集群必须是本集群
+func CheckPublishLoop(pub *PublishForm, bridge bool) bool {
+	if configOpt.publishMaxHops > 0 && pub.Hops > configOpt.publishMaxHops {
+		atomic.AddInt64(&HopExceedCount, 1)
+		log.Error("消息<%s> 转发次数<%d>超限, origin:%s, visited:%v",
+			pub.UpstreamId, pub.Hops, pub.Origin, pub.Visited)
+		return false
+	}
+
+	cluster := configOpt.clusterId
+	if len(cluster) == 0 || len(pub.Visited) == 0 {
+		return true
+	}
+
+	loop := false
+	if bridge {
+		loop = hasVisited(pub, cluster)
+	} else {
+		loop = pub.Visited[len(pub.Visited)-1] != cluster
+	}
+	if loop {
+		atomic.AddInt64(&LoopCount, 1)
+		log.Error("消息<%s> 出现环路, bridge:%v, origin:%s, hops:%d, visited:%v",
+			pub.UpstreamId, bridge, pub.Origin, pub.Hops, pub.Visited)
+		return false
+	}
+	return true
+}
+
+//桥接进入本集群，记录经过的集群
+func MarkPublishVisited(pub *PublishForm) {
+	if len(configOpt.clusterId) > 0 {
+		pub.Visited = append(pub.Visited, configOpt.clusterId)
+	}
+}
+
+func GetLoopStats() Dict {
+	return Dict{
+		"loop":       atomic.LoadInt64(&LoopCount),
+		"hop_exceed": atomic.LoadInt64(&HopExceedCount),
+	}
+}
+
 //将消息发到本节点的broker
 func PushToLocal(pub *PublishForm) Error {
 	pub.PubTime = Gtimer.Unix
+	topicRegistry.Touch(pub.Topic)
 	CollectPublish(pub, false)
 	return OK
 }
@@ -31,18 +101,38 @@ func BridgeBetweenCluster(pub *PublishForm) Error {
 }
 
 //将消息发送到其它provider
-func providerToRemote(pub *PublishForm,
+func providerToRemote(origin *PublishForm,
 	invoker string, url string, providerList []string) Error {
+	if _, ret := signProviderRequest(origin, invoker); !ret.Ok() {
+		return ret
+	}
+
+	//转发的是副本，转发次数+1，对端不再桥接
+	fwd := *origin
+	fwd.Hops++
+	fwd.Bridge = false
+	fwd.Visited = append([]string{}, origin.Visited...)
+
+	//放入对端的发送队列，由发送协程负责重试
+	for _, addr := range providerList {
+		GetPeerQueue(addr).Put(&fwd, invoker, url)
+	}
+
+	return OK
+}
+
+//对请求体签名，返回请求头
+func signProviderRequest(pub *PublishForm, invoker string) (map[string]string, Error) {
 	jstr, _ := json.Marshal(pub)
 	dict, ok := configOpt.invokerMap[invoker].(map[string]interface{})
 	if !ok {
 		log.Error("invalid invoker:%s", invoker)
-		return NewError(INVALID_PARAM, nil, "invalid invoker")
+		return nil, NewError(INVALID_PARAM, nil, "invalid invoker")
 	}
 	key, ok := dict["key"].(string)
 	if !ok {
 		log.Error("invalid invoker:%s", invoker)
-		return NewError(INVALID_PARAM, nil, "invalid invoker")
+		return nil, NewError(INVALID_PARAM, nil, "invalid invoker")
 	}
 
 	sig := Md5Sig(string(jstr), invoker, key)
@@ -51,29 +141,5 @@ func providerToRemote(pub *PublishForm,
 		configOpt.requestInvokerKey: invoker,
 		configOpt.requestSignKey:    sig,
 	}
-
-	goProviderPublish(pub, headerMap, url, providerList)
-
-	return OK
-}
-
-func goProviderPublish(pub *PublishForm, headerMap map[string]string,
-	url string, providerList []string) {
-	for _, addrStr := range providerList {
-		go func(addr string) {
-			httpUrl := fmt.Sprintf("http://%s%s", addr, url)
-			data, ret := HttpPostJson(httpUrl, headerMap, pub, configOpt.httpRpcTimeout)
-			if !ret.Ok() {
-				log.Error("publish to provider:<%s> to <%s> failed, %s", pub.UpstreamId, addr, ret)
-				return
-			}
-			_, ret = TransProviderResult(data)
-			if !ret.Ok() {
-				log.Error("publish to provider:<%s> to <%s> failed, %s", pub.UpstreamId, addr, ret)
-			} else {
-				log.Info("publish provider:<%s> to <%s> success", pub.UpstreamId, addr)
-			}
-		}(addrStr)
-
-	}
+	return headerMap, OK
 }
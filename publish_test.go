@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCheckPublishLoop(t *testing.T) {
+	savedCluster, savedHops := configOpt.clusterId, configOpt.publishMaxHops
+	t.Cleanup(func() {
+		configOpt.clusterId, configOpt.publishMaxHops = savedCluster, savedHops
+	})
+
+	for _, c := range []struct {
+		name    string
+		cluster string
+		maxHops int
+		bridge  bool
+		hops    int
+		visited []string
+		ok      bool
+	}{
+		{"bridge from other cluster", "c1", 4, true, 1, []string{"c2"}, true},
+		{"bridge through other clusters", "c1", 4, true, 2, []string{"c2", "c3"}, true},
+		{"bridge back to origin", "c1", 4, true, 2, []string{"c1", "c2"}, false},
+		{"bridge back to middle", "c1", 4, true, 3, []string{"c2", "c1", "c3"}, false},
+		{"relay inside cluster", "c1", 4, false, 1, []string{"c1"}, true},
+		{"relay after bridge in", "c1", 4, false, 2, []string{"c2", "c1"}, true},
+		{"relay from other cluster", "c1", 4, false, 1, []string{"c2"}, false},
+		{"relay passed through but not last", "c1", 4, false, 2, []string{"c1", "c2"}, false},
+		{"no cluster id", "", 4, true, 1, []string{"c1"}, true},
+		{"old provider without visited", "c1", 4, true, 1, nil, true},
+		{"hops at limit", "c1", 4, true, 4, []string{"c2"}, true},
+		{"hops over limit", "c1", 4, true, 5, []string{"c2"}, false},
+		{"hops over limit without cluster id", "", 4, false, 5, nil, false},
+		{"no hop limit", "c1", 0, true, 100, []string{"c2"}, true},
+	} {
+		configOpt.clusterId = c.cluster
+		configOpt.publishMaxHops = c.maxHops
+		pub := &PublishForm{UpstreamId: "id", Topic: "live/a", Hops: c.hops, Visited: c.visited}
+		if ok := CheckPublishLoop(pub, c.bridge); ok != c.ok {
+			t.Errorf("%s: got %v, want %v", c.name, ok, c.ok)
+		}
+	}
+}
+
+//本集群产生的消息忽略调用方传入的转发信息，桥接进入时记录经过的集群
+func TestMarkPublishOrigin(t *testing.T) {
+	savedCluster := configOpt.clusterId
+	t.Cleanup(func() { configOpt.clusterId = savedCluster })
+	configOpt.clusterId = "c1"
+
+	pub := &PublishForm{Origin: "c9", Hops: 3, Visited: []string{"c9", "c1"}}
+	MarkPublishOrigin(pub)
+	if pub.Origin != "c1" || pub.Hops != 0 || len(pub.Visited) != 1 || pub.Visited[0] != "c1" {
+		t.Errorf("marked origin %+v", pub)
+	}
+
+	configOpt.clusterId = "c2"
+	MarkPublishVisited(pub)
+	if !CheckPublishLoop(pub, false) || CheckPublishLoop(pub, true) {
+		t.Errorf("visited %v: relay should pass and bridge back should loop", pub.Visited)
+	}
+}
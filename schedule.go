@@ -0,0 +1,215 @@
+package main
+
+/**
+ * 推送队列的调度策略
+ * strict: 严格优先级，每次从最高权重的非空队列取消息（低权重消息可能被饿死）
+ * wrr:    加权轮询，每轮权重为w的队列最多取w条消息
+ * drr:    差额轮询，每轮权重为w的队列获得 w*quantum 字节额度，按消息长度扣减
+ * 调度器只在 PublishQueue 持有锁时调用，自身不需要加锁
+ */
+
+import (
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	SCHEDULE_STRICT = "strict"
+	SCHEDULE_WRR    = "wrr"
+	SCHEDULE_DRR    = "drr"
+)
+
+var (
+	publishScheduler Scheduler = nil
+	PublishStats     []*WeightStat
+)
+
+type Scheduler interface {
+	Name() string
+	//取下一条要处理的消息，所有队列为空返回nil
+	Next() *PublishForm
+}
+
+//每个权重的处理统计
+type WeightStat struct {
+	Dispatched int64 //成功分发到broker
+	Expired    int64 //超过生命周期被丢弃
+	Dropped    int64 //队列满被丢弃
+}
+
+func initPublishStats() {
+	PublishStats = make([]*WeightStat, MaxPublishWeight+1)
+	for i := range PublishStats {
+		PublishStats[i] = &WeightStat{}
+	}
+}
+
+func IncrPublishDispatched(weight int) {
+	if weight >= 0 && weight < len(PublishStats) {
+		atomic.AddInt64(&PublishStats[weight].Dispatched, 1)
+	}
+}
+
+func IncrPublishExpired(weight int) {
+	if weight >= 0 && weight < len(PublishStats) {
+		atomic.AddInt64(&PublishStats[weight].Expired, 1)
+	}
+}
+
+func IncrPublishDropped(weight int) {
+	if weight >= 0 && weight < len(PublishStats) {
+		atomic.AddInt64(&PublishStats[weight].Dropped, 1)
+	}
+}
+
+func GetPublishStats() List {
+	list := List{}
+	lens := publishQueue.Lens()
+	for i := MaxPublishWeight; i >= 0; i-- {
+		stat := PublishStats[i]
+		list = append(list, Dict{
+			"weight":     i,
+			"queue":      lens[i],
+			"dispatched": atomic.LoadInt64(&stat.Dispatched),
+			"expired":    atomic.LoadInt64(&stat.Expired),
+			"dropped":    atomic.LoadInt64(&stat.Dropped),
+		})
+	}
+	return list
+}
+
+func NewScheduler(name string, quantum int) Scheduler {
+	switch strings.ToLower(name) {
+	case SCHEDULE_WRR:
+		return &WrrScheduler{cursor: 0, credit: 0}
+	case SCHEDULE_DRR:
+		if quantum <= 0 {
+			quantum = 512
+		}
+		return &DrrScheduler{
+			quantum: quantum,
+			deficit: make([]int, MaxPublishWeight+1),
+			cursor:  MaxPublishWeight,
+			fresh:   true,
+		}
+	default:
+		if len(name) > 0 && strings.ToLower(name) != SCHEDULE_STRICT {
+			log.Warning("unknown publish schedule <%s>, use %s", name, SCHEDULE_STRICT)
+		}
+		return &StrictScheduler{}
+	}
+}
+
+func queueWeight(weight int) int {
+	if weight < 1 {
+		return 1
+	}
+	return weight
+}
+
+//严格优先级
+type StrictScheduler struct {
+}
+
+func (p *StrictScheduler) Name() string {
+	return SCHEDULE_STRICT
+}
+
+func (p *StrictScheduler) Next() *PublishForm {
+	for i := MaxPublishWeight; i >= 0; i-- {
+		queue, ok := WeightQueueMap[i]
+		if !ok {
+			continue
+		}
+		if pub := queue.pop(); pub != nil {
+			return pub
+		}
+	}
+	return nil
+}
+
+//加权轮询
+type WrrScheduler struct {
+	cursor int //当前轮到的权重
+	credit int //当前权重本轮剩余可取条数
+}
+
+func (p *WrrScheduler) Name() string {
+	return SCHEDULE_WRR
+}
+
+func (p *WrrScheduler) Next() *PublishForm {
+	//最多走两轮：第一轮用完剩余额度，第二轮每个队列都有完整额度
+	for i := 0; i <= 2*(MaxPublishWeight+1); i++ {
+		if p.credit > 0 {
+			if queue, ok := WeightQueueMap[p.cursor]; ok {
+				if pub := queue.pop(); pub != nil {
+					p.credit--
+					return pub
+				}
+			}
+		}
+		p.advance()
+	}
+	return nil
+}
+
+func (p *WrrScheduler) advance() {
+	p.cursor--
+	if p.cursor < 0 {
+		p.cursor = MaxPublishWeight
+	}
+	p.credit = queueWeight(p.cursor)
+}
+
+//差额轮询
+type DrrScheduler struct {
+	quantum int   //权重1每轮获得的字节额度
+	deficit []int //每个权重累积的额度
+	cursor  int
+	fresh   bool //刚轮到当前队列，还没有加额度
+}
+
+func (p *DrrScheduler) Name() string {
+	return SCHEDULE_DRR
+}
+
+func publishCost(pub *PublishForm) int {
+	if len(pub.Msg) < 1 {
+		return 1
+	}
+	return len(pub.Msg)
+}
+
+func (p *DrrScheduler) Next() *PublishForm {
+	for !publishQueue.Empty() {
+		queue, ok := WeightQueueMap[p.cursor]
+		if !ok || queue.Len() == 0 {
+			//空队列不累积额度
+			p.deficit[p.cursor] = 0
+			p.advance()
+			continue
+		}
+		if p.fresh {
+			p.deficit[p.cursor] += p.quantum * queueWeight(p.cursor)
+			p.fresh = false
+		}
+		pub := queue.popIf(func(head *PublishForm) bool {
+			return publishCost(head) <= p.deficit[p.cursor]
+		})
+		if pub != nil {
+			p.deficit[p.cursor] -= publishCost(pub)
+			return pub
+		}
+		p.advance()
+	}
+	return nil
+}
+
+func (p *DrrScheduler) advance() {
+	p.cursor--
+	if p.cursor < 0 {
+		p.cursor = MaxPublishWeight
+	}
+	p.fresh = true
+}
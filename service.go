@@ -1,8 +1,12 @@
 package main
 
 import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
 	"sort"
+	"strings"
 )
 
 const (
@@ -30,6 +34,10 @@ func ServiceGetToken(form *TokenForm) (Dict, Error) {
 
 	data["brokerAddr"] = configOpt.brokerProxyAddr
 	data["brokerPort"] = configOpt.brokerProxyPort
+	//不能连接broker时，通过websocket或长轮询订阅
+	if len(configOpt.urlSubscribe) > 0 {
+		data["subscribeUrl"] = configOpt.urlSubscribe
+	}
 
 	return data, OK
 }
@@ -39,10 +47,11 @@ func ServiceGetToken(form *TokenForm) (Dict, Error) {
  */
 func ServiceGetLocalOnline(topic string) (Dict, Error) {
 	//返回本地在线人数不要去修饰
-	online := onlineCache.GetLocalOnline(topic)
+	detail := onlineCache.GetLocalDetail(topic)
 
 	data := Dict{
-		"online": online,
+		"online":   detail.Online,
+		"degraded": detail.Degraded,
 	}
 	return data, OK
 }
@@ -52,30 +61,310 @@ func ServiceGetLocalOnline(topic string) (Dict, Error) {
  */
 func ServiceGetOnline(topic string) (Dict, Error) {
 	var online int64 = 0
+	degraded := false
 
 	decorate := GetDecorate(topic)
-	if decorate >= 0 {
-		online = int64(decorate * float64(onlineCache.GetTotalOnline(topic)))
-	} else { //表示利用一个固定值 作为在线人数，没必须去后台捞数据，减少穿透
-		online = 0 - int64(decorate)
+	if !decorate.IsFixed() {
+		detail := onlineCache.GetTotalDetail(topic)
+		online = detail.Online
+		degraded = detail.Degraded
+	} //利用一个固定值 作为在线人数，没必须去后台捞数据，减少穿透
+	online = DecorateOnline(topic, decorate, online)
+
+	data := Dict{
+		"online":   online,
+		"degraded": degraded,
+	}
+	return data, OK
+}
+
+func ServiceGetLocalOnlineBatch(topics []string) (Dict, Error) {
+	//返回本地在线人数不要去修饰
+	onlines := map[string]int64{}
+	degraded := []string{}
+	for topic, detail := range onlineCache.GetLocalDetailBatch(topics) {
+		onlines[topic] = detail.Online
+		if detail.Degraded {
+			degraded = append(degraded, topic)
+		}
 	}
 
 	data := Dict{
-		"online": online,
+		"onlines":  onlines,
+		"degraded": degraded,
 	}
 	return data, OK
 }
 
+/**
+*批量获取多个topic的在线人数，对外接口
+ */
+func ServiceGetOnlineBatch(topics []string) (Dict, Error) {
+	if len(topics) == 0 {
+		return nil, NewError(INVALID_PARAM, nil, "invalid params")
+	}
+	if configOpt.onlineBatchMax > 0 && len(topics) > configOpt.onlineBatchMax {
+		return nil, NewError(INVALID_PARAM, nil, "too many topics")
+	}
+
+	onlines, degraded := GetDecoratedOnlineBatch(topics)
+	data := Dict{
+		"onlines":  onlines,
+		"degraded": degraded,
+	}
+	return data, OK
+}
+
+//修饰后的在线人数，返回在线人数和降级的topic
+func GetDecoratedOnlineBatch(topics []string) (map[string]int64, []string) {
+	//使用固定值的topic不需要去后台捞数据
+	onlines := map[string]int64{}
+	query := []string{}
+	decorates := map[string]*DecorateRule{}
+	for _, topic := range topics {
+		decorate := GetDecorate(topic)
+		if decorate.IsFixed() {
+			onlines[topic] = decorate.Apply(topic, 0)
+		} else {
+			decorates[topic] = decorate
+			query = append(query, topic)
+		}
+	}
+
+	degraded := []string{}
+	if len(query) > 0 {
+		totals := onlineCache.GetTotalDetailBatch(query)
+		for _, topic := range query {
+			onlines[topic] = DecorateOnline(topic, decorates[topic], totals[topic].Online)
+			if totals[topic].Degraded {
+				degraded = append(degraded, topic)
+			}
+		}
+	}
+	return onlines, degraded
+}
+
 //获取在线人数，对外后台接口，不加权在线人数
-func ServiceGetPureOnline(topic string) (Dict, Error) {
-	online := onlineCache.GetTotalOnline(topic)
+func ServiceGetPureOnline(topic string, breakdown bool) (Dict, Error) {
+	detail := onlineCache.GetTotalDetail(topic)
+	data := Dict{
+		"online":   detail.Online,
+		"degraded": detail.Degraded,
+	}
+	if !breakdown {
+		return data, OK
+	}
+
+	//按broker和对端provider分开展示
+	failed := []string{}
+	brokers := Dict{}
+	peers := Dict{}
+	local := onlineCache.GetLocalDetail(topic)
+	for addr, src := range local.Sources {
+		brokers[addr] = sourceOnlineDict(src)
+		if len(src.Failed) > 0 {
+			failed = append(failed, addr)
+		}
+	}
+	for addr, src := range detail.Sources {
+		if addr == ONLINE_SOURCE_LOCAL {
+			continue
+		}
+		peers[addr] = sourceOnlineDict(src)
+		if len(src.Failed) > 0 {
+			failed = append(failed, addr)
+		}
+	}
+	sort.Strings(failed)
+
+	data["updated"] = detail.Updated
+	data["local"] = local.Online
+	data["brokers"] = brokers
+	data["peers"] = peers
+	data["failed"] = failed
+	return data, OK
+}
+
+func sourceOnlineDict(src SourceOnline) Dict {
+	return Dict{
+		"online":  src.Online,
+		"updated": src.Updated,
+		"failed":  src.Failed,
+	}
+}
+
+//某个topic在[from, to]之间的在线人数采样
+func ServiceGetOnlineHistory(topic string, from, to int64) (Dict, Error) {
+	if len(topic) == 0 {
+		return nil, NewError(INVALID_PARAM, nil, "invalid params")
+	}
+	data := Dict{
+		"topic":    topic,
+		"interval": onlineHistory.interval,
+		"samples":  onlineHistory.Series(topic, from, to),
+	}
+	return data, OK
+}
+
+//某个topic在[from, to]之间的峰值和平均值
+func ServiceGetOnlinePeak(topic string, from, to int64) (Dict, Error) {
+	if len(topic) == 0 {
+		return nil, NewError(INVALID_PARAM, nil, "invalid params")
+	}
+	peak := onlineHistory.Peak(topic, from, to)
+	data := Dict{
+		"topic":    topic,
+		"peak":     peak.Peak,
+		"peakTime": peak.PeakTime,
+		"average":  peak.Average,
+		"samples":  peak.Samples,
+	}
+	return data, OK
+}
+
+//[from, to]之间峰值最高的前showlen个topic
+func ServiceGetOnlineTop(from, to int64, showlen int) (Dict, Error) {
+	if showlen <= 0 {
+		showlen = 10
+	}
+	data := Dict{
+		"from": from,
+		"to":   to,
+		"top":  onlineHistory.Top(from, to, showlen),
+	}
+	return data, OK
+}
+
+//分页获取修饰规则，limit <= 0 表示全部
+func ServiceListDecorate(prefix string, offset, limit int) (Dict, Error) {
+	if offset < 0 {
+		return nil, NewError(INVALID_PARAM, nil, "invalid offset")
+	}
+	items := GetDecorateList(prefix)
+	total := len(items)
+	if offset > total {
+		offset = total
+	}
+	items = items[offset:]
+	if limit > 0 && limit < len(items) {
+		items = items[:limit]
+	}
+
+	//兼容老的调用方，同时返回map形式
+	dmap := make(map[string]*DecorateRule, len(items))
+	for _, item := range items {
+		dmap[item.Key] = item.Rule
+	}
+	data := Dict{
+		"map":     dmap,
+		"list":    items,
+		"total":   total,
+		"offset":  offset,
+		"limit":   limit,
+		"version": GetDecorateVersion(),
+	}
+	return data, OK
+}
+
+func ServiceSetDecorate(key string, rule *DecorateRule, operator string) (Dict, Error) {
+	if len(key) == 0 || nil == rule {
+		return nil, NewError(INVALID_PARAM, nil, "invalid params")
+	}
+	if err := checkDecorateKey(key); err != nil {
+		return nil, NewError(INVALID_PARAM, err, "invalid key")
+	}
+	if err := rule.check(); err != nil {
+		return nil, NewError(INVALID_PARAM, err, "invalid rule")
+	}
+	change := ChangeDecorate(key, rule, operator)
 	data := Dict{
-		"online": online,
+		"map":     GetAllDecorate(),
+		"version": change.Version,
 	}
+	return data, OK
+}
 
+func ServiceDeleteDecorate(key string, operator string) (Dict, Error) {
+	if len(key) == 0 {
+		return nil, NewError(INVALID_PARAM, nil, "invalid params")
+	}
+	if nil == GetDecorateMap(key) {
+		return nil, NewError(INVALID_PARAM, nil, "no such rule")
+	}
+	change := ChangeDecorate(key, nil, operator)
+	data := Dict{
+		"key":     key,
+		"version": change.Version,
+	}
 	return data, OK
 }
 
+//批量导入，replace 为true时删除导入数据中没有的规则
+func ServiceImportDecorate(rules map[string]*DecorateRule, replace bool, operator string) (Dict, Error) {
+	for key, rule := range rules {
+		if len(key) == 0 || nil == rule {
+			return nil, NewError(INVALID_PARAM, nil, "invalid params")
+		}
+		if err := checkDecorateKey(key); err != nil {
+			return nil, NewError(INVALID_PARAM, err, fmt.Sprintf("invalid key <%s>", key))
+		}
+		if err := rule.check(); err != nil {
+			return nil, NewError(INVALID_PARAM, err, fmt.Sprintf("invalid rule of <%s>", key))
+		}
+	}
+
+	//整批生效，只产生一个版本
+	set, deleted := 0, 0
+	changes := ChangeDecorateBatch(rules, replace, operator)
+	for _, change := range changes {
+		if nil == change.Rule {
+			deleted++
+		} else {
+			set++
+		}
+	}
+	data := Dict{
+		"set":     set,
+		"deleted": deleted,
+		"version": GetDecorateVersion(),
+	}
+	return data, OK
+}
+
+//导出成csv，每行 key,规则(数字或json)
+func ExportDecorateCsv() string {
+	buf := &bytes.Buffer{}
+	writer := csv.NewWriter(buf)
+	writer.Write([]string{"key", "rule"})
+	for _, item := range GetDecorateList("") {
+		jstr, _ := json.Marshal(item.Rule)
+		writer.Write([]string{item.Key, string(jstr)})
+	}
+	writer.Flush()
+	return buf.String()
+}
+
+func ParseDecorateCsv(body []byte) (map[string]*DecorateRule, Error) {
+	reader := csv.NewReader(bytes.NewReader(body))
+	reader.FieldsPerRecord = 2
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, NewError(INVALID_PARAM, err, "invalid csv")
+	}
+	rules := map[string]*DecorateRule{}
+	for i, record := range records {
+		if i == 0 && record[0] == "key" {
+			continue
+		}
+		rule := &DecorateRule{}
+		if err := json.Unmarshal([]byte(record[1]), rule); err != nil {
+			return nil, NewError(INVALID_PARAM, err, fmt.Sprintf("invalid rule of <%s>", record[0]))
+		}
+		rules[strings.TrimSpace(record[0])] = rule
+	}
+	return rules, OK
+}
+
 type Pair struct {
 	Key   string
 	Value int64
@@ -116,29 +405,52 @@ func ServiceGetAllPureOnline(showlen, local int) (Dict, Error) {
 
 //来自集群内的广播，直接将消息广播到broker
 func ServiceRelayPublish(form *PublishForm) Error {
+	if !CheckPublishLoop(form, false) {
+		return OK
+	}
+	if !MarkPublishSeen(form.UpstreamId, form.Topic) {
+		log.Warning("消息<%s> 重复，被丢弃", form.UpstreamId)
+		return OK
+	}
 	form.PubTime = Gtimer.Unix
 	return PushToLocal(form)
 }
 
 //集群间广播
 func ServiceBridgePublish(form *PublishForm) Error {
+	if !CheckPublishLoop(form, true) {
+		return OK
+	}
+	if !MarkPublishSeen(form.UpstreamId, form.Topic) {
+		log.Warning("消息<%s> 重复，被丢弃", form.UpstreamId)
+		return OK
+	}
 
 	//桥接过来的消息要重新进行 过载保护处理
+	//被丢弃的消息撤销去重登记，对端重试时还能推送
+	if !InrcTopicCountAndTryTrans(form.Topic) {
+		log.Error("消息<%s> 超出topic<%s>处理能力，被丢弃", form.UpstreamId, form.Topic)
+		UnmarkPublishSeen(form.UpstreamId, form.Topic)
+		return OK
+	}
 	if !InrcCurCountAndTryTrans() {
 		log.Error("消息<%s> 超出处理能力，被丢弃", form.UpstreamId)
+		UnmarkPublishSeen(form.UpstreamId, form.Topic)
 		return OK
 	}
 
 	form.PubTime = Gtimer.Unix
+	MarkPublishVisited(form)
 
 	//重新计算在线人数，(bridge过来的在线人数是其它集群的)
 	//在线人数只是本集群之内的数据
 	//获取在线人数 修饰手法
 	decorate := GetDecorate(form.Topic)
-	if decorate >= 0 {
-		form.Online = int64(decorate * float64(onlineCache.GetTotalOnline(form.Topic)))
-	} else { //表示利用一个固定值 作为在线人数，没必须去后台捞数据，减少穿透
-		form.Online = 0 - int64(decorate)
+	if decorate.IsFixed() { //表示利用一个固定值 作为在线人数，没必须去后台捞数据，减少穿透
+		form.Online = decorate.Apply(form.Topic, 0)
+	} else {
+		form.Online = DecorateOnline(form.Topic, decorate,
+			onlineCache.GetTotalOnline(form.Topic))
 	}
 
 	//转到本节点broker
@@ -147,38 +459,131 @@ func ServiceBridgePublish(form *PublishForm) Error {
 	return RelayInCluster(form)
 }
 
-//对外接口
-func ServicePublish(form *PublishForm) Error {
+//展开要推送的topic，Topic 按原样推送，Topics 中的通配符按本节点已知的topic展开
+//通配符规则和修饰规则的模式相同: live/+ 、game/# 、live/* 、room-?
+//已知的topic: 最近推送过消息的topic(见topics.go)、配置的 PublishKnownTopics、在线人数缓存中的topic
+//最近没有消息、也没有人查询在线人数的topic匹配不到，需要保证送达的topic请配置或者逐个列出
+func ExpandPublishTopics(form *PublishForm) ([]string, Error) {
+	topics := []string{}
+	seen := map[string]bool{}
+	add := func(topic string) {
+		if !seen[topic] {
+			seen[topic] = true
+			topics = append(topics, topic)
+		}
+	}
 
-	//压力过载保护
-	//本集群处理不过来的消息，不会进行任何处理, 不桥接、不转发
-	if !InrcCurCountAndTryTrans() {
-		log.Error("消息<%s> 超出处理能力，被丢弃", form.UpstreamId)
-		return OK
+	if len(form.Topic) > 0 {
+		add(form.Topic)
+	}
+	var known []string
+	for _, target := range form.Topics {
+		if err := checkDecorateKey(target); err != nil {
+			return nil, NewError(INVALID_PARAM, err, "invalid topic")
+		}
+		pattern := NewDecoratePattern(target, nil)
+		if nil == pattern {
+			add(target)
+			continue
+		}
+		if nil == known {
+			known = gainKnownTopics()
+		}
+		for _, topic := range known {
+			if pattern.Match(topic) {
+				add(topic)
+			}
+		}
+	}
+
+	if len(form.Topic) == 0 && len(form.Topics) == 0 {
+		return nil, NewError(INVALID_PARAM, nil, "invalid topic")
+	}
+	if configOpt.publishMaxTopics > 0 && len(topics) > configOpt.publishMaxTopics {
+		return nil, NewError(INVALID_PARAM, nil, "too many topics")
+	}
+	return topics, OK
+}
+
+func gainKnownTopics() []string {
+	known := topicRegistry.Topics()
+	seen := make(map[string]bool, len(known))
+	for _, topic := range known {
+		seen[topic] = true
+	}
+	for topic := range onlineCache.GetAllTotalOnline(false) {
+		if !seen[topic] {
+			known = append(known, topic)
+		}
+	}
+	sort.Strings(known)
+	return known
+}
+
+//对外接口，每个topic一条消息，分别流控、进入权重队列、转发
+func ServicePublish(form *PublishForm) (Dict, Error) {
+	topics, ret := ExpandPublishTopics(form)
+	if !ret.Ok() {
+		return nil, ret
 	}
 
 	if len(form.UpstreamId) == 0 {
 		form.UpstreamId = NewUuid(true)
 	}
-
-	//获取在线人数 修饰手法
-	decorate := GetDecorate(form.Topic)
-	if decorate >= 0 {
-		form.Online = int64(decorate * float64(onlineCache.GetTotalOnline(form.Topic)))
-	} else { //表示利用一个固定值 作为在线人数，没必须去后台捞数据，减少穿透
-		form.Online = 0 - int64(decorate)
+	MarkPublishOrigin(form)
+
+	accepted := []string{}
+	dropped := []string{}
+	for _, topic := range topics {
+		//客户端重试的消息只处理一次
+		if !MarkPublishSeen(form.UpstreamId, topic) {
+			log.Warning("消息<%s> 重复，被丢弃", form.UpstreamId)
+			continue
+		}
+
+		//压力过载保护
+		//本集群处理不过来的消息，不会进行任何处理, 不桥接、不转发
+		//被丢弃的消息撤销去重登记，客户端用同一个id重试时还能推送
+		if !InrcTopicCountAndTryTrans(topic) {
+			log.Error("消息<%s> 超出topic<%s>处理能力，被丢弃", form.UpstreamId, topic)
+			UnmarkPublishSeen(form.UpstreamId, topic)
+			dropped = append(dropped, topic)
+			continue
+		}
+		if !InrcCurCountAndTryTrans() {
+			log.Error("消息<%s> 超出处理能力，被丢弃", form.UpstreamId)
+			UnmarkPublishSeen(form.UpstreamId, topic)
+			dropped = append(dropped, topic)
+			continue
+		}
+		accepted = append(accepted, topic)
 	}
 
-	//先进入本地过滤系统
-	PushToLocal(form)
+	//获取在线人数 修饰手法，多个topic一次性拉取
+	onlines, _ := GetDecoratedOnlineBatch(accepted)
+
+	for _, topic := range accepted {
+		pub := *form
+		pub.Topic = topic
+		pub.Topics = nil
+		pub.Online = onlines[topic]
+
+		//先进入本地过滤系统
+		PushToLocal(&pub)
 
-	//广播到集群内的其它节点
-	RelayInCluster(form)
+		//广播到集群内的其它节点
+		RelayInCluster(&pub)
 
-	if form.Bridge {
-		//桥接消息到其它集群
-		BridgeBetweenCluster(form)
+		if pub.Bridge {
+			//桥接消息到其它集群
+			BridgeBetweenCluster(&pub)
+		}
 	}
 
-	return OK
+	data := Dict{
+		"id":      form.UpstreamId,
+		"topics":  len(accepted),
+		"dropped": dropped, //被流控丢弃的topic，可以用同一个id重试
+	}
+	return data, OK
 }
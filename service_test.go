@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExpandPublishTopics(t *testing.T) {
+	useTestOnlineCache(t)
+	savedRegistry, savedMax := topicRegistry, configOpt.publishMaxTopics
+	t.Cleanup(func() {
+		topicRegistry, configOpt.publishMaxTopics = savedRegistry, savedMax
+	})
+	topicRegistry = &TopicRegistry{topics: map[string]int64{}, pinned: map[string]bool{}}
+	for _, topic := range []string{"live/a", "live/b", "game/x/1", "game/y"} {
+		topicRegistry.Touch(topic)
+	}
+	topicRegistry.Pin([]string{"room-1", "room-22"})
+	//在线人数缓存中的topic也算已知
+	onlineCache.GetTotalOnline("live/c")
+
+	for _, c := range []struct {
+		name    string
+		topic   string
+		topics  []string
+		max     int
+		want    string
+		invalid bool
+	}{
+		{"single topic", "new/topic", nil, 0, "new/topic", false},
+		{"plain list", "", []string{"x", "y"}, 0, "x,y", false},
+		{"dedup with topic", "live/a", []string{"live/a", "x", "x"}, 0, "live/a,x", false},
+		{"mqtt single level", "", []string{"live/+"}, 0, "live/a,live/b,live/c", false},
+		{"mqtt multi level", "", []string{"game/#"}, 0, "game/x/1,game/y", false},
+		{"prefix", "", []string{"game/*"}, 0, "game/x/1,game/y", false},
+		{"glob", "", []string{"room-?"}, 0, "room-1", false},
+		{"overlapping patterns", "live/b", []string{"live/+", "live/*", "live/a"}, 0,
+			"live/b,live/a,live/c", false},
+		{"no match", "", []string{"none/+"}, 0, "", false},
+		{"at max topics", "", []string{"live/+"}, 3, "live/a,live/b,live/c", false},
+		{"over max topics", "", []string{"live/+"}, 2, "", true},
+		{"plain topics over max", "a", []string{"b", "c"}, 2, "", true},
+		{"empty topic in list", "", []string{"live/a", ""}, 0, "", true},
+		{"malformed wildcard", "", []string{"live/#/a"}, 0, "", true},
+		{"no topic", "", nil, 0, "", true},
+	} {
+		configOpt.publishMaxTopics = c.max
+		topics, ret := ExpandPublishTopics(&PublishForm{Topic: c.topic, Topics: c.topics})
+		if c.invalid {
+			if ret.Code != INVALID_PARAM {
+				t.Errorf("%s: got %v, %s, want invalid param", c.name, topics, ret)
+			}
+			continue
+		}
+		if !ret.Ok() || strings.Join(topics, ",") != c.want {
+			t.Errorf("%s: got %v, %s, want %s", c.name, topics, ret, c.want)
+		}
+	}
+}
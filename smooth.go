@@ -0,0 +1,136 @@
+package main
+
+/**
+ * 对外展示的在线人数平滑处理，只作用于修饰后的人数，后台接口的原始人数不受影响
+ * 1、alpha: 指数移动平均，每个周期 新值 = alpha * 当前值 + (1 - alpha) * 上次值
+ * 2、maxDecrease: 每个周期最多下降的比例，上升不受限制
+ * 同一个周期内多次查询返回同一个值
+ */
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+)
+
+var (
+	smoothStates = map[string]*smoothState{}
+	smoothLock   sync.Mutex
+)
+
+//平滑状态最多保存的topic个数，超过后清理长时间没有查询的topic
+//仍然超过时淘汰最久没有更新的，一次清理到 90%，避免每个新topic都要清理
+const SMOOTH_STATE_MAX = 100000
+
+type DecorateSmooth struct {
+	Alpha       float64 `json:"alpha,omitempty"`
+	MaxDecrease float64 `json:"maxDecrease,omitempty"`
+	Interval    int64   `json:"interval,omitempty"` //周期(秒)，默认1
+}
+
+type smoothState struct {
+	value float64
+	time  int64
+}
+
+func (p *DecorateSmooth) check() error {
+	if p.Alpha < 0 || p.Alpha > 1 {
+		return fmt.Errorf("smooth alpha must be in [0, 1]")
+	}
+	if p.MaxDecrease < 0 || p.MaxDecrease >= 1 {
+		return fmt.Errorf("smooth maxDecrease must be in [0, 1)")
+	}
+	if p.Interval < 0 {
+		return fmt.Errorf("negative smooth interval")
+	}
+	return nil
+}
+
+func (p *DecorateSmooth) interval() int64 {
+	if p.Interval > 0 {
+		return p.Interval
+	}
+	return 1
+}
+
+func SmoothOnline(topic string, smooth *DecorateSmooth, online int64) int64 {
+	return smoothOnlineAt(topic, smooth, online, Gtimer.Unix)
+}
+
+func smoothOnlineAt(topic string, smooth *DecorateSmooth, online int64, now int64) int64 {
+	interval := smooth.interval()
+
+	smoothLock.Lock()
+	defer smoothLock.Unlock()
+
+	state, ok := smoothStates[topic]
+	if !ok {
+		if len(smoothStates) >= SMOOTH_STATE_MAX {
+			cleanSmoothStates(now)
+		}
+		smoothStates[topic] = &smoothState{value: float64(online), time: now}
+		return online
+	}
+
+	//长时间没有查询，不再参考旧值
+	if now-state.time > 60*interval {
+		state.value = float64(online)
+		state.time = now
+		return online
+	}
+
+	steps := (now - state.time) / interval
+	if steps <= 0 {
+		return int64(state.value)
+	}
+
+	value := float64(online)
+	if smooth.Alpha > 0 {
+		//经过steps个周期后的移动平均
+		value = value + (state.value-value)*math.Pow(1-smooth.Alpha, float64(steps))
+	}
+	if smooth.MaxDecrease > 0 {
+		min := state.value * math.Pow(1-smooth.MaxDecrease, float64(steps))
+		if value < min {
+			value = min
+		}
+	}
+	state.value = value
+	//按整周期前进，不足一个周期的时间留到下次
+	state.time += steps * interval
+	return int64(value)
+}
+
+//调用方持有 smoothLock
+func cleanSmoothStates(now int64) {
+	for topic, state := range smoothStates {
+		if now-state.time > 60 {
+			delete(smoothStates, topic)
+		}
+	}
+	if len(smoothStates) < SMOOTH_STATE_MAX {
+		return
+	}
+
+	items := make(smoothItemList, 0, len(smoothStates))
+	for topic, state := range smoothStates {
+		items = append(items, smoothItem{topic, state.time})
+	}
+	sort.Sort(items)
+	for _, item := range items[:len(items)-SMOOTH_STATE_MAX*9/10] {
+		delete(smoothStates, item.topic)
+	}
+}
+
+type smoothItem struct {
+	topic string
+	time  int64
+}
+
+//按更新时间排列，最旧的在前
+type smoothItemList []smoothItem
+
+func (p smoothItemList) Len() int           { return len(p) }
+func (p smoothItemList) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p smoothItemList) Less(i, j int) bool { return p[i].time < p[j].time }
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func useSmoothStates(t *testing.T) {
+	smoothLock.Lock()
+	saved := smoothStates
+	smoothStates = map[string]*smoothState{}
+	smoothLock.Unlock()
+	t.Cleanup(func() {
+		smoothLock.Lock()
+		smoothStates = saved
+		smoothLock.Unlock()
+	})
+}
+
+//查询时间不是周期的整数倍时，不足一个周期的时间留到下次，不会丢周期
+func TestSmoothOnlineSteps(t *testing.T) {
+	useSmoothStates(t)
+	smooth := &DecorateSmooth{MaxDecrease: 0.5, Interval: 3}
+
+	for _, c := range []struct {
+		now    int64
+		online int64
+		want   int64
+	}{
+		{1000, 1000, 1000},
+		{1002, 0, 1000}, //同一个周期返回同一个值
+		{1004, 0, 500},  //一个周期
+		{1006, 0, 250},  //1004 只用掉了一个周期，1006 又满一个周期
+		{1008, 0, 250},
+		{1012, 0, 62},    //两个周期
+		{1100, 800, 800}, //长时间没有查询，不参考旧值
+	} {
+		if got := smoothOnlineAt("live/a", smooth, c.online, c.now); got != c.want {
+			t.Errorf("at %d online %d: got %d, want %d", c.now, c.online, got, c.want)
+		}
+	}
+}
+
+//所有状态都是最近更新的，也要淘汰最旧的，不能无限增长
+func TestCleanSmoothStates(t *testing.T) {
+	useSmoothStates(t)
+	smooth := &DecorateSmooth{Alpha: 0.5}
+
+	now := int64(1000)
+	for i := 0; i < SMOOTH_STATE_MAX; i++ {
+		smoothOnlineAt(fmt.Sprintf("live/%d", i), smooth, 1, now+int64(i%10))
+	}
+	smoothOnlineAt("live/new", smooth, 1, now+10)
+
+	smoothLock.Lock()
+	defer smoothLock.Unlock()
+	if n := len(smoothStates); n > SMOOTH_STATE_MAX || n < SMOOTH_STATE_MAX*9/10 {
+		t.Errorf("%d states after clean", n)
+	}
+	if _, ok := smoothStates["live/new"]; !ok {
+		t.Errorf("new topic not saved")
+	}
+	for topic, state := range smoothStates {
+		if state.time == now && topic != "live/new" {
+			t.Errorf("oldest state <%s> kept", topic)
+			break
+		}
+	}
+}
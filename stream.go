@@ -0,0 +1,251 @@
+package main
+
+/**
+ * 在线人数推送流(SSE)，代替前端页面轮询在线人数接口
+ * 1、客户端订阅一个或多个topic: GET UrlOnlineStream?topics=a,b
+ * 2、一个协程按总在线人数缓存的过期周期刷新所有被订阅的topic，每轮只查一次缓存，不随连接数增加
+ * 3、修饰后的在线人数有变化才推送，订阅后先推送一次当前值
+ * 4、每个连接两次推送的间隔不小于 OnlineStreamInterval 秒，期间的变化合并成一次
+ * 5、空闲时定时发送注释行保活，写失败或客户端断开后退订
+ *
+ * 推送格式:
+ * event: online
+ * data: {"onlines": {"topic": 100}, "degraded": [], "time": 1500000000}
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	//保活间隔(秒)
+	ONLINE_STREAM_KEEPALIVE = 15
+	//断线后客户端重连的间隔(毫秒)
+	ONLINE_STREAM_RETRY = 3000
+)
+
+var (
+	onlineStreamHub = &OnlineStreamHub{
+		streams: map[*OnlineStream]bool{},
+	}
+)
+
+type OnlineStream struct {
+	topics   []string
+	sent     map[string]int64 //上次通知的值
+	pending  map[string]int64 //还没推送的变化
+	degraded map[string]bool
+	notify   chan bool
+	lock     sync.Mutex
+}
+
+func NewOnlineStream(topics []string) *OnlineStream {
+	return &OnlineStream{
+		topics:   topics,
+		sent:     map[string]int64{},
+		pending:  map[string]int64{},
+		degraded: map[string]bool{},
+		notify:   make(chan bool, 1),
+	}
+}
+
+//记录有变化的topic并通知推送
+func (p *OnlineStream) update(onlines map[string]int64, degraded map[string]bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	changed := false
+	for _, topic := range p.topics {
+		online, ok := onlines[topic]
+		if !ok {
+			continue
+		}
+		if last, ok := p.sent[topic]; ok && last == online && p.degraded[topic] == degraded[topic] {
+			continue
+		}
+		p.sent[topic] = online
+		p.pending[topic] = online
+		p.degraded[topic] = degraded[topic]
+		changed = true
+	}
+	if changed {
+		select {
+		case p.notify <- true:
+		default:
+		}
+	}
+}
+
+//取出所有未推送的变化
+func (p *OnlineStream) take() (map[string]int64, []string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	onlines := p.pending
+	degraded := []string{}
+	for topic := range onlines {
+		if p.degraded[topic] {
+			degraded = append(degraded, topic)
+		}
+	}
+	p.pending = map[string]int64{}
+	return onlines, degraded
+}
+
+//推送直到客户端断开或写失败
+func (p *OnlineStream) Serve(w io.Writer, flusher http.Flusher, done <-chan struct{}) {
+	interval := time.Second * time.Duration(configOpt.onlineStreamInterval)
+	keepalive := time.NewTicker(time.Second * ONLINE_STREAM_KEEPALIVE)
+	defer keepalive.Stop()
+
+	if _, err := fmt.Fprintf(w, "retry: %d\n\n", ONLINE_STREAM_RETRY); err != nil {
+		return
+	}
+	flusher.Flush()
+
+	var last time.Time
+	for {
+		select {
+		case <-done:
+			return
+		case <-keepalive.C:
+			if _, err := io.WriteString(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+			continue
+		case <-p.notify:
+		}
+
+		//限速，等待期间的变化合并到这次推送
+		if wait := interval - time.Since(last); wait > 0 {
+			select {
+			case <-done:
+				return
+			case <-time.After(wait):
+			}
+		}
+
+		onlines, degraded := p.take()
+		if len(onlines) == 0 {
+			continue
+		}
+		jstr, _ := json.Marshal(Dict{
+			"onlines":  onlines,
+			"degraded": degraded,
+			"time":     Gtimer.Unix,
+		})
+		if _, err := fmt.Fprintf(w, "event: online\ndata: %s\n\n", jstr); err != nil {
+			return
+		}
+		flusher.Flush()
+		last = time.Now()
+	}
+}
+
+type OnlineStreamHub struct {
+	streams map[*OnlineStream]bool
+	lock    sync.Mutex
+}
+
+func (p *OnlineStreamHub) Add(stream *OnlineStream) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if configOpt.onlineStreamMaxConn > 0 && len(p.streams) >= configOpt.onlineStreamMaxConn {
+		return false
+	}
+	p.streams[stream] = true
+	return true
+}
+
+func (p *OnlineStreamHub) Remove(stream *OnlineStream) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	delete(p.streams, stream)
+}
+
+func (p *OnlineStreamHub) Len() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.streams)
+}
+
+//刷新所有被订阅的topic，通知有变化的连接
+func (p *OnlineStreamHub) refresh() {
+	p.lock.Lock()
+	streams := make([]*OnlineStream, 0, len(p.streams))
+	topicSet := map[string]bool{}
+	for stream := range p.streams {
+		streams = append(streams, stream)
+		for _, topic := range stream.topics {
+			topicSet[topic] = true
+		}
+	}
+	p.lock.Unlock()
+
+	if len(topicSet) == 0 {
+		return
+	}
+	topics := make([]string, 0, len(topicSet))
+	for topic := range topicSet {
+		topics = append(topics, topic)
+	}
+
+	onlines, degraded := gainStreamOnline(topics)
+	for _, stream := range streams {
+		stream.update(onlines, degraded)
+	}
+}
+
+func StartOnlineStream() {
+	if len(configOpt.urlOnlineStream) == 0 {
+		return
+	}
+	if configOpt.onlineStreamInterval <= 0 {
+		configOpt.onlineStreamInterval = 1
+	}
+	//跟随总在线人数缓存的刷新周期
+	interval := configOpt.totalOnlineCacheExpire
+	if interval <= 0 {
+		interval = 1
+	}
+
+	go func() {
+		for {
+			<-time.After(time.Second * time.Duration(interval))
+			onlineStreamHub.refresh()
+		}
+	}()
+}
+
+//订阅，成功后先推送一次当前值
+func SubscribeOnlineStream(topics []string) (*OnlineStream, Error) {
+	if len(topics) == 0 {
+		return nil, NewError(INVALID_PARAM, nil, "invalid params")
+	}
+	if configOpt.onlineStreamMaxTopics > 0 && len(topics) > configOpt.onlineStreamMaxTopics {
+		return nil, NewError(INVALID_PARAM, nil, "too many topics")
+	}
+
+	stream := NewOnlineStream(topics)
+	if !onlineStreamHub.Add(stream) {
+		return nil, NewError(SYSTEM_BUSY, nil, "too many streams")
+	}
+
+	stream.update(gainStreamOnline(topics))
+	return stream, OK
+}
+
+func gainStreamOnline(topics []string) (map[string]int64, map[string]bool) {
+	onlines, degradedList := GetDecoratedOnlineBatch(topics)
+	degraded := make(map[string]bool, len(degradedList))
+	for _, topic := range degradedList {
+		degraded[topic] = true
+	}
+	return onlines, degraded
+}
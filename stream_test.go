@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//记录推送内容的writer
+type streamRecorder struct {
+	buf  bytes.Buffer
+	lock sync.Mutex
+}
+
+func (p *streamRecorder) Write(b []byte) (int, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.buf.Write(b)
+}
+
+func (p *streamRecorder) Flush() {}
+
+func (p *streamRecorder) events() []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	events := []string{}
+	for _, block := range strings.Split(p.buf.String(), "\n\n") {
+		if strings.HasPrefix(block, "event: online\n") {
+			events = append(events, strings.TrimPrefix(block, "event: online\ndata: "))
+		}
+	}
+	return events
+}
+
+func useTestDecorate(t *testing.T, dmap map[string]interface{}) {
+	decorateLock.Lock()
+	saved := DecorateMap
+	InitOnlineDecorteMap(dmap)
+	decorateLock.Unlock()
+	t.Cleanup(func() {
+		decorateLock.Lock()
+		DecorateMap = saved
+		rebuildDecoratePatterns()
+		decorateLock.Unlock()
+	})
+}
+
+func TestOnlineStreamChangeOnly(t *testing.T) {
+	stream := NewOnlineStream([]string{"a", "b"})
+	for _, c := range []struct {
+		onlines  map[string]int64
+		degraded map[string]bool
+		pending  map[string]int64
+	}{
+		{map[string]int64{"a": 1, "b": 2}, nil, map[string]int64{"a": 1, "b": 2}},
+		{map[string]int64{"a": 1, "b": 2}, nil, map[string]int64{}},
+		{map[string]int64{"a": 3, "b": 2}, nil, map[string]int64{"a": 3}},
+		{map[string]int64{"a": 3, "b": 2}, map[string]bool{"b": true}, map[string]int64{"b": 2}},
+		{map[string]int64{"a": 3, "c": 5}, map[string]bool{"b": true}, map[string]int64{}},
+	} {
+		stream.update(c.onlines, c.degraded)
+		pending, _ := stream.take()
+		if len(pending) != len(c.pending) {
+			t.Errorf("update %v got %v, want %v", c.onlines, pending, c.pending)
+			continue
+		}
+		for topic, online := range c.pending {
+			if pending[topic] != online {
+				t.Errorf("update %v got %v, want %v", c.onlines, pending, c.pending)
+			}
+		}
+	}
+}
+
+//实际值不变时，带随机浮动的规则不会每次刷新都产生变化
+func TestOnlineStreamJitterStable(t *testing.T) {
+	useTestOnlineCache(t)
+	useTestDecorate(t, map[string]interface{}{
+		"live/+": map[string]interface{}{"multiplier": 100.0, "jitter": 0.5},
+	})
+
+	stream := NewOnlineStream([]string{"live/a", "live/bb"})
+	stream.update(gainStreamOnline(stream.topics))
+	if pending, _ := stream.take(); len(pending) != 2 {
+		t.Fatalf("first update got %v", pending)
+	}
+	for i := 0; i < 10; i++ {
+		stream.update(gainStreamOnline(stream.topics))
+		if pending, _ := stream.take(); len(pending) != 0 {
+			t.Fatalf("refresh %d pushed %v", i, pending)
+		}
+	}
+
+	if decorateJitter("live/a", 100) != decorateJitter("live/a", 109) {
+		t.Errorf("jitter changed within an interval")
+	}
+	for now := int64(0); now < 1000; now += DECORATE_JITTER_INTERVAL {
+		if j := decorateJitter("live/a", now); j < -1 || j >= 1 {
+			t.Errorf("jitter %f out of range", j)
+		}
+	}
+}
+
+//限速期间的多次变化合并成一次推送，只推最新的值
+func TestOnlineStreamCoalesce(t *testing.T) {
+	saved := configOpt
+	t.Cleanup(func() { configOpt = saved })
+	configOpt.onlineStreamInterval = 1
+
+	stream := NewOnlineStream([]string{"a"})
+	w := &streamRecorder{}
+	done := make(chan struct{})
+	served := make(chan bool)
+	go func() {
+		stream.Serve(w, w, done)
+		close(served)
+	}()
+
+	stream.update(map[string]int64{"a": 1}, nil)
+	time.Sleep(100 * time.Millisecond)
+	for i := int64(2); i <= 5; i++ {
+		stream.update(map[string]int64{"a": i}, nil)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if events := w.events(); len(events) != 1 {
+		t.Fatalf("pushed %d events before interval, %v", len(events), events)
+	}
+	time.Sleep(time.Second)
+	close(done)
+	<-served
+
+	events := w.events()
+	if len(events) != 2 {
+		t.Fatalf("pushed %d events, %v", len(events), events)
+	}
+	if !strings.Contains(events[0], `"a":1`) || !strings.Contains(events[1], `"a":5`) {
+		t.Errorf("unexpected events %v", events)
+	}
+}
+
+func TestOnlineStreamLimits(t *testing.T) {
+	useTestOnlineCache(t)
+	saved := configOpt
+	savedHub := onlineStreamHub
+	t.Cleanup(func() {
+		configOpt = saved
+		onlineStreamHub = savedHub
+	})
+	configOpt.onlineStreamMaxConn = 1
+	configOpt.onlineStreamMaxTopics = 2
+	onlineStreamHub = &OnlineStreamHub{streams: map[*OnlineStream]bool{}}
+
+	if _, ret := SubscribeOnlineStream(nil); ret.Code != INVALID_PARAM {
+		t.Errorf("empty topics got %s", ret)
+	}
+	if _, ret := SubscribeOnlineStream([]string{"a", "b", "c"}); ret.Code != INVALID_PARAM {
+		t.Errorf("too many topics got %s", ret)
+	}
+	stream, ret := SubscribeOnlineStream([]string{"a", "bb"})
+	if !ret.Ok() {
+		t.Fatalf("subscribe failed, %s", ret)
+	}
+	//订阅后先推送一次当前值
+	if pending, _ := stream.take(); pending["a"] != 1 || pending["bb"] != 2 {
+		t.Errorf("first push %v", pending)
+	}
+	if _, ret := SubscribeOnlineStream([]string{"a"}); ret.Code != SYSTEM_BUSY {
+		t.Errorf("too many streams got %s", ret)
+	}
+	onlineStreamHub.Remove(stream)
+	if _, ret := SubscribeOnlineStream([]string{"a"}); !ret.Ok() {
+		t.Errorf("subscribe after remove failed, %s", ret)
+	}
+}
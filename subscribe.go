@@ -0,0 +1,295 @@
+package main
+
+/**
+ * 不能直接连接broker(mqtt)的客户端，从provider订阅topic的消息
+ * 1、WebSocket: GET UrlSubscribe?topic=xxx 并升级为websocket，每条消息一个文本帧
+ * 2、长轮询:    GET UrlSubscribe?topic=xxx[&session=yyy]
+ *    没有新消息时最多等待 SubscribePollWait 秒，返回 {"session": "yyy", "messages": [...]}
+ *    下次请求带上返回的session，SubscribeSessionExpire 秒内没有请求的会话被删除
+ * 3、消息来自本节点的推送流程(spreadToBrokers)，内容和推送给broker的 PublishData 相同
+ *    集群内转发、集群间桥接过来的消息也会经过本节点的推送流程
+ * 4、每个连接(会话)最多缓存 SubscribeBuffer 条消息，满了说明消费太慢，断开连接(删除会话)
+ *    客户端需要重新订阅，期间的消息丢失(和mqtt qos 0 一致)
+ * 5、带 Origin 请求头(浏览器)的请求，Origin 必须在 SubscribeAllowOrigins 中，防止其它网站的页面跨站订阅
+ *    长轮询不支持jsonp(<script> 请求不带 Origin)，浏览器跨域访问靠CORS，只对允许的 Origin 返回
+ *    为空时拒绝所有带 Origin 的请求，"*" 表示不限制；订阅本身不认证，不要用来推送敏感消息
+ */
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	SUBSCRIBE_CLOSE_EVICTED = "slow consumer"
+	SUBSCRIBE_CLOSE_EXPIRED = "session expired"
+)
+
+var (
+	subscribeHub = &SubscribeHub{
+		topics:   map[string]map[*Subscriber]bool{},
+		sessions: map[string]*Subscriber{},
+	}
+
+	SubscribeDelivered int64 = 0 //投递到订阅者缓冲区的消息数
+	SubscribeEvicted   int64 = 0 //因消费太慢被断开的订阅者数
+)
+
+type Subscriber struct {
+	Id     string
+	Topic  string
+	Buffer chan string
+	Closed chan bool //订阅被删除时关闭
+	Reason string    //被删除的原因
+
+	active int64 //长轮询最后一次请求的时间
+	once   sync.Once
+}
+
+func (p *Subscriber) close(reason string) {
+	p.once.Do(func() {
+		p.Reason = reason
+		close(p.Closed)
+	})
+}
+
+//等待消息，最多返回缓冲区中已有的所有消息
+func (p *Subscriber) Poll(wait time.Duration) ([]string, bool) {
+	messages := []string{}
+	select {
+	case msg := <-p.Buffer:
+		messages = append(messages, msg)
+	case <-p.Closed:
+		return messages, false
+	case <-time.After(wait):
+		return messages, true
+	}
+	for {
+		select {
+		case msg := <-p.Buffer:
+			messages = append(messages, msg)
+		default:
+			return messages, true
+		}
+	}
+}
+
+type SubscribeHub struct {
+	topics   map[string]map[*Subscriber]bool
+	sessions map[string]*Subscriber //长轮询会话
+	count    int
+	lock     sync.RWMutex
+}
+
+//新建订阅，session 为true 表示长轮询会话
+func (p *SubscribeHub) Subscribe(topic string, session bool) (*Subscriber, Error) {
+	if len(topic) == 0 {
+		return nil, NewError(INVALID_PARAM, nil, "invalid params")
+	}
+	buffer := configOpt.subscribeBuffer
+	if buffer <= 0 {
+		buffer = 100
+	}
+	sub := &Subscriber{
+		Id:     NewUuid(true),
+		Topic:  topic,
+		Buffer: make(chan string, buffer),
+		Closed: make(chan bool),
+		active: Gtimer.Unix,
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if configOpt.subscribeMaxConn > 0 && p.count >= configOpt.subscribeMaxConn {
+		return nil, NewError(SYSTEM_BUSY, nil, "too many subscribers")
+	}
+	subs, ok := p.topics[topic]
+	if !ok {
+		subs = map[*Subscriber]bool{}
+		p.topics[topic] = subs
+	}
+	subs[sub] = true
+	if session {
+		p.sessions[sub.Id] = sub
+	}
+	p.count++
+	return sub, OK
+}
+
+//查找长轮询会话，并刷新活跃时间
+func (p *SubscribeHub) Session(id string) (*Subscriber, bool) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	sub, ok := p.sessions[id]
+	if ok {
+		atomic.StoreInt64(&sub.active, Gtimer.Unix)
+	}
+	return sub, ok
+}
+
+func (p *SubscribeHub) Unsubscribe(sub *Subscriber, reason string) {
+	p.lock.Lock()
+	if subs, ok := p.topics[sub.Topic]; ok {
+		if _, ok := subs[sub]; ok {
+			delete(subs, sub)
+			p.count--
+		}
+		if len(subs) == 0 {
+			delete(p.topics, sub.Topic)
+		}
+	}
+	delete(p.sessions, sub.Id)
+	p.lock.Unlock()
+	sub.close(reason)
+}
+
+//投递到订阅者的缓冲区，缓冲区满的订阅者被断开
+func (p *SubscribeHub) Deliver(topic string, data string) {
+	evicted := []*Subscriber{}
+	p.lock.RLock()
+	for sub := range p.topics[topic] {
+		select {
+		case sub.Buffer <- data:
+			atomic.AddInt64(&SubscribeDelivered, 1)
+		default:
+			evicted = append(evicted, sub)
+		}
+	}
+	p.lock.RUnlock()
+
+	for _, sub := range evicted {
+		log.Warning("subscriber<%s> of topic<%s> too slow, evicted", sub.Id, topic)
+		atomic.AddInt64(&SubscribeEvicted, 1)
+		p.Unsubscribe(sub, SUBSCRIBE_CLOSE_EVICTED)
+	}
+}
+
+//删除长时间没有请求的长轮询会话
+func (p *SubscribeHub) expireSessions(expire int64) {
+	p.lock.RLock()
+	expired := []*Subscriber{}
+	for _, sub := range p.sessions {
+		if atomic.LoadInt64(&sub.active) < Gtimer.Unix-expire {
+			expired = append(expired, sub)
+		}
+	}
+	p.lock.RUnlock()
+
+	for _, sub := range expired {
+		log.Info("subscribe session<%s> of topic<%s> expired", sub.Id, sub.Topic)
+		p.Unsubscribe(sub, SUBSCRIBE_CLOSE_EXPIRED)
+	}
+}
+
+func (p *SubscribeHub) Stats() Dict {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return Dict{
+		"subscribers": p.count,
+		"sessions":    len(p.sessions),
+		"topics":      len(p.topics),
+		"delivered":   atomic.LoadInt64(&SubscribeDelivered),
+		"evicted":     atomic.LoadInt64(&SubscribeEvicted),
+	}
+}
+
+//没有 Origin 的请求不是来自浏览器页面，不检查
+func SubscribeOriginAllowed(origin string) bool {
+	if len(origin) == 0 {
+		return true
+	}
+	for _, allow := range configOpt.subscribeAllowOrigins {
+		if allow == "*" || strings.EqualFold(allow, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func StartSubscribe() {
+	if len(configOpt.urlSubscribe) == 0 {
+		return
+	}
+	if configOpt.subscribePollWait <= 0 {
+		configOpt.subscribePollWait = 30
+	}
+	if configOpt.subscribeSessionExpire <= configOpt.subscribePollWait {
+		configOpt.subscribeSessionExpire = configOpt.subscribePollWait * 2
+	}
+
+	go func() {
+		for {
+			<-time.After(time.Second * time.Duration(configOpt.subscribePollWait))
+			subscribeHub.expireSessions(int64(configOpt.subscribeSessionExpire))
+		}
+	}()
+}
+
+//websocket推送，直到连接断开或订阅被删除
+func ServeSubscribeWebsocket(conn *WebsocketConn, sub *Subscriber) {
+	done := make(chan bool)
+	go func() {
+		conn.ReadLoop()
+		close(done)
+	}()
+	defer conn.Close()
+
+	ping := time.NewTicker(time.Second * time.Duration(configOpt.subscribePollWait))
+	defer ping.Stop()
+	for {
+		select {
+		case msg := <-sub.Buffer:
+			if err := conn.WriteText(msg); err != nil {
+				return
+			}
+		case <-ping.C:
+			if err := conn.WriteFrame(WEBSOCKET_OP_PING, nil); err != nil {
+				return
+			}
+		case <-sub.Closed:
+			conn.WriteClose(WEBSOCKET_CLOSE_OVERLOAD, sub.Reason)
+			return
+		case <-done:
+			return
+		}
+	}
+}
+
+//长轮询，session 为空时新建会话
+func ServiceSubscribePoll(topic string, session string) (Dict, Error) {
+	var sub *Subscriber
+	if len(session) > 0 {
+		var ok bool
+		sub, ok = subscribeHub.Session(session)
+		if !ok || sub.Topic != topic {
+			return nil, NewError(INVALID_PARAM, nil, "invalid session")
+		}
+	} else {
+		var ret Error
+		sub, ret = subscribeHub.Subscribe(topic, true)
+		if !ret.Ok() {
+			return nil, ret
+		}
+	}
+
+	messages, ok := sub.Poll(time.Second * time.Duration(configOpt.subscribePollWait))
+	if !ok {
+		return nil, NewError(INVALID_PARAM, nil, sub.Reason)
+	}
+	//等待期间不算空闲
+	atomic.StoreInt64(&sub.active, Gtimer.Unix)
+
+	//消息本身就是json，原样返回
+	datas := make([]json.RawMessage, len(messages))
+	for i, msg := range messages {
+		datas[i] = json.RawMessage(msg)
+	}
+	data := Dict{
+		"session":  sub.Id,
+		"messages": datas,
+	}
+	return data, OK
+}
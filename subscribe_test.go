@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/yjp211/web"
+)
+
+func resetSubscribeHub(t *testing.T, buffer int) {
+	subscribeHub = &SubscribeHub{
+		topics:   map[string]map[*Subscriber]bool{},
+		sessions: map[string]*Subscriber{},
+	}
+	saved := configOpt
+	t.Cleanup(func() { configOpt = saved })
+	configOpt.subscribeBuffer = buffer
+	configOpt.subscribePollWait = 1
+	configOpt.subscribeMaxConn = 0
+}
+
+func pollMessages(t *testing.T, data Dict) []string {
+	messages := []string{}
+	for _, msg := range data["messages"].([]json.RawMessage) {
+		messages = append(messages, string(msg))
+	}
+	return messages
+}
+
+func TestSubscribePollSession(t *testing.T) {
+	resetSubscribeHub(t, 10)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		subscribeHub.Deliver("live/a", `{"n":1}`)
+	}()
+	data, ret := ServiceSubscribePoll("live/a", "")
+	if !ret.Ok() {
+		t.Fatalf("poll failed, %s", ret)
+	}
+	session := data["session"].(string)
+	if messages := pollMessages(t, data); len(messages) != 1 || messages[0] != `{"n":1}` {
+		t.Fatalf("unexpected messages %v", messages)
+	}
+
+	//两次请求之间的消息缓存在会话中，下次一起返回
+	subscribeHub.Deliver("live/a", `{"n":2}`)
+	subscribeHub.Deliver("live/b", `{"n":0}`)
+	subscribeHub.Deliver("live/a", `{"n":3}`)
+	data, ret = ServiceSubscribePoll("live/a", session)
+	if !ret.Ok() || data["session"] != session {
+		t.Fatalf("poll with session failed, %v %s", data, ret)
+	}
+	if messages := pollMessages(t, data); len(messages) != 2 || messages[1] != `{"n":3}` {
+		t.Fatalf("unexpected messages %v", messages)
+	}
+
+	//没有消息时等待 SubscribePollWait 后返回空
+	start := time.Now()
+	data, ret = ServiceSubscribePoll("live/a", session)
+	if !ret.Ok() || len(pollMessages(t, data)) != 0 || time.Since(start) < time.Second {
+		t.Fatalf("empty poll %v %s after %v", data, ret, time.Since(start))
+	}
+
+	for _, c := range []struct{ topic, session string }{
+		{"live/b", session},
+		{"live/a", "unknown"},
+	} {
+		if _, ret := ServiceSubscribePoll(c.topic, c.session); ret.Code != INVALID_PARAM {
+			t.Errorf("poll %s with session %s: %s", c.topic, c.session, ret)
+		}
+	}
+}
+
+func TestSubscribeSessionExpire(t *testing.T) {
+	resetSubscribeHub(t, 10)
+
+	sub, ret := subscribeHub.Subscribe("live/a", true)
+	if !ret.Ok() {
+		t.Fatalf("subscribe failed, %s", ret)
+	}
+	fresh, _ := subscribeHub.Subscribe("live/a", true)
+	atomic.StoreInt64(&sub.active, Gtimer.Unix-100)
+	subscribeHub.expireSessions(60)
+
+	if _, ok := subscribeHub.Session(sub.Id); ok {
+		t.Errorf("expired session still exists")
+	}
+	select {
+	case <-sub.Closed:
+		if sub.Reason != SUBSCRIBE_CLOSE_EXPIRED {
+			t.Errorf("close reason %s", sub.Reason)
+		}
+	default:
+		t.Errorf("expired session not closed")
+	}
+	if _, ok := subscribeHub.Session(fresh.Id); !ok {
+		t.Errorf("active session expired")
+	}
+	if _, ret := ServiceSubscribePoll("live/a", sub.Id); ret.Code != INVALID_PARAM {
+		t.Errorf("poll expired session: %s", ret)
+	}
+}
+
+func TestSubscribeEvictSlow(t *testing.T) {
+	resetSubscribeHub(t, 2)
+
+	slow, _ := subscribeHub.Subscribe("live/a", true)
+	fast, _ := subscribeHub.Subscribe("live/a", false)
+	for i := 0; i < 2; i++ {
+		subscribeHub.Deliver("live/a", `{}`)
+		<-fast.Buffer
+	}
+	//缓冲区满了以后的消息让慢的订阅者被断开
+	subscribeHub.Deliver("live/a", `{}`)
+
+	select {
+	case <-slow.Closed:
+		if slow.Reason != SUBSCRIBE_CLOSE_EVICTED {
+			t.Errorf("close reason %s", slow.Reason)
+		}
+	default:
+		t.Fatalf("slow subscriber not evicted")
+	}
+	if _, ok := subscribeHub.Session(slow.Id); ok {
+		t.Errorf("evicted session still exists")
+	}
+	if stats := subscribeHub.Stats(); stats["subscribers"] != 1 {
+		t.Errorf("unexpected stats %v", stats)
+	}
+	select {
+	case <-fast.Closed:
+		t.Errorf("fast subscriber evicted")
+	case msg := <-fast.Buffer:
+		if msg != `{}` {
+			t.Errorf("unexpected message %s", msg)
+		}
+	}
+}
+
+func serveSubscribe(params map[string]string, origin string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/provider/v1/subscribe", nil)
+	if len(origin) > 0 {
+		req.Header.Set("Origin", origin)
+	}
+	w := httptest.NewRecorder()
+	DoneSubscribe(&web.Context{Request: req, Params: params, ResponseWriter: w})
+	return w
+}
+
+func TestSubscribeOriginAndJsonp(t *testing.T) {
+	resetSubscribeHub(t, 10)
+	configOpt.subscribeAllowOrigins = []string{"https://www.example.com"}
+
+	w := serveSubscribe(map[string]string{"topic": "live/a"}, "https://evil.example")
+	result := Dict{}
+	json.Unmarshal(w.Body.Bytes(), &result)
+	if result["err_code"] != float64(NO_PERM) || len(w.Header().Get("Access-Control-Allow-Origin")) > 0 {
+		t.Errorf("origin not denied, %s", w.Body.String())
+	}
+
+	//callback 参数被忽略，返回的是json而不是脚本
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		subscribeHub.Deliver("live/a", `{"n":1}`)
+	}()
+	w = serveSubscribe(map[string]string{"topic": "live/a", "callback": "steal"}, "https://www.example.com")
+	result = Dict{}
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil || result["err_code"] != float64(200) {
+		t.Errorf("unexpected response %s", w.Body.String())
+	}
+	if w.Header().Get("Access-Control-Allow-Origin") != "https://www.example.com" {
+		t.Errorf("missing cors header, %v", w.Header())
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+/**
+ * 按topic的流控和消息去重
+ * 1、每个topic每秒最多接收的消息条数，规则和在线人数修饰一样: 先查具体topic，再查default
+ *    0 表示不限制
+ * 2、按 UpstreamId + topic 去重，同一条消息经过 relay、bridge 或客户端重试多次到达时只推送一次
+ *    同一条消息推送到多个topic时，每个topic各推送一次
+ *    使用新旧两代map，每个窗口周期轮换一次，保证去重时间在 [window, 2*window) 之间
+ */
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	TopicLimitMap              = map[string]int64{}
+	DefaultTopicLimit    int64 = 0
+	DefaultTopicLimitKey       = "default"
+
+	topicCount     = map[string]int64{}
+	topicCountLock sync.Mutex
+
+	DedupWindow int64 = 0
+	dedupCur          = map[string]bool{}
+	dedupPrev         = map[string]bool{}
+	dedupRotate int64 = 0
+	dedupLock   sync.Mutex
+
+	ThrottledCount int64 = 0 //因topic流控丢弃的消息数
+	DuplicateCount int64 = 0 //因重复丢弃的消息数
+)
+
+func InitTopicLimitMap(dmap map[string]interface{}) {
+	TopicLimitMap = map[string]int64{}
+	for k, v := range dmap {
+		val, ok := v.(float64)
+		if !ok {
+			continue
+		}
+		if k == DefaultTopicLimitKey {
+			DefaultTopicLimit = int64(val)
+			continue
+		}
+		TopicLimitMap[k] = int64(val)
+	}
+}
+
+func GetTopicLimit(topic string) int64 {
+	if v, ok := TopicLimitMap[topic]; ok {
+		return v
+	}
+	return DefaultTopicLimit
+}
+
+func ResetTopicCount() {
+	topicCountLock.Lock()
+	topicCount = map[string]int64{}
+	topicCountLock.Unlock()
+}
+
+func InrcTopicCountAndTryTrans(topic string) bool {
+	limit := GetTopicLimit(topic)
+	if limit <= 0 {
+		return true
+	}
+
+	topicCountLock.Lock()
+	defer topicCountLock.Unlock()
+
+	count := topicCount[topic] + 1
+	if count > limit {
+		atomic.AddInt64(&ThrottledCount, 1)
+		return false
+	}
+	topicCount[topic] = count
+	return true
+}
+
+func SetDedupWindow(window int) {
+	DedupWindow = int64(window)
+}
+
+//每秒调用一次，到达窗口周期则轮换
+func RotateDedup(now int64) {
+	if DedupWindow <= 0 {
+		return
+	}
+	dedupLock.Lock()
+	defer dedupLock.Unlock()
+
+	if now-dedupRotate < DedupWindow {
+		return
+	}
+	dedupPrev = dedupCur
+	dedupCur = map[string]bool{}
+	dedupRotate = now
+}
+
+func dedupKey(upstreamId string, topic string) string {
+	return upstreamId + "\x00" + topic
+}
+
+//第一次见到该消息返回true，重复消息返回false
+//检查和登记在一起，并发到达的重复消息只有一条能通过
+func MarkPublishSeen(upstreamId string, topic string) bool {
+	if DedupWindow <= 0 || len(upstreamId) == 0 {
+		return true
+	}
+	key := dedupKey(upstreamId, topic)
+	dedupLock.Lock()
+	defer dedupLock.Unlock()
+
+	if dedupCur[key] || dedupPrev[key] {
+		atomic.AddInt64(&DuplicateCount, 1)
+		return false
+	}
+	dedupCur[key] = true
+	return true
+}
+
+//消息被流控或过载保护丢弃时撤销登记，调用方用同一个id重试时还能推送
+func UnmarkPublishSeen(upstreamId string, topic string) {
+	if DedupWindow <= 0 || len(upstreamId) == 0 {
+		return
+	}
+	key := dedupKey(upstreamId, topic)
+	dedupLock.Lock()
+	defer dedupLock.Unlock()
+	delete(dedupCur, key)
+	delete(dedupPrev, key)
+}
+
+func GetThrottleStats() Dict {
+	return Dict{
+		"throttled": atomic.LoadInt64(&ThrottledCount),
+		"duplicate": atomic.LoadInt64(&DuplicateCount),
+	}
+}
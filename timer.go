@@ -22,6 +22,8 @@ func (p *Timer) Start() {
 
 			ResetCurCount()
 			ResetCurQps()
+			ResetTopicCount()
+			RotateDedup(p.Unix)
 
 		}
 
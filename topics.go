@@ -0,0 +1,94 @@
+package main
+
+/**
+ * 已知topic登记表，用于展开推送时的通配符
+ * 1、经过本节点推送流程(PushToLocal)的topic自动登记，集群内转发、集群间桥接的消息也会经过
+ *    超过 TopicRegistryExpire 秒没有消息的topic删除，最多登记 TopicRegistryMax 个
+ * 2、配置 PublishKnownTopics 中的topic常驻，用于从来没有推送过消息的topic
+ * 3、登记表是本节点的视图: 没有推送过消息、也没有配置的topic不会被通配符匹配到
+ */
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	topicRegistry = &TopicRegistry{
+		topics: map[string]int64{},
+		pinned: map[string]bool{},
+	}
+)
+
+type TopicRegistry struct {
+	topics map[string]int64 //topic -> 最后一次推送的时间
+	pinned map[string]bool
+	lock   sync.Mutex
+}
+
+func (p *TopicRegistry) Touch(topic string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if _, ok := p.topics[topic]; !ok && configOpt.topicRegistryMax > 0 &&
+		len(p.topics) >= configOpt.topicRegistryMax {
+		return
+	}
+	p.topics[topic] = Gtimer.Unix
+}
+
+func (p *TopicRegistry) Pin(topics []string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, topic := range topics {
+		p.pinned[topic] = true
+	}
+}
+
+//按字典序返回所有已知的topic
+func (p *TopicRegistry) Topics() []string {
+	p.lock.Lock()
+	topics := make([]string, 0, len(p.topics)+len(p.pinned))
+	for topic := range p.topics {
+		topics = append(topics, topic)
+	}
+	for topic := range p.pinned {
+		if _, ok := p.topics[topic]; !ok {
+			topics = append(topics, topic)
+		}
+	}
+	p.lock.Unlock()
+
+	sort.Strings(topics)
+	return topics
+}
+
+func (p *TopicRegistry) Len() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.topics)
+}
+
+func (p *TopicRegistry) expire(now int64, expire int64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for topic, last := range p.topics {
+		if last < now-expire {
+			delete(p.topics, topic)
+		}
+	}
+}
+
+func StartTopicRegistry() {
+	topicRegistry.Pin(configOpt.publishKnownTopics)
+	if configOpt.topicRegistryExpire <= 0 {
+		configOpt.topicRegistryExpire = 86400
+	}
+
+	go func() {
+		for {
+			<-time.After(time.Minute)
+			topicRegistry.expire(Gtimer.Unix, int64(configOpt.topicRegistryExpire))
+		}
+	}()
+}
@@ -0,0 +1,211 @@
+package main
+
+/**
+ * 最简单的websocket服务端(RFC 6455)，只用于向客户端推送文本消息
+ * 1、不支持扩展(压缩)和子协议
+ * 2、客户端发来的数据帧直接丢弃，只处理 ping 和 close
+ * 3、控制帧必须是完整的一帧且长度不超过125，否则按协议错误关闭连接
+ */
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	WEBSOCKET_GUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	WEBSOCKET_OP_CONTINUE = 0x0
+	WEBSOCKET_OP_TEXT     = 0x1
+	WEBSOCKET_OP_BINARY   = 0x2
+	WEBSOCKET_OP_CLOSE    = 0x8
+	WEBSOCKET_OP_PING     = 0x9
+	WEBSOCKET_OP_PONG     = 0xA
+
+	WEBSOCKET_CLOSE_NORMAL   = 1000
+	WEBSOCKET_CLOSE_PROTOCOL = 1002 //协议错误
+	WEBSOCKET_CLOSE_OVERLOAD = 1013 //稍后重试
+
+	//控制帧的最大长度(RFC 6455 5.5)
+	WEBSOCKET_MAX_CONTROL = 125
+
+	//客户端帧的最大长度，只推送不接收，不需要太大
+	WEBSOCKET_MAX_READ = 4096
+	//写超时
+	WEBSOCKET_WRITE_TIMEOUT = 10 * time.Second
+)
+
+var errWebsocketFrame = errors.New("invalid websocket frame")
+
+type WebsocketConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	lock   sync.Mutex //写锁
+}
+
+//是否是websocket握手请求
+func IsWebsocketRequest(req *http.Request) bool {
+	return req.Method == "GET" &&
+		strings.EqualFold(req.Header.Get("Upgrade"), "websocket") &&
+		strings.Contains(strings.ToLower(req.Header.Get("Connection")), "upgrade")
+}
+
+func websocketAccept(key string) string {
+	h := sha1.New()
+	io.WriteString(h, key+WEBSOCKET_GUID)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+//完成握手，接管底层连接
+func UpgradeWebsocket(w http.ResponseWriter, req *http.Request) (*WebsocketConn, error) {
+	if !IsWebsocketRequest(req) {
+		return nil, errors.New("not websocket request")
+	}
+	if req.Header.Get("Sec-Websocket-Version") != "13" {
+		return nil, errors.New("unsupported websocket version")
+	}
+	key := req.Header.Get("Sec-Websocket-Key")
+	if len(key) == 0 {
+		return nil, errors.New("missing websocket key")
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("connection can not be hijacked")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(WEBSOCKET_WRITE_TIMEOUT))
+	_, err = io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: "+websocketAccept(key)+"\r\n\r\n")
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &WebsocketConn{conn: conn, reader: rw.Reader}, nil
+}
+
+func (p *WebsocketConn) WriteFrame(opcode byte, payload []byte) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	header := make([]byte, 2, 10)
+	header[0] = 0x80 | opcode //FIN
+	switch n := len(payload); {
+	case n < 126:
+		header[1] = byte(n)
+	case n <= 0xFFFF:
+		header[1] = 126
+		header = header[:4]
+		binary.BigEndian.PutUint16(header[2:], uint16(n))
+	default:
+		header[1] = 127
+		header = header[:10]
+		binary.BigEndian.PutUint64(header[2:], uint64(n))
+	}
+
+	p.conn.SetWriteDeadline(time.Now().Add(WEBSOCKET_WRITE_TIMEOUT))
+	if _, err := p.conn.Write(header); err != nil {
+		return err
+	}
+	_, err := p.conn.Write(payload)
+	return err
+}
+
+func (p *WebsocketConn) WriteText(text string) error {
+	return p.WriteFrame(WEBSOCKET_OP_TEXT, []byte(text))
+}
+
+func (p *WebsocketConn) WriteClose(code int, reason string) error {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, reason...)
+	return p.WriteFrame(WEBSOCKET_OP_CLOSE, payload)
+}
+
+//读取一帧，客户端的帧必须带掩码
+func (p *WebsocketConn) ReadFrame() (byte, []byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(p.reader, header); err != nil {
+		return 0, nil, err
+	}
+	opcode := header[0] & 0x0F
+	if header[1]&0x80 == 0 {
+		return 0, nil, errWebsocketFrame
+	}
+	length := uint64(header[1] & 0x7F)
+	//控制帧不能分片，长度不用扩展字段
+	if opcode >= WEBSOCKET_OP_CLOSE && (header[0]&0x80 == 0 || length > WEBSOCKET_MAX_CONTROL) {
+		return 0, nil, errWebsocketFrame
+	}
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(p.reader, ext); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err := io.ReadFull(p.reader, ext); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext)
+	}
+	if length > WEBSOCKET_MAX_READ {
+		return 0, nil, errWebsocketFrame
+	}
+
+	mask := make([]byte, 4)
+	if _, err := io.ReadFull(p.reader, mask); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(p.reader, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return opcode, payload, nil
+}
+
+//处理客户端发来的帧直到连接关闭，返回时连接已关闭
+func (p *WebsocketConn) ReadLoop() {
+	defer p.conn.Close()
+	for {
+		opcode, payload, err := p.ReadFrame()
+		if err != nil {
+			if err == errWebsocketFrame {
+				p.WriteClose(WEBSOCKET_CLOSE_PROTOCOL, "")
+			}
+			return
+		}
+		switch opcode {
+		case WEBSOCKET_OP_PING:
+			if p.WriteFrame(WEBSOCKET_OP_PONG, payload) != nil {
+				return
+			}
+		case WEBSOCKET_OP_CLOSE:
+			p.WriteClose(WEBSOCKET_CLOSE_NORMAL, "")
+			return
+		}
+	}
+}
+
+func (p *WebsocketConn) Close() error {
+	return p.conn.Close()
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+//客户端的帧，带掩码
+func clientFrame(first byte, payload []byte) []byte {
+	frame := []byte{first}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, 0x80|byte(n))
+	default:
+		frame = append(frame, 0x80|126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(n))
+	}
+	mask := []byte{1, 2, 3, 4}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}
+
+func readTestFrame(t *testing.T, data []byte) (byte, []byte, error) {
+	server, client := net.Pipe()
+	defer server.Close()
+	go func() {
+		client.Write(data)
+		client.Close()
+	}()
+	conn := &WebsocketConn{conn: server, reader: bufio.NewReader(server)}
+	return conn.ReadFrame()
+}
+
+func TestWebsocketControlFrame(t *testing.T) {
+	long := make([]byte, WEBSOCKET_MAX_CONTROL+1)
+	cases := []struct {
+		name  string
+		frame []byte
+		ok    bool
+	}{
+		{"ping", clientFrame(0x80|WEBSOCKET_OP_PING, []byte("hi")), true},
+		{"max ping", clientFrame(0x80|WEBSOCKET_OP_PING, long[:WEBSOCKET_MAX_CONTROL]), true},
+		{"long ping", clientFrame(0x80|WEBSOCKET_OP_PING, long), false},
+		{"long close", clientFrame(0x80|WEBSOCKET_OP_CLOSE, long), false},
+		{"fragmented ping", clientFrame(WEBSOCKET_OP_PING, []byte("hi")), false},
+		{"long text", clientFrame(0x80|WEBSOCKET_OP_TEXT, long), true},
+	}
+	for _, c := range cases {
+		opcode, payload, err := readTestFrame(t, c.frame)
+		if c.ok && (err != nil || opcode != c.frame[0]&0x0F) {
+			t.Errorf("%s: opcode %d, err %v", c.name, opcode, err)
+		}
+		if c.ok && c.name == "ping" && string(payload) != "hi" {
+			t.Errorf("%s: payload %q", c.name, payload)
+		}
+		if !c.ok && err != errWebsocketFrame {
+			t.Errorf("%s: err %v, want invalid frame", c.name, err)
+		}
+	}
+}
+
+func TestSubscribeOrigin(t *testing.T) {
+	defer func(origins []string) { configOpt.subscribeAllowOrigins = origins }(configOpt.subscribeAllowOrigins)
+
+	configOpt.subscribeAllowOrigins = nil
+	if !SubscribeOriginAllowed("") || SubscribeOriginAllowed("https://evil.example") {
+		t.Errorf("empty allow list")
+	}
+	configOpt.subscribeAllowOrigins = []string{"https://www.example.com"}
+	if !SubscribeOriginAllowed("https://WWW.example.com") || SubscribeOriginAllowed("https://evil.example") {
+		t.Errorf("allow list")
+	}
+	configOpt.subscribeAllowOrigins = []string{"*"}
+	if !SubscribeOriginAllowed("https://evil.example") {
+		t.Errorf("allow all")
+	}
+}